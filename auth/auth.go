@@ -12,6 +12,10 @@ import (
 	"github.com/markbates/goth/providers/google"
 
 	"github.com/spy16/pgbase/errors"
+	"github.com/spy16/pgbase/log"
+	"github.com/spy16/pgbase/mailer"
+	"github.com/spy16/pgbase/sms"
+	"github.com/spy16/pgbase/strutils"
 )
 
 const defaultSessionCookie = "_pgbase_auth"
@@ -20,7 +24,7 @@ const defaultSessionCookie = "_pgbase_auth"
 var schema string
 
 // Init initialises auth module and returns.
-func Init(conn *pgx.Conn, baseURL string, cfg Config) (*Auth, error) {
+func Init(conn *pgx.Conn, baseURL string, cfg Config, opts ...Option) (*Auth, error) {
 	u, err := url.Parse(baseURL)
 	if err != nil {
 		return nil, errors.InvalidInput.Hintf("invalid baseURL").CausedBy(err)
@@ -36,42 +40,174 @@ func Init(conn *pgx.Conn, baseURL string, cfg Config) (*Auth, error) {
 		github.New(cfg.Github.ClientID, cfg.Github.ClientSecret, cbURL, cfg.Github.Scopes...),
 	)
 
+	for name, oidcConf := range cfg.OIDC {
+		goth.UseProviders(newOIDCProvider(name, cbURL, oidcConf))
+	}
+
 	if _, err := conn.Exec(context.Background(), schema); err != nil {
 		return nil, err
 	}
 
+	keys, err := newKeyring(cfg.SigningKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	hasher, err := cfg.PasswordHashing.hasher()
+	if err != nil {
+		return nil, err
+	}
+
 	au := &Auth{
-		cfg:  cfg,
-		conn: conn,
+		cfg:     cfg,
+		keys:    keys,
+		hasher:  hasher,
+		conn:    conn,
+		baseURL: u,
+		mailer:  mailer.Log{},
+		sms:     sms.Log{},
+	}
+
+	for _, opt := range opts {
+		opt(au)
+	}
+
+	if _, ok := au.mailer.(mailer.Log); ok {
+		log.Warn(context.Background(), "no mailer configured, mails will only be logged")
+	}
+
+	if _, ok := au.sms.(sms.Log); ok {
+		log.Warn(context.Background(), "no sms sender configured, text messages will only be logged")
+	}
+
+	if _, err := au.PruneEvents(context.Background()); err != nil {
+		return nil, err
 	}
 
 	return au, nil
 }
 
+// Option values can be provided to Init for customisation.
+type Option func(au *Auth)
+
+// WithMailer sets the mailer to be used for delivering emails. If no mailer
+// is set, only the recipients and subjects of mails are written to the log
+// and nothing is delivered.
+func WithMailer(m mailer.Mailer) Option {
+	return func(au *Auth) {
+		if m != nil {
+			au.mailer = m
+		}
+	}
+}
+
+// WithSMSSender sets the sender to be used for delivering text messages.
+// If no sender is set, only the recipients of messages are written to the
+// log and nothing is delivered.
+func WithSMSSender(s sms.Sender) Option {
+	return func(au *Auth) {
+		if s != nil {
+			au.sms = s
+		}
+	}
+}
+
+// WithPasswordHasher sets the hasher to be used for hashing passwords,
+// overriding the configured scheme. The hasher is also registered for
+// verifying the hashes it creates.
+func WithPasswordHasher(h PasswordHasher) Option {
+	return func(au *Auth) {
+		if h != nil {
+			RegisterPasswordHasher(h)
+			au.hasher = h
+		}
+	}
+}
+
 // Auth represents the auth module and implements user management and
 // authentication facilities.
 type Auth struct {
-	cfg  Config
-	conn *pgx.Conn
+	cfg     Config
+	keys    *keyring
+	conn    *pgx.Conn
+	baseURL *url.URL
+	mailer  mailer.Mailer
+	sms     sms.Sender
+	hasher  PasswordHasher
 }
 
 type Config struct {
+	// SessionTTL is the lifetime of the access tokens of sessions. Clients
+	// get new access tokens using the refresh token, which is valid for
+	// RefreshTTL.
 	SessionTTL    time.Duration `mapstructure:"session_ttl"`
+	RefreshTTL    time.Duration `mapstructure:"refresh_ttl"`
 	SessionCookie string        `mapstructure:"session_cookie"`
 	SigningSecret string        `mapstructure:"signing_secret"`
+	SigningKeys   []SigningKey  `mapstructure:"signing_keys"`
 	EnabledKinds  []string      `mapstructure:"enabled_kinds"`
+	NotifyLogins  bool          `mapstructure:"notify_logins"`
+
+	// MagicLinkSignup allows magic-link login for emails that are not
+	// registered yet. The user is created when the link is opened.
+	MagicLinkSignup bool `mapstructure:"magic_link_signup"`
+
+	// ReauthWindow is the duration after login within which sensitive
+	// changes (e.g., changing the email) do not need the password again.
+	ReauthWindow time.Duration `mapstructure:"reauth_window"`
+
+	RequireVerified      bool          `mapstructure:"require_verified"`
+	VerifyTokenTTL       time.Duration `mapstructure:"verify_token_ttl"`
+	VerifyResendInterval time.Duration `mapstructure:"verify_resend_interval"`
+
+	LoginPageRoute     string `mapstructure:"login_page_route"`
+	RegisterPageRoute  string `mapstructure:"register_page_route"`
+	ResetPageRoute     string `mapstructure:"reset_page_route"`
+	MFAPageRoute       string `mapstructure:"mfa_page_route"`
+	InvitePageRoute    string `mapstructure:"invite_page_route"`
+	ConsentPageRoute   string `mapstructure:"consent_page_route"`
+	MagicLinkPageRoute string `mapstructure:"magic_link_page_route"`
 
-	LoginPageRoute    string `mapstructure:"login_page_route"`
-	RegisterPageRoute string `mapstructure:"register_page_route"`
+	ResetTokenTTL time.Duration `mapstructure:"reset_token_ttl"`
+	MagicLinkTTL  time.Duration `mapstructure:"magic_link_ttl"`
+	OTPTTL        time.Duration `mapstructure:"otp_ttl"`
+	OrgInviteTTL  time.Duration `mapstructure:"org_invite_ttl"`
 
-	Google OAuthConf `mapstructure:"google"`
-	Github OAuthConf `mapstructure:"github"`
+	// OTPResendInterval is the minimum interval between one-time codes
+	// sent to the same destination.
+	OTPResendInterval time.Duration `mapstructure:"otp_resend_interval"`
+
+	// OAuthAccessTTL is the lifetime of access and ID tokens issued to
+	// OAuth clients of the authorization server.
+	OAuthAccessTTL time.Duration `mapstructure:"oauth_access_ttl"`
+
+	TOTPIssuer      string        `mapstructure:"totp_issuer"`
+	MFAChallengeTTL time.Duration `mapstructure:"mfa_challenge_ttl"`
+
+	WebAuthn WebAuthnConf `mapstructure:"webauthn"`
+
+	LoginThrottle   LoginThrottleConf `mapstructure:"login_throttle"`
+	PasswordPolicy  PasswordPolicy    `mapstructure:"password_policy"`
+	PasswordHashing PasswordHashConf  `mapstructure:"password_hashing"`
+
+	// EventRetention is the duration for which audit log events are kept.
+	EventRetention time.Duration `mapstructure:"event_retention"`
+
+	Google OAuthConf           `mapstructure:"google"`
+	Github OAuthConf           `mapstructure:"github"`
+	OIDC   map[string]OIDCConf `mapstructure:"oidc"`
 }
 
 type OAuthConf struct {
 	Scopes       []string `mapstructure:"scopes"`
 	ClientID     string   `mapstructure:"client_id"`
 	ClientSecret string   `mapstructure:"client_secret"`
+
+	// AutoLinkVerifiedEmail links an identity of this provider to an
+	// existing user with the same email if the provider asserts that the
+	// email is verified. Enable only for providers trusted to verify the
+	// emails they assert.
+	AutoLinkVerifiedEmail bool `mapstructure:"auto_link_verified_email"`
 }
 
 func (cfg *Config) sanitise(u *url.URL) error {
@@ -83,16 +219,129 @@ func (cfg *Config) sanitise(u *url.URL) error {
 		cfg.LoginPageRoute = u.JoinPath(cfg.LoginPageRoute).String()
 	}
 
+	if cfg.ResetPageRoute != "" {
+		cfg.ResetPageRoute = u.JoinPath(cfg.ResetPageRoute).String()
+	}
+
+	if cfg.ConsentPageRoute != "" {
+		cfg.ConsentPageRoute = u.JoinPath(cfg.ConsentPageRoute).String()
+	}
+
+	if cfg.InvitePageRoute != "" {
+		cfg.InvitePageRoute = u.JoinPath(cfg.InvitePageRoute).String()
+	}
+
+	if cfg.MagicLinkPageRoute != "" {
+		cfg.MagicLinkPageRoute = u.JoinPath(cfg.MagicLinkPageRoute).String()
+	}
+
+	if cfg.MFAPageRoute != "" {
+		cfg.MFAPageRoute = u.JoinPath(cfg.MFAPageRoute).String()
+	} else {
+		cfg.MFAPageRoute = cfg.LoginPageRoute
+	}
+
 	if cfg.SessionTTL <= 0 {
-		cfg.SessionTTL = 12 * time.Hour
+		cfg.SessionTTL = 15 * time.Minute
+	}
+
+	if cfg.RefreshTTL <= 0 {
+		cfg.RefreshTTL = 30 * 24 * time.Hour
+	}
+
+	if cfg.ReauthWindow <= 0 {
+		cfg.ReauthWindow = 10 * time.Minute
+	}
+
+	if cfg.VerifyTokenTTL <= 0 {
+		cfg.VerifyTokenTTL = 24 * time.Hour
+	}
+
+	if cfg.VerifyResendInterval <= 0 {
+		cfg.VerifyResendInterval = 1 * time.Minute
+	}
+
+	if cfg.ResetTokenTTL <= 0 {
+		cfg.ResetTokenTTL = 1 * time.Hour
+	}
+
+	if cfg.MagicLinkTTL <= 0 {
+		cfg.MagicLinkTTL = 15 * time.Minute
+	}
+
+	if cfg.OTPTTL <= 0 {
+		cfg.OTPTTL = 10 * time.Minute
+	}
+
+	if cfg.OTPResendInterval <= 0 {
+		cfg.OTPResendInterval = 1 * time.Minute
+	}
+
+	if cfg.OAuthAccessTTL <= 0 {
+		cfg.OAuthAccessTTL = 1 * time.Hour
+	}
+
+	if cfg.OrgInviteTTL <= 0 {
+		cfg.OrgInviteTTL = 7 * 24 * time.Hour
+	}
+
+	if cfg.TOTPIssuer == "" {
+		cfg.TOTPIssuer = u.Hostname()
+	}
+
+	if cfg.MFAChallengeTTL <= 0 {
+		cfg.MFAChallengeTTL = 5 * time.Minute
+	}
+
+	if cfg.WebAuthn.RPID == "" {
+		cfg.WebAuthn.RPID = u.Hostname()
+	}
+
+	if cfg.WebAuthn.RPName == "" {
+		cfg.WebAuthn.RPName = cfg.TOTPIssuer
+	}
+
+	if len(cfg.WebAuthn.Origins) == 0 {
+		cfg.WebAuthn.Origins = []string{u.Scheme + "://" + u.Host}
+	}
+
+	cfg.LoginThrottle.sanitise()
+	cfg.PasswordPolicy.sanitise()
+
+	if cfg.EventRetention <= 0 {
+		cfg.EventRetention = 90 * 24 * time.Hour
 	}
 
 	if cfg.SessionCookie == "" {
 		cfg.SessionCookie = defaultSessionCookie
 	}
 
-	if cfg.SigningSecret == "" {
-		return errors.InvalidInput.Hintf("signing_secret is required")
+	if cfg.SigningSecret != "" {
+		// The plain secret acts as the default key so that configs (and
+		// tokens) from before keyring support continue to work.
+		state := KeyStateActive
+		for _, k := range cfg.SigningKeys {
+			if k.State == KeyStateActive {
+				state = KeyStateVerifyOnly
+			}
+		}
+		cfg.SigningKeys = append(cfg.SigningKeys, SigningKey{
+			ID:     defaultKeyID,
+			Secret: cfg.SigningSecret,
+			State:  state,
+		})
+	} else if len(cfg.SigningKeys) == 0 {
+		return errors.InvalidInput.Hintf("signing_secret or signing_keys is required")
+	}
+
+	for name, oidcConf := range cfg.OIDC {
+		if !keyKindPattern.MatchString(name) {
+			return errors.InvalidInput.Hintf("oidc provider name '%s' is not valid", name)
+		} else if strutils.OneOf(name, reservedKeyKinds) {
+			return errors.InvalidInput.Hintf("oidc provider name '%s' is reserved", name)
+		} else if oidcConf.DiscoveryURL == "" || oidcConf.ClientID == "" {
+			return errors.InvalidInput.Hintf("oidc provider '%s' needs discovery_url and client_id", name)
+		}
 	}
 
 	if len(cfg.EnabledKinds) == 0 {
@@ -0,0 +1,256 @@
+package auth
+
+import (
+	"context"
+	"encoding/base64"
+	"strings"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+
+	"github.com/spy16/pgbase/errors"
+)
+
+// PermManageUsers is the permission required for the admin operations
+// exposed by AdminRoutes.
+const PermManageUsers = "users:manage"
+
+const (
+	defaultUsersPageSize = 50
+	maxUsersPageSize     = 500
+)
+
+var errInvalidCursor = errors.InvalidInput.Coded("invalid_cursor")
+
+// UserFilter specifies the criteria for listing users. Zero values are
+// ignored.
+type UserFilter struct {
+	Kind          string     `json:"kind"`
+	Verified      *bool      `json:"verified"`
+	Disabled      *bool      `json:"disabled"`
+	EmailPrefix   string     `json:"email_prefix"`
+	CreatedAfter  *time.Time `json:"created_after"`
+	CreatedBefore *time.Time `json:"created_before"`
+
+	// Cursor is the NextCursor of the previous page. Limit is the max
+	// number of users to return.
+	Cursor string `json:"cursor"`
+	Limit  int    `json:"limit"`
+}
+
+// UserPage is a page of users returned by ListUsers. NextCursor is empty
+// if there are no more users.
+type UserPage struct {
+	Users      []User `json:"users"`
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// ListUsers returns users matching the filter, newest first.
+func (auth *Auth) ListUsers(ctx context.Context, filter UserFilter) (*UserPage, error) {
+	if filter.Limit <= 0 {
+		filter.Limit = defaultUsersPageSize
+	} else if filter.Limit > maxUsersPageSize {
+		filter.Limit = maxUsersPageSize
+	}
+
+	qb := sq.Select("id", "kind", "user_data", "email", "username", "created_at",
+		"updated_at", "verified_at", "disabled_at", "phone").
+		From("users").
+		OrderBy("created_at DESC", "id DESC").
+		Limit(uint64(filter.Limit + 1))
+
+	if filter.Kind != "" {
+		qb = qb.Where(sq.Eq{"kind": filter.Kind})
+	}
+	if filter.Verified != nil {
+		qb = qb.Where(nullFilter("verified_at", *filter.Verified))
+	}
+	if filter.Disabled != nil {
+		qb = qb.Where(nullFilter("disabled_at", *filter.Disabled))
+	}
+	if filter.EmailPrefix != "" {
+		qb = qb.Where(sq.ILike{"email": escapeLike(filter.EmailPrefix) + "%"})
+	}
+	if filter.CreatedAfter != nil {
+		qb = qb.Where(sq.GtOrEq{"created_at": *filter.CreatedAfter})
+	}
+	if filter.CreatedBefore != nil {
+		qb = qb.Where(sq.Lt{"created_at": *filter.CreatedBefore})
+	}
+	if filter.Cursor != "" {
+		createdAt, id, err := decodeUserCursor(filter.Cursor)
+		if err != nil {
+			return nil, err
+		}
+		qb = qb.Where(sq.Expr("(created_at, id) < (?, ?)", createdAt, id))
+	}
+
+	q, args, err := qb.PlaceholderFormat(sq.Dollar).ToSql()
+	if err != nil {
+		return nil, errors.InternalIssue.CausedBy(err)
+	}
+
+	rows, err := auth.conn.Query(ctx, q, args...)
+	if err != nil {
+		return nil, translateErr(err)
+	}
+	defer rows.Close()
+
+	page := UserPage{Users: []User{}}
+	for rows.Next() {
+		var u User
+		if err := rows.Scan(&u.ID, &u.Kind, &u.Data, &u.Email, &u.Username, &u.CreatedAt,
+			&u.UpdatedAt, &u.VerifiedAt, &u.DisabledAt, &u.Phone); err != nil {
+			return nil, translateErr(err)
+		}
+		page.Users = append(page.Users, u)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, translateErr(err)
+	}
+
+	if len(page.Users) > filter.Limit {
+		page.Users = page.Users[:filter.Limit]
+		last := page.Users[len(page.Users)-1]
+		page.NextCursor = encodeUserCursor(last.CreatedAt, last.ID)
+	}
+	return &page, nil
+}
+
+// DisableUser disables the user and revokes all their sessions. Disabled
+// users cannot login and their existing tokens and API keys are rejected.
+func (auth *Auth) DisableUser(ctx context.Context, userID string) error {
+	return auth.setDisabled(ctx, userID, true)
+}
+
+// EnableUser re-enables a previously disabled user.
+func (auth *Auth) EnableUser(ctx context.Context, userID string) error {
+	return auth.setDisabled(ctx, userID, false)
+}
+
+// DeleteUser permanently deletes the user and all data owned by the user
+// in the auth module. Returns errors.Conflict if the user is the only
+// owner of an organization.
+func (auth *Auth) DeleteUser(ctx context.Context, userID string) error {
+	tx, err := auth.conn.Begin(ctx)
+	if err != nil {
+		return translateErr(err)
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	var soleOwnerOf int
+	err = tx.QueryRow(ctx, `SELECT count(*) FROM org_members AS m
+		WHERE m.user_id=$1 AND m.role=$2 AND NOT EXISTS (
+			SELECT 1 FROM org_members AS o WHERE o.org_id=m.org_id AND o.role=$2 AND o.user_id<>$1
+		)`, userID, OrgRoleOwner).Scan(&soleOwnerOf)
+	if err != nil {
+		return translateErr(err)
+	} else if soleOwnerOf > 0 {
+		return errors.Conflict.Coded("sole_org_owner").
+			Hintf("user is the only owner of %d org(s)", soleOwnerOf)
+	}
+
+	// Order matters since the child tables reference users and sessions.
+	deletes := []sq.DeleteBuilder{
+		sq.Delete("refresh_tokens").Where(sq.Expr("session_id IN (SELECT id FROM sessions WHERE user_id=?)", userID)),
+		sq.Delete("sessions").Where(sq.Eq{"user_id": userID}),
+		sq.Delete("user_tokens").Where(sq.Eq{"user_id": userID}),
+		sq.Delete("user_tokens").Where(sq.Expr("attribs->>'user_id'=?", userID)),
+		sq.Delete("user_keys").Where(sq.Eq{"user_id": userID}),
+		sq.Delete("api_keys").Where(sq.Eq{"user_id": userID}),
+		sq.Delete("user_roles").Where(sq.Eq{"user_id": userID}),
+		sq.Delete("org_members").Where(sq.Eq{"user_id": userID}),
+	}
+	for _, del := range deletes {
+		q, args, err := del.PlaceholderFormat(sq.Dollar).ToSql()
+		if err != nil {
+			return errors.InternalIssue.CausedBy(err)
+		}
+
+		if _, err := tx.Exec(ctx, q, args...); err != nil {
+			return translateErr(err)
+		}
+	}
+
+	tag, err := tx.Exec(ctx, "DELETE FROM users WHERE id=$1", userID)
+	if err != nil {
+		return translateErr(err)
+	} else if tag.RowsAffected() == 0 {
+		return errors.NotFound.Coded("user_not_found")
+	}
+
+	return translateErr(tx.Commit(ctx))
+}
+
+func (auth *Auth) setDisabled(ctx context.Context, userID string, disabled bool) error {
+	now := time.Now()
+
+	var disabledAt *time.Time
+	if disabled {
+		disabledAt = &now
+	}
+
+	tx, err := auth.conn.Begin(ctx)
+	if err != nil {
+		return translateErr(err)
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	q, args, err := sq.Update("users").
+		Where(sq.Eq{"id": userID}).
+		Set("disabled_at", disabledAt).
+		Set("updated_at", now).
+		PlaceholderFormat(sq.Dollar).ToSql()
+	if err != nil {
+		return errors.InternalIssue.CausedBy(err)
+	}
+
+	tag, err := tx.Exec(ctx, q, args...)
+	if err != nil {
+		return translateErr(err)
+	} else if tag.RowsAffected() == 0 {
+		return errors.NotFound.Coded("user_not_found")
+	}
+
+	if disabled {
+		if err := revokeSessions(ctx, tx, sq.Eq{"user_id": userID}); err != nil {
+			return err
+		}
+	}
+
+	return translateErr(tx.Commit(ctx))
+}
+
+func nullFilter(col string, notNull bool) sq.Sqlizer {
+	if notNull {
+		return sq.NotEq{col: nil}
+	}
+	return sq.Eq{col: nil}
+}
+
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+func encodeUserCursor(createdAt time.Time, id string) string {
+	raw := createdAt.UTC().Format(time.RFC3339Nano) + "|" + id
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func decodeUserCursor(cursor string) (time.Time, string, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return time.Time{}, "", errInvalidCursor.CausedBy(err)
+	}
+
+	ts, id, found := strings.Cut(string(raw), "|")
+	if !found || id == "" {
+		return time.Time{}, "", errInvalidCursor.Hintf("malformed cursor")
+	}
+
+	createdAt, err := time.Parse(time.RFC3339Nano, ts)
+	if err != nil {
+		return time.Time{}, "", errInvalidCursor.CausedBy(err)
+	}
+	return createdAt, id, nil
+}
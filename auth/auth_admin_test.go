@@ -0,0 +1,33 @@
+package auth
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUserCursor(t *testing.T) {
+	t.Parallel()
+
+	createdAt := time.Date(2023, 4, 5, 6, 7, 8, 123456000, time.UTC)
+	cursor := encodeUserCursor(createdAt, "abc123")
+
+	gotAt, gotID, err := decodeUserCursor(cursor)
+	require.NoError(t, err)
+	assert.True(t, createdAt.Equal(gotAt))
+	assert.Equal(t, "abc123", gotID)
+
+	for _, bad := range []string{"%%%", "bm9zZXBhcmF0b3I", "bm90LWEtdGltZXxhYmM"} {
+		_, _, err := decodeUserCursor(bad)
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestEscapeLike(t *testing.T) {
+	t.Parallel()
+
+	assert.Equal(t, `bob\_smith\%`, escapeLike("bob_smith%"))
+	assert.Equal(t, `a\\b`, escapeLike(`a\b`))
+}
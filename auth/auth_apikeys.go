@@ -0,0 +1,201 @@
+package auth
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/jackc/pgx/v5"
+
+	"github.com/spy16/pgbase/errors"
+	"github.com/spy16/pgbase/strutils"
+)
+
+// apiKeyPrefix is prepended to all API key tokens so that they can be
+// told apart from session tokens (and spotted by secret scanners).
+const apiKeyPrefix = "pgb_"
+
+const maxAPIKeyNameLen = 64
+
+// APIKey represents a long-lived, revocable credential of a user that
+// can be used in place of a session token.
+type APIKey struct {
+	ID         string     `json:"id"`
+	UserID     string     `json:"user_id"`
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+
+	// Token is the plaintext token. It is set only when the key is
+	// created and cannot be retrieved afterwards.
+	Token string `json:"token,omitempty"`
+}
+
+// CreateAPIKey creates a new API key for the user. Only a hash of the
+// token is stored, so the returned key is the only place the plaintext
+// token is available.
+func (auth *Auth) CreateAPIKey(ctx context.Context, userID, name string, scopes []string, expiresAt *time.Time) (*APIKey, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || len(name) > maxAPIKeyNameLen {
+		return nil, errors.InvalidInput.Coded("invalid_name").
+			Hintf("name must be 1-%d characters", maxAPIKeyNameLen)
+	}
+
+	for _, scope := range scopes {
+		if strings.TrimSpace(scope) == "" || strings.ContainsAny(scope, " \t\n") {
+			return nil, errors.InvalidInput.Coded("invalid_scope").Hintf("scope '%s' is not valid", scope)
+		}
+	}
+	if scopes == nil {
+		scopes = []string{}
+	}
+
+	now := time.Now()
+	if expiresAt != nil && !expiresAt.After(now) {
+		return nil, errors.InvalidInput.Coded("invalid_expiry").Hintf("expiry must be in the future")
+	}
+
+	key := APIKey{
+		ID:        strutils.RandStr(10),
+		UserID:    userID,
+		Name:      name,
+		Scopes:    scopes,
+		CreatedAt: now,
+		ExpiresAt: expiresAt,
+		Token:     apiKeyPrefix + newSecretToken(),
+	}
+
+	q, args, err := sq.Insert("api_keys").
+		Columns("id", "user_id", "name", "token_hash", "scopes", "created_at", "expires_at").
+		Values(key.ID, key.UserID, key.Name, hashToken(key.Token), key.Scopes, key.CreatedAt, key.ExpiresAt).
+		PlaceholderFormat(sq.Dollar).ToSql()
+	if err != nil {
+		return nil, errors.InternalIssue.CausedBy(err)
+	}
+
+	if _, err := auth.conn.Exec(ctx, q, args...); err != nil {
+		return nil, translateErr(err)
+	}
+
+	auth.recordEvent(ctx, EventAPIKeyCreated, userID, map[string]any{
+		"api_key_id": key.ID,
+		"name":       key.Name,
+	})
+	return &key, nil
+}
+
+// ListAPIKeys returns all the API keys of the user that have not been
+// revoked.
+func (auth *Auth) ListAPIKeys(ctx context.Context, userID string) ([]APIKey, error) {
+	q, args, err := sq.Select("id", "user_id", "name", "scopes", "created_at", "expires_at", "last_used_at", "revoked_at").
+		From("api_keys").
+		Where(sq.Eq{
+			"user_id":    userID,
+			"revoked_at": nil,
+		}).
+		OrderBy("created_at DESC").
+		PlaceholderFormat(sq.Dollar).ToSql()
+	if err != nil {
+		return nil, errors.InternalIssue.CausedBy(err)
+	}
+
+	rows, err := auth.conn.Query(ctx, q, args...)
+	if err != nil {
+		return nil, translateErr(err)
+	}
+	defer rows.Close()
+
+	res := []APIKey{}
+	for rows.Next() {
+		var k APIKey
+		if err := rows.Scan(&k.ID, &k.UserID, &k.Name, &k.Scopes, &k.CreatedAt,
+			&k.ExpiresAt, &k.LastUsedAt, &k.RevokedAt); err != nil {
+			return nil, translateErr(err)
+		}
+		res = append(res, k)
+	}
+	return res, translateErr(rows.Err())
+}
+
+// RevokeAPIKey revokes the API key of the user. Returns errors.NotFound
+// if no such active key exists.
+func (auth *Auth) RevokeAPIKey(ctx context.Context, userID, keyID string) error {
+	q, args, err := sq.Update("api_keys").
+		Where(sq.Eq{
+			"id":         keyID,
+			"user_id":    userID,
+			"revoked_at": nil,
+		}).
+		Set("revoked_at", time.Now()).
+		PlaceholderFormat(sq.Dollar).ToSql()
+	if err != nil {
+		return errors.InternalIssue.CausedBy(err)
+	}
+
+	tag, err := auth.conn.Exec(ctx, q, args...)
+	if err != nil {
+		return translateErr(err)
+	} else if tag.RowsAffected() == 0 {
+		return errors.NotFound.Coded("api_key_not_found")
+	}
+
+	auth.recordEvent(ctx, EventAPIKeyRevoked, userID, map[string]any{"api_key_id": keyID})
+	return nil
+}
+
+// restoreAPIKeySession verifies the API key token and returns a session
+// representing it. The last-used timestamp of the key is updated. Unlike
+// session tokens, grants are resolved from the database on every use.
+func (auth *Auth) restoreAPIKeySession(ctx context.Context, token string) (*Session, error) {
+	var errToken = errors.MissingAuth.Coded("invalid_token")
+
+	now := time.Now()
+	roles, perms := grantsQuery("api_keys.user_id")
+	q, args, err := sq.Update("api_keys").
+		Where(sq.Eq{
+			"token_hash": hashToken(token),
+			"revoked_at": nil,
+		}).
+		Where(sq.Or{
+			sq.Eq{"expires_at": nil},
+			sq.Gt{"expires_at": now},
+		}).
+		Set("last_used_at", now).
+		Suffix(`RETURNING id, user_id, scopes, expires_at,
+			(SELECT u.kind FROM users AS u WHERE u.id=api_keys.user_id),
+			(SELECT u.verified_at FROM users AS u WHERE u.id=api_keys.user_id),
+			(SELECT u.disabled_at FROM users AS u WHERE u.id=api_keys.user_id),
+			` + roles + `, ` + perms).
+		PlaceholderFormat(sq.Dollar).ToSql()
+	if err != nil {
+		return nil, errors.InternalIssue.CausedBy(err)
+	}
+
+	var sess Session
+	var expiresAt, verifiedAt, disabledAt *time.Time
+	row := auth.conn.QueryRow(ctx, q, args...)
+	if err := row.Scan(&sess.APIKeyID, &sess.UserID, &sess.Scopes, &expiresAt, &sess.UserKind, &verifiedAt,
+		&disabledAt, &sess.Roles, &sess.Permissions); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, errToken.Hintf("api key is invalid, expired or revoked")
+		}
+		return nil, translateErr(err)
+	} else if disabledAt != nil {
+		return nil, errDisabled
+	}
+
+	sess.Token = token
+	sess.Verified = verifiedAt != nil
+	if expiresAt != nil {
+		sess.ExpiresAt = *expiresAt
+	}
+	return &sess, nil
+}
+
+func isAPIKey(token string) bool {
+	return strings.HasPrefix(token, apiKeyPrefix)
+}
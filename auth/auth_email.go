@@ -0,0 +1,141 @@
+package auth
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+
+	"github.com/spy16/pgbase/errors"
+	"github.com/spy16/pgbase/strutils"
+)
+
+var errEmailTaken = errors.Conflict.Coded("email_taken").Hintf("email is used by another account")
+
+// RequestEmailChange stages the new email for the user and sends a
+// confirmation link to it. A notice is sent to the current email. The
+// email of the user is changed only once the link is confirmed using
+// ConfirmEmailChange. Any previously staged change is discarded. Callers
+// must ensure that the user has re-authenticated (see checkReauth).
+func (auth *Auth) RequestEmailChange(ctx context.Context, userID, newEmail string) error {
+	newEmail = strings.TrimSpace(newEmail)
+	if !strutils.IsValidEmail(newEmail) {
+		return errors.InvalidInput.Hintf("invalid email")
+	}
+
+	u, err := auth.GetUser(ctx, NewAuthKey(KeyKindID, userID))
+	if err != nil {
+		return err
+	} else if strings.EqualFold(u.Email, newEmail) {
+		return errors.InvalidInput.Coded("same_email").Hintf("new email is same as the current")
+	}
+
+	if _, err := auth.GetUser(ctx, NewAuthKey(KeyKindEmail, newEmail)); err == nil {
+		return errEmailTaken
+	} else if !errors.Is(err, errors.NotFound) {
+		return err
+	}
+
+	expiresAt := time.Now().Add(auth.cfg.VerifyTokenTTL)
+	token, err := issueToken(ctx, auth.conn, tokenKindEmailChange, &u.ID, auth.cfg.VerifyTokenTTL, map[string]any{
+		"email": newEmail,
+	})
+	if err != nil {
+		return err
+	}
+
+	link := withQuery(auth.baseURL.JoinPath("/email/confirm").String(), map[string]string{
+		"token": token,
+	})
+
+	data := map[string]any{
+		"User":      u.Clone(true),
+		"NewEmail":  newEmail,
+		"Link":      link,
+		"ExpiresAt": expiresAt,
+	}
+	auth.sendMail(ctx, mailEmailChange, newEmail, data)
+	auth.sendMail(ctx, mailEmailChangeNotice, u.Email, data)
+	return nil
+}
+
+// ConfirmEmailChange swaps the email of the user with the one staged by
+// RequestEmailChange. Since the token was delivered to the new email, the
+// user is marked as verified. Outstanding password reset, magic-link and
+// login code tokens are invalidated. Returns errors.Conflict if the email has
+// been taken by another account in the meantime.
+func (auth *Auth) ConfirmEmailChange(ctx context.Context, token string) (*User, error) {
+	var errToken = errors.MissingAuth.Coded("invalid_email_change_token")
+
+	tx, err := auth.conn.Begin(ctx)
+	if err != nil {
+		return nil, translateErr(err)
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	ut, err := consumeToken(ctx, tx, tokenKindEmailChange, strings.TrimSpace(token))
+	if err != nil {
+		if errors.Is(err, errors.NotFound) {
+			return nil, errToken
+		}
+		return nil, err
+	} else if ut.UserID == nil {
+		return nil, errToken.Hintf("token has no user")
+	}
+
+	newEmail, _ := ut.Attribs["email"].(string)
+	if newEmail == "" {
+		return nil, errToken.Hintf("token has no email")
+	}
+
+	// The sub-select in RETURNING reads from the snapshot taken when the
+	// statement started, so it sees the row before this update and yields
+	// the old email. A plain 'RETURNING email' would give the new one.
+	now := time.Now()
+	q, args, err := sq.Update("users").
+		Where(sq.Eq{"id": *ut.UserID}).
+		Set("email", newEmail).
+		Set("verified_at", now).
+		Set("updated_at", now).
+		Suffix("RETURNING (SELECT email FROM users WHERE id=?)", *ut.UserID).
+		PlaceholderFormat(sq.Dollar).ToSql()
+	if err != nil {
+		return nil, errors.InternalIssue.CausedBy(err)
+	}
+
+	var oldEmail string
+	if err := tx.QueryRow(ctx, q, args...).Scan(&oldEmail); err != nil {
+		if err = translateErr(err); errors.Is(err, errors.Conflict) {
+			return nil, errEmailTaken
+		}
+		return nil, err
+	}
+
+	// Links and codes sent to the old email must not work anymore.
+	q, args, err = sq.Update("user_tokens").
+		Where(sq.Eq{
+			"user_id": *ut.UserID,
+			"kind":    []string{tokenKindPasswordReset, tokenKindMagicLink, tokenKindLoginOTP},
+			"used_at": nil,
+		}).
+		Set("used_at", now).
+		PlaceholderFormat(sq.Dollar).ToSql()
+	if err != nil {
+		return nil, errors.InternalIssue.CausedBy(err)
+	}
+
+	if _, err := tx.Exec(ctx, q, args...); err != nil {
+		return nil, translateErr(err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, translateErr(err)
+	}
+
+	auth.recordEvent(ctx, EventEmailChanged, *ut.UserID, map[string]any{
+		"old_email": oldEmail,
+		"new_email": newEmail,
+	})
+	return auth.GetUser(ctx, NewAuthKey(KeyKindID, *ut.UserID))
+}
@@ -0,0 +1,94 @@
+package auth
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/spy16/pgbase/errors"
+)
+
+func TestEmailChange(t *testing.T) {
+	rm := &recordingMailer{}
+	au := newTestAuth(t, Config{}, WithMailer(rm))
+	ctx := context.Background()
+
+	alice := registerTestUser(t, au, "alice@example.com", "Correct-Horse-42")
+	registerTestUser(t, au, "bob@example.com", "Battery-Staple-77")
+
+	t.Run("Invalid", func(t *testing.T) {
+		err := au.RequestEmailChange(ctx, alice.ID, "not-an-email")
+		assert.True(t, errors.Is(err, errors.InvalidInput), "got %v", err)
+
+		err = au.RequestEmailChange(ctx, alice.ID, "ALICE@example.com")
+		assert.Equal(t, "same_email", errors.E(err).Code)
+
+		err = au.RequestEmailChange(ctx, alice.ID, "bob@example.com")
+		assert.Equal(t, "email_taken", errors.E(err).Code)
+
+		_, err = au.ConfirmEmailChange(ctx, "bogus")
+		assert.Equal(t, "invalid_email_change_token", errors.E(err).Code)
+	})
+
+	t.Run("Confirm", func(t *testing.T) {
+		require.NoError(t, au.RequestEmailChange(ctx, alice.ID, "alice@example.org"))
+		require.Len(t, rm.sent("alice@example.com"), 1, "notice must go to the current email")
+
+		token := emailChangeToken(t, rm, "alice@example.org")
+
+		u, err := au.ConfirmEmailChange(ctx, token)
+		require.NoError(t, err)
+		assert.Equal(t, "alice@example.org", u.Email)
+		assert.NotNil(t, u.VerifiedAt)
+
+		page, err := au.ListEvents(ctx, EventFilter{UserID: alice.ID, Kind: EventEmailChanged})
+		require.NoError(t, err)
+		require.Len(t, page.Events, 1)
+		assert.Equal(t, "alice@example.com", page.Events[0].Attribs["old_email"])
+		assert.Equal(t, "alice@example.org", page.Events[0].Attribs["new_email"])
+
+		_, err = au.ConfirmEmailChange(ctx, token)
+		assert.Equal(t, "invalid_email_change_token", errors.E(err).Code)
+	})
+
+	t.Run("Conflict", func(t *testing.T) {
+		require.NoError(t, au.RequestEmailChange(ctx, alice.ID, "carol@example.com"))
+		token := emailChangeToken(t, rm, "carol@example.com")
+
+		// The email is taken by another account before the change is
+		// confirmed.
+		registerTestUser(t, au, "carol@example.com", "Purple-Monkey-19")
+
+		_, err := au.ConfirmEmailChange(ctx, token)
+		assert.True(t, errors.Is(err, errEmailTaken), "got %v", err)
+
+		u, err := au.GetUser(ctx, NewAuthKey(KeyKindID, alice.ID))
+		require.NoError(t, err)
+		assert.Equal(t, "alice@example.org", u.Email)
+	})
+}
+
+// emailChangeToken returns the token of the confirmation link in the last
+// mail sent to the given address.
+func emailChangeToken(t *testing.T, rm *recordingMailer, to string) string {
+	t.Helper()
+
+	msgs := rm.sent(to)
+	require.NotEmpty(t, msgs, "no mail sent to %s", to)
+
+	for _, line := range strings.Split(msgs[len(msgs)-1].Text, "\n") {
+		if !strings.Contains(line, "/email/confirm") {
+			continue
+		}
+		link, err := url.Parse(strings.TrimSpace(line))
+		require.NoError(t, err)
+		return link.Query().Get("token")
+	}
+
+	t.Fatalf("no confirmation link in mail to %s", to)
+	return ""
+}
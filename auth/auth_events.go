@@ -0,0 +1,237 @@
+package auth
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+
+	"github.com/spy16/pgbase/errors"
+	"github.com/spy16/pgbase/log"
+)
+
+// Kinds of events recorded in the audit log.
+const (
+	EventUserRegistered   = "user.registered"
+	EventUserVerified     = "user.verified"
+	EventLoginSucceeded   = "login.succeeded"
+	EventLoginFailed      = "login.failed"
+	EventLogout           = "logout"
+	EventPasswordChanged  = "password.changed"
+	EventEmailChanged     = "email.changed"
+	EventIdentityLinked   = "identity.linked"
+	EventIdentityUnlinked = "identity.unlinked"
+	EventAPIKeyCreated    = "api_key.created"
+	EventAPIKeyRevoked    = "api_key.revoked"
+
+	EventOAuthConsentGranted = "oauth.consent_granted"
+	EventOAuthTokenIssued    = "oauth.token_issued"
+)
+
+// Login methods recorded with login events.
+const (
+	loginMethodPassword  = "password"
+	loginMethodTOTP      = "totp"
+	loginMethodPasskey   = "passkey"
+	loginMethodOTP       = "otp"
+	loginMethodMagicLink = "magic_link"
+	loginMethodOAuth     = "oauth"
+)
+
+const (
+	defaultEventsPageSize = 50
+	maxEventsPageSize     = 500
+)
+
+// Event represents an entry in the audit log.
+type Event struct {
+	ID        int64          `json:"id"`
+	Kind      string         `json:"kind"`
+	UserID    *string        `json:"user_id"`
+	ClientIP  string         `json:"client_ip"`
+	UserAgent string         `json:"user_agent"`
+	RequestID string         `json:"request_id"`
+	Attribs   map[string]any `json:"attribs"`
+	CreatedAt time.Time      `json:"created_at"`
+}
+
+// EventFilter specifies the criteria for listing events. Zero values are
+// ignored.
+type EventFilter struct {
+	UserID string     `json:"user_id"`
+	Kind   string     `json:"kind"`
+	Since  *time.Time `json:"since"`
+	Until  *time.Time `json:"until"`
+
+	// Cursor is the NextCursor of the previous page. Limit is the max
+	// number of events to return.
+	Cursor string `json:"cursor"`
+	Limit  int    `json:"limit"`
+}
+
+// EventPage is a page of events returned by ListEvents. NextCursor is
+// empty if there are no more events.
+type EventPage struct {
+	Events     []Event `json:"events"`
+	NextCursor string  `json:"next_cursor,omitempty"`
+}
+
+// ListEvents returns audit log events matching the filter, newest first.
+func (auth *Auth) ListEvents(ctx context.Context, filter EventFilter) (*EventPage, error) {
+	qb, limit, err := eventsQuery(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	q, args, err := qb.PlaceholderFormat(sq.Dollar).ToSql()
+	if err != nil {
+		return nil, errors.InternalIssue.CausedBy(err)
+	}
+
+	rows, err := auth.conn.Query(ctx, q, args...)
+	if err != nil {
+		return nil, translateErr(err)
+	}
+	defer rows.Close()
+
+	var events []Event
+	for rows.Next() {
+		var ev Event
+		if err := rows.Scan(&ev.ID, &ev.Kind, &ev.UserID, &ev.ClientIP, &ev.UserAgent,
+			&ev.RequestID, &ev.Attribs, &ev.CreatedAt); err != nil {
+			return nil, translateErr(err)
+		}
+		events = append(events, ev)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, translateErr(err)
+	}
+
+	page := newEventPage(events, limit)
+	return &page, nil
+}
+
+// eventsQuery returns the query for listing events matching the filter
+// along with the page size. One event more than the page size is queried
+// to know if there is a next page.
+func eventsQuery(filter EventFilter) (sq.SelectBuilder, int, error) {
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = defaultEventsPageSize
+	} else if limit > maxEventsPageSize {
+		limit = maxEventsPageSize
+	}
+
+	qb := sq.Select("id", "kind", "user_id", "coalesce(client_ip, '')", "coalesce(user_agent, '')",
+		"coalesce(request_id, '')", "attribs", "created_at").
+		From("auth_events").
+		OrderBy("id DESC").
+		Limit(uint64(limit + 1))
+
+	if filter.UserID != "" {
+		qb = qb.Where(sq.Eq{"user_id": filter.UserID})
+	}
+	if filter.Kind != "" {
+		qb = qb.Where(sq.Eq{"kind": filter.Kind})
+	}
+	if filter.Since != nil {
+		qb = qb.Where(sq.GtOrEq{"created_at": *filter.Since})
+	}
+	if filter.Until != nil {
+		qb = qb.Where(sq.Lt{"created_at": *filter.Until})
+	}
+	if filter.Cursor != "" {
+		beforeID, err := strconv.ParseInt(filter.Cursor, 10, 64)
+		if err != nil {
+			return qb, 0, errInvalidCursor.CausedBy(err)
+		}
+		qb = qb.Where(sq.Lt{"id": beforeID})
+	}
+	return qb, limit, nil
+}
+
+// newEventPage returns the page of events queried using eventsQuery. The
+// extra event, if present, is dropped and sets the cursor for next page.
+func newEventPage(events []Event, limit int) EventPage {
+	page := EventPage{Events: []Event{}}
+	if len(events) > limit {
+		events = events[:limit]
+		page.NextCursor = strconv.FormatInt(events[len(events)-1].ID, 10)
+	}
+	page.Events = append(page.Events, events...)
+	return page
+}
+
+// PruneEvents deletes the events older than the configured retention
+// period and returns the number of events deleted. Init prunes once, but
+// long-running applications should invoke this periodically.
+func (auth *Auth) PruneEvents(ctx context.Context) (int64, error) {
+	q, args, err := sq.Delete("auth_events").
+		Where(sq.Lt{"created_at": time.Now().Add(-auth.cfg.EventRetention)}).
+		PlaceholderFormat(sq.Dollar).ToSql()
+	if err != nil {
+		return 0, errors.InternalIssue.CausedBy(err)
+	}
+
+	tag, err := auth.conn.Exec(ctx, q, args...)
+	if err != nil {
+		return 0, translateErr(err)
+	}
+	return tag.RowsAffected(), nil
+}
+
+// recordLoginFailed records a failed login attempt using the method in
+// the audit log. Only authentication failures are recorded and not, for
+// example, malformed requests or throttled attempts.
+func (auth *Auth) recordLoginFailed(ctx context.Context, method string, err error, attribs map[string]any) {
+	e := errors.E(err)
+	if e.Status != errors.MissingAuth.Status {
+		return
+	}
+
+	ev := map[string]any{
+		"method": method,
+		"reason": loginFailureReason(e),
+	}
+	for k, v := range attribs {
+		ev[k] = v
+	}
+	auth.recordEvent(ctx, EventLoginFailed, "", ev)
+}
+
+// loginFailureReason returns the reason recorded for a failed login.
+func loginFailureReason(e errors.Error) string {
+	if e.DebugHint != "" {
+		return e.DebugHint
+	}
+	return e.Code
+}
+
+// recordEvent appends an event to the audit log. Client details are read
+// from the context. Failures are logged and never fail the operation
+// being audited.
+func (auth *Auth) recordEvent(ctx context.Context, kind, userID string, attribs map[string]any) {
+	client := curClient(ctx)
+
+	var uid *string
+	if userID != "" {
+		uid = &userID
+	}
+
+	q, args, err := sq.Insert("auth_events").
+		Columns("kind", "user_id", "client_ip", "user_agent", "request_id", "attribs", "created_at").
+		Values(kind, uid, client.IP, client.UserAgent, client.RequestID, attribs, time.Now()).
+		PlaceholderFormat(sq.Dollar).ToSql()
+	if err == nil {
+		_, err = auth.conn.Exec(ctx, q, args...)
+	}
+
+	if err != nil {
+		log.Warn(ctx, "failed to record auth event", log.Fields{
+			"kind":    kind,
+			"user_id": userID,
+			"error":   err.Error(),
+		})
+	}
+}
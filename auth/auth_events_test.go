@@ -0,0 +1,97 @@
+package auth
+
+import (
+	"testing"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/spy16/pgbase/errors"
+)
+
+func TestEventsQuery(t *testing.T) {
+	t.Parallel()
+
+	const cols = "SELECT id, kind, user_id, coalesce(client_ip, ''), coalesce(user_agent, ''), " +
+		"coalesce(request_id, ''), attribs, created_at FROM auth_events"
+	since := time.Date(2023, 4, 5, 0, 0, 0, 0, time.UTC)
+
+	table := []struct {
+		title     string
+		filter    EventFilter
+		wantSQL   string
+		wantArgs  []any
+		wantLimit int
+		wantErr   string
+	}{
+		{
+			title:     "Defaults",
+			filter:    EventFilter{},
+			wantSQL:   cols + " ORDER BY id DESC LIMIT 51",
+			wantLimit: defaultEventsPageSize,
+		},
+		{
+			title:     "MaxLimit",
+			filter:    EventFilter{Limit: 10000},
+			wantSQL:   cols + " ORDER BY id DESC LIMIT 501",
+			wantLimit: maxEventsPageSize,
+		},
+		{
+			title:     "Filters",
+			filter:    EventFilter{UserID: "u1", Kind: EventLoginFailed, Since: &since, Cursor: "42", Limit: 10},
+			wantSQL:   cols + " WHERE user_id = $1 AND kind = $2 AND created_at >= $3 AND id < $4 ORDER BY id DESC LIMIT 11",
+			wantArgs:  []any{"u1", EventLoginFailed, since, int64(42)},
+			wantLimit: 10,
+		},
+		{
+			title:   "BadCursor",
+			filter:  EventFilter{Cursor: "abc"},
+			wantErr: "invalid_cursor",
+		},
+	}
+
+	for _, tt := range table {
+		t.Run(tt.title, func(t *testing.T) {
+			qb, limit, err := eventsQuery(tt.filter)
+			if tt.wantErr != "" {
+				require.Error(t, err)
+				assert.Equal(t, tt.wantErr, errors.E(err).Code)
+				return
+			}
+			require.NoError(t, err)
+
+			q, args, err := qb.PlaceholderFormat(sq.Dollar).ToSql()
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantSQL, q)
+			assert.Equal(t, tt.wantArgs, args)
+			assert.Equal(t, tt.wantLimit, limit)
+		})
+	}
+}
+
+func TestNewEventPage(t *testing.T) {
+	t.Parallel()
+
+	events := []Event{{ID: 9}, {ID: 8}, {ID: 7}}
+
+	page := newEventPage(events, 2)
+	assert.Equal(t, []Event{{ID: 9}, {ID: 8}}, page.Events)
+	assert.Equal(t, "8", page.NextCursor)
+
+	page = newEventPage(events, 3)
+	assert.Len(t, page.Events, 3)
+	assert.Empty(t, page.NextCursor)
+
+	page = newEventPage(nil, 3)
+	assert.NotNil(t, page.Events)
+	assert.Empty(t, page.NextCursor)
+}
+
+func TestLoginFailureReason(t *testing.T) {
+	t.Parallel()
+
+	assert.Equal(t, "code mismatch", loginFailureReason(errOTP.Hintf("code mismatch")))
+	assert.Equal(t, "invalid_otp", loginFailureReason(errOTP))
+}
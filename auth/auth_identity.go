@@ -0,0 +1,245 @@
+package auth
+
+import (
+	"context"
+	"time"
+
+	"github.com/markbates/goth"
+
+	"github.com/spy16/pgbase/errors"
+)
+
+// tokenExpiryLeeway is the margin before expiry at which provider access
+// tokens are refreshed.
+const tokenExpiryLeeway = time.Minute
+
+// Identity represents an OAuth provider identity linked to a user.
+type Identity struct {
+	Key            string `json:"key"`
+	Provider       string `json:"provider"`
+	ProviderUserID string `json:"provider_user_id"`
+}
+
+// LinkIdentity links the provider identity key to the user. Returns
+// errors.Conflict if the identity is already linked to another user.
+func (auth *Auth) LinkIdentity(ctx context.Context, userID string, key Key) error {
+	if err := putUserKey(ctx, auth.conn, userID, key.Key, key.Attribs); err != nil {
+		if errors.Is(err, errors.Conflict) {
+			return errors.Conflict.Coded("identity_linked").
+				Hintf("identity is linked to another user")
+		}
+		return err
+	}
+
+	auth.recordEvent(ctx, EventIdentityLinked, userID, map[string]any{"key": key.Key})
+	return nil
+}
+
+// ListIdentities returns all the provider identities linked to the user.
+func (auth *Auth) ListIdentities(ctx context.Context, userID string) ([]Identity, error) {
+	keys, err := listUserKeys(ctx, auth.conn, userID, "")
+	if err != nil {
+		return nil, err
+	}
+
+	providers := goth.GetProviders()
+
+	res := []Identity{}
+	for _, k := range keys {
+		if kind, _ := SplitAuthKey(k.Key); providers[kind] != nil {
+			res = append(res, newIdentity(k))
+		}
+	}
+	return res, nil
+}
+
+// UnlinkIdentity removes the provider identity from the user. Returns
+// errors.Conflict if the identity is the only way for the user to login.
+func (auth *Auth) UnlinkIdentity(ctx context.Context, userID, key string) error {
+	u, err := auth.GetUser(ctx, NewAuthKey(KeyKindID, userID))
+	if err != nil {
+		return err
+	}
+
+	identities, err := auth.ListIdentities(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	passkeys, err := listUserKeys(ctx, auth.conn, userID, KeyKindWebAuthn)
+	if err != nil {
+		return err
+	}
+
+	found := false
+	for _, id := range identities {
+		found = found || id.Key == key
+	}
+
+	if !found {
+		return errors.NotFound.Coded("identity_not_found")
+	} else if u.PwdHash == nil && len(passkeys) == 0 && len(identities) == 1 {
+		return errors.Conflict.Coded("last_login_method").
+			Hintf("set a password or link another identity first")
+	}
+
+	if err := deleteUserKey(ctx, auth.conn, userID, key); err != nil {
+		return err
+	}
+
+	auth.recordEvent(ctx, EventIdentityUnlinked, userID, map[string]any{"key": key})
+	return nil
+}
+
+// ProviderToken returns a valid access token issued by the provider for
+// the user. An expired token is refreshed using the stored refresh token.
+func (auth *Auth) ProviderToken(ctx context.Context, userID, provider string) (string, error) {
+	p, err := goth.GetProvider(provider)
+	if err != nil {
+		return "", errors.NotFound.Coded("unknown_provider").Hintf("provider '%s' is not enabled", provider)
+	}
+
+	keys, err := listUserKeys(ctx, auth.conn, userID, provider)
+	if err != nil {
+		return "", err
+	} else if len(keys) == 0 {
+		return "", errors.NotFound.Coded("identity_not_found").
+			Hintf("user has no '%s' identity linked", provider)
+	}
+	k := keys[0]
+
+	accessToken, _ := k.Attribs["access_token"].(string)
+	refreshToken, _ := k.Attribs["refresh_token"].(string)
+
+	var expiresAt time.Time
+	if v, ok := k.Attribs["expires_at"].(float64); ok && v > 0 {
+		expiresAt = time.Unix(int64(v), 0)
+	}
+
+	// Tokens without known expiry are assumed valid. Otherwise, refresh a
+	// bit early to avoid handing out a token that expires in transit.
+	if expiresAt.IsZero() || time.Now().Add(tokenExpiryLeeway).Before(expiresAt) {
+		return accessToken, nil
+	}
+
+	if refreshToken == "" || !p.RefreshTokenAvailable() {
+		return "", errors.MissingAuth.Coded("provider_token_expired").
+			Hintf("login again with '%s' to renew access", provider)
+	}
+
+	tok, err := p.RefreshToken(refreshToken)
+	if err != nil {
+		return "", errors.MissingAuth.Coded("provider_token_expired").CausedBy(err)
+	}
+
+	k.Attribs["access_token"] = tok.AccessToken
+	k.Attribs["expires_at"] = unixOrZero(tok.Expiry)
+	if tok.RefreshToken != "" {
+		k.Attribs["refresh_token"] = tok.RefreshToken
+	}
+
+	if err := putUserKey(ctx, auth.conn, userID, k.Key, k.Attribs); err != nil {
+		return "", err
+	}
+	return tok.AccessToken, nil
+}
+
+// syncIdentity refreshes the stored provider tokens and merges the latest
+// profile fields from the provider into the user data.
+func (auth *Auth) syncIdentity(ctx context.Context, u *User, gu goth.User) error {
+	key := identityKey(gu)
+
+	// Providers usually issue refresh tokens only on first consent. So the
+	// stored one is retained if none was issued now.
+	if gu.RefreshToken == "" {
+		var old map[string]any
+		if err := getUserKey(ctx, auth.conn, u.ID, key.Key, &old); err != nil {
+			return err
+		}
+		key.Attribs["refresh_token"] = old["refresh_token"]
+	}
+
+	if err := putUserKey(ctx, auth.conn, u.ID, key.Key, key.Attribs); err != nil {
+		return err
+	}
+
+	if u.Data == nil {
+		u.Data = UserData{}
+	}
+
+	changed := false
+	for field, val := range userDataFromGothUser(gu) {
+		if s, _ := val.(string); s != "" && u.Data[field] != s {
+			u.Data[field] = s
+			changed = true
+		}
+	}
+
+	if !changed {
+		return nil
+	}
+	return auth.SetUserData(ctx, u.ID, u.Data)
+}
+
+func newIdentity(k Key) Identity {
+	provider, providerUserID := SplitAuthKey(k.Key)
+	return Identity{
+		Key:            k.Key,
+		Provider:       provider,
+		ProviderUserID: providerUserID,
+	}
+}
+
+// identityKey returns the auth key for the provider identity.
+func identityKey(gu goth.User) Key {
+	return Key{
+		Key: NewAuthKey(gu.Provider, gu.UserID),
+		Attribs: map[string]any{
+			"user_id":       gu.UserID,
+			"expires_at":    unixOrZero(gu.ExpiresAt),
+			"access_token":  gu.AccessToken,
+			"refresh_token": gu.RefreshToken,
+			"raw_data":      gu.RawData,
+		},
+	}
+}
+
+// autoLinkEnabled returns true if identities of the provider may be linked
+// to existing users based on the verified email asserted by the provider.
+func (cfg Config) autoLinkEnabled(provider string) bool {
+	switch provider {
+	case "google":
+		return cfg.Google.AutoLinkVerifiedEmail
+	case "github":
+		return cfg.Github.AutoLinkVerifiedEmail
+	default:
+		conf, found := cfg.OIDC[provider]
+		return found && conf.AutoLinkVerifiedEmail
+	}
+}
+
+// gothEmailVerified returns true if the provider asserts that the email
+// of the user has been verified. Different providers use different
+// claims for this.
+func gothEmailVerified(gu goth.User) bool {
+	for _, claim := range []string{"email_verified", "verified_email"} {
+		switch v := gu.RawData[claim].(type) {
+		case bool:
+			if v {
+				return true
+			}
+		case string:
+			if v == "true" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func unixOrZero(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
@@ -0,0 +1,125 @@
+package auth
+
+import (
+	"context"
+	"strings"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/jackc/pgx/v5"
+
+	"github.com/spy16/pgbase/errors"
+)
+
+// getUserKey reads the attributes of the auth key owned by the user into
+// the given pointer. Returns errors.NotFound if no such key exists.
+func getUserKey(ctx context.Context, db querier, userID, key string, attribsInto any) error {
+	return selectUserKey(ctx, db, userID, key, attribsInto, "")
+}
+
+// lockUserKey is same as getUserKey but also locks the key until the end
+// of the transaction. db must be a transaction.
+func lockUserKey(ctx context.Context, db querier, userID, key string, attribsInto any) error {
+	return selectUserKey(ctx, db, userID, key, attribsInto, "FOR UPDATE")
+}
+
+func selectUserKey(ctx context.Context, db querier, userID, key string, attribsInto any, suffix string) error {
+	qb := sq.Select("attribs").
+		From("user_keys").
+		Where(sq.Eq{
+			"key":     key,
+			"user_id": userID,
+		})
+	if suffix != "" {
+		qb = qb.Suffix(suffix)
+	}
+
+	q, args, err := qb.PlaceholderFormat(sq.Dollar).ToSql()
+	if err != nil {
+		return errors.InternalIssue.CausedBy(err)
+	}
+
+	if err := db.QueryRow(ctx, q, args...).Scan(attribsInto); err != nil {
+		return translateErr(err)
+	}
+	return nil
+}
+
+// putUserKey creates or updates the auth key of the user. Returns
+// errors.Conflict if the key belongs to a different user.
+func putUserKey(ctx context.Context, db querier, userID, key string, attribs any) error {
+	if err := ValidateAuthKey(key); err != nil {
+		return err
+	}
+
+	q, args, err := sq.Insert("user_keys").
+		Columns("key", "user_id", "attribs").
+		Values(key, userID, attribs).
+		Suffix("ON CONFLICT (key) DO UPDATE SET attribs=excluded.attribs WHERE user_keys.user_id=excluded.user_id").
+		PlaceholderFormat(sq.Dollar).ToSql()
+	if err != nil {
+		return errors.InternalIssue.CausedBy(err)
+	}
+
+	tag, err := db.Exec(ctx, q, args...)
+	if err != nil {
+		return translateErr(err)
+	} else if tag.RowsAffected() == 0 {
+		return errors.Conflict.Hintf("key belongs to another user")
+	}
+	return nil
+}
+
+// deleteUserKey deletes the auth key owned by the user. Returns
+// errors.NotFound if no such key exists.
+func deleteUserKey(ctx context.Context, db querier, userID, key string) error {
+	q, args, err := sq.Delete("user_keys").
+		Where(sq.Eq{
+			"key":     key,
+			"user_id": userID,
+		}).
+		PlaceholderFormat(sq.Dollar).ToSql()
+	if err != nil {
+		return errors.InternalIssue.CausedBy(err)
+	}
+
+	tag, err := db.Exec(ctx, q, args...)
+	if err != nil {
+		return translateErr(err)
+	} else if tag.RowsAffected() == 0 {
+		return errors.NotFound
+	}
+	return nil
+}
+
+// listUserKeys returns all auth keys of the given kind owned by the user.
+// All keys of the user are returned if kind is empty.
+func listUserKeys(ctx context.Context, db *pgx.Conn, userID, kind string) ([]Key, error) {
+	qb := sq.Select("key", "attribs").
+		From("user_keys").
+		Where(sq.Eq{"user_id": userID}).
+		OrderBy("key")
+	if kind != "" {
+		qb = qb.Where(sq.Like{"key": strings.ReplaceAll(kind, "_", `\_`) + keyIDSeparator + "%"})
+	}
+
+	q, args, err := qb.PlaceholderFormat(sq.Dollar).ToSql()
+	if err != nil {
+		return nil, errors.InternalIssue.CausedBy(err)
+	}
+
+	rows, err := db.Query(ctx, q, args...)
+	if err != nil {
+		return nil, translateErr(err)
+	}
+	defer rows.Close()
+
+	var keys []Key
+	for rows.Next() {
+		var k Key
+		if err := rows.Scan(&k.Key, &k.Attribs); err != nil {
+			return nil, translateErr(err)
+		}
+		keys = append(keys, k)
+	}
+	return keys, translateErr(rows.Err())
+}
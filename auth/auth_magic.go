@@ -0,0 +1,175 @@
+package auth
+
+import (
+	"context"
+	"html/template"
+	"strings"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+
+	"github.com/spy16/pgbase/errors"
+	"github.com/spy16/pgbase/strutils"
+)
+
+var errMagicLink = errors.MissingAuth.Coded("invalid_magic_link")
+
+// magicLinkPage is served when the magic link is opened and no page route
+// is configured. The token is consumed only once the user submits the form.
+var magicLinkPage = template.Must(template.New("magic_link").Parse(`<!DOCTYPE html>
+<html>
+<head>
+  <meta charset="utf-8">
+  <meta name="robots" content="noindex">
+  <title>Login</title>
+</head>
+<body>
+  <form method="post" action="{{.Action}}">
+    <input type="hidden" name="token" value="{{.Token}}">
+    <button type="submit">Continue to login</button>
+  </form>
+</body>
+</html>
+`))
+
+// RequestMagicLink emails a single-use login link to the given email. If
+// no user has the email, a link is sent only if MagicLinkSignup is enabled
+// and the user is created (with given kind) when the link is opened. No
+// error is returned if nothing is sent so that callers cannot probe for
+// registered emails.
+func (auth *Auth) RequestMagicLink(ctx context.Context, email, kind string) error {
+	email = strings.TrimSpace(email)
+	if !strutils.IsValidEmail(email) {
+		return errors.InvalidInput.Hintf("invalid email")
+	}
+
+	var userID *string
+	attribs := map[string]any{"email": email}
+
+	u, err := auth.GetUser(ctx, NewAuthKey(KeyKindEmail, email))
+	if err != nil {
+		if !errors.Is(err, errors.NotFound) {
+			return err
+		} else if !auth.cfg.MagicLinkSignup {
+			return nil
+		}
+
+		kind = strings.TrimSpace(kind)
+		if kind == "" {
+			kind = defaultUserKind
+		} else if !strutils.OneOf(kind, auth.cfg.EnabledKinds) {
+			return errors.InvalidInput.Coded("invalid_kind").Hintf("user kind '%s' is not valid", kind)
+		}
+		attribs["kind"] = kind
+	} else if u.DisabledAt != nil {
+		return nil
+	} else {
+		userID = &u.ID
+	}
+
+	expiresAt := time.Now().Add(auth.cfg.MagicLinkTTL)
+	token, err := issueToken(ctx, auth.conn, tokenKindMagicLink, userID, auth.cfg.MagicLinkTTL, attribs)
+	if err != nil {
+		return err
+	}
+
+	auth.sendMail(ctx, mailMagicLink, email, map[string]any{
+		"Email":     email,
+		"Link":      auth.magicLinkURL(token),
+		"ExpiresAt": expiresAt,
+	})
+	return nil
+}
+
+// magicLinkURL returns the link to be mailed for the magic-link token. It
+// leads to MagicLinkPageRoute if set, or to the built-in page otherwise.
+// Either page must submit the token using POST, since opening a link must
+// not log anyone in (mail scanners prefetch links).
+func (auth *Auth) magicLinkURL(token string) string {
+	page := auth.cfg.MagicLinkPageRoute
+	if page == "" {
+		page = auth.baseURL.JoinPath("/login/magic/verify").String()
+	}
+	return withQuery(page, map[string]string{"token": token})
+}
+
+// ConsumeMagicLink invalidates the magic-link token and returns the user
+// it was issued for, creating the user first in case of a signup. Since
+// opening the link proves ownership of the email, the user is marked as
+// verified.
+func (auth *Auth) ConsumeMagicLink(ctx context.Context, token string) (*User, error) {
+	ut, err := consumeToken(ctx, auth.conn, tokenKindMagicLink, strings.TrimSpace(token))
+	if err != nil {
+		if errors.Is(err, errors.NotFound) {
+			return nil, errMagicLink
+		}
+		return nil, err
+	}
+
+	var u *User
+	if ut.UserID != nil {
+		u, err = auth.GetUser(ctx, NewAuthKey(KeyKindID, *ut.UserID))
+	} else {
+		u, err = auth.magicLinkSignup(ctx, ut.Attribs)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if u.VerifiedAt == nil {
+		if u, err = auth.markVerified(ctx, u.ID, loginMethodMagicLink); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := auth.checkLoginAllowed(u); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+func (auth *Auth) magicLinkSignup(ctx context.Context, attribs map[string]any) (*User, error) {
+	email, _ := attribs["email"].(string)
+	kind, _ := attribs["kind"].(string)
+	if email == "" {
+		return nil, errMagicLink.Hintf("token has no email")
+	}
+
+	// The user may have registered since the link was sent.
+	u, err := auth.GetUser(ctx, NewAuthKey(KeyKindEmail, email))
+	if err == nil {
+		return u, nil
+	} else if !errors.Is(err, errors.NotFound) {
+		return nil, err
+	}
+
+	newU := NewUser(kind, "", email)
+	newU.VerifyToken = nil
+	return auth.RegisterUser(ctx, newU, nil)
+}
+
+// markVerified marks the user as verified and returns the updated user.
+// Method is the way the user proved ownership of the email.
+func (auth *Auth) markVerified(ctx context.Context, userID, method string) (*User, error) {
+	now := time.Now()
+
+	q, args, err := sq.Update("users").
+		Where(sq.Eq{
+			"id":          userID,
+			"verified_at": nil,
+		}).
+		Set("verified_at", now).
+		Set("updated_at", now).
+		PlaceholderFormat(sq.Dollar).ToSql()
+	if err != nil {
+		return nil, errors.InternalIssue.CausedBy(err)
+	}
+
+	tag, err := auth.conn.Exec(ctx, q, args...)
+	if err != nil {
+		return nil, translateErr(err)
+	} else if tag.RowsAffected() > 0 {
+		auth.recordEvent(ctx, EventUserVerified, userID, map[string]any{"method": method})
+	}
+	return auth.GetUser(ctx, NewAuthKey(KeyKindID, userID))
+}
@@ -0,0 +1,96 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMagicLinkURL(t *testing.T) {
+	t.Parallel()
+
+	baseURL, _ := url.Parse("https://example.com/auth")
+
+	auth := &Auth{baseURL: baseURL}
+	assert.Equal(t, "https://example.com/auth/login/magic/verify?token=t0k3n", auth.magicLinkURL("t0k3n"))
+
+	auth.cfg.MagicLinkPageRoute = "https://example.com/magic"
+	assert.Equal(t, "https://example.com/magic?token=t0k3n", auth.magicLinkURL("t0k3n"))
+}
+
+func TestHandleMagicLinkPage(t *testing.T) {
+	t.Parallel()
+
+	baseURL, _ := url.Parse("https://example.com/auth")
+	auth := &Auth{baseURL: baseURL}
+
+	// opening the link must not touch the token (auth has no db here).
+	req := httptest.NewRequest(http.MethodGet, "/login/magic/verify?token=a%22%3Cb", nil)
+	rec := httptest.NewRecorder()
+	auth.handleMagicLinkPage(rec, req)
+
+	res := rec.Result()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "no-store", res.Header.Get("Cache-Control"))
+	assert.Empty(t, res.Cookies())
+
+	body := rec.Body.String()
+	assert.Contains(t, body, `<form method="post" action="https://example.com/auth/login/magic/verify">`)
+	assert.Contains(t, body, `value="a&#34;&lt;b"`)
+}
+
+func TestHandleMagicLinkVerify_crossOrigin(t *testing.T) {
+	t.Parallel()
+
+	baseURL, _ := url.Parse("https://example.com/auth")
+	auth := &Auth{baseURL: baseURL}
+
+	req := httptest.NewRequest(http.MethodPost, "/login/magic/verify", strings.NewReader(`{"token":"t0k3n"}`))
+	req.Header.Set("Origin", "https://evil.example")
+	rec := httptest.NewRecorder()
+	auth.handleMagicLinkVerify(rec, req)
+
+	res := rec.Result()
+	assert.Equal(t, http.StatusForbidden, res.StatusCode)
+	assert.Empty(t, res.Cookies())
+}
+
+func TestCheckSameOrigin(t *testing.T) {
+	t.Parallel()
+
+	baseURL, _ := url.Parse("https://example.com/auth")
+	auth := &Auth{baseURL: baseURL}
+
+	table := []struct {
+		origin  string
+		wantErr bool
+	}{
+		{origin: ""},
+		{origin: "https://example.com"},
+		{origin: "http://example.com", wantErr: true},
+		{origin: "https://example.com:8443", wantErr: true},
+		{origin: "https://evil.example", wantErr: true},
+		{origin: "null", wantErr: true},
+	}
+
+	for _, tt := range table {
+		t.Run(tt.origin, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/login/magic/verify", nil)
+			if tt.origin != "" {
+				req.Header.Set("Origin", tt.origin)
+			}
+
+			err := auth.checkSameOrigin(req)
+			if tt.wantErr {
+				require.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
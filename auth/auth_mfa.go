@@ -0,0 +1,265 @@
+package auth
+
+import (
+	"context"
+	"crypto/subtle"
+	"strings"
+	"time"
+
+	"github.com/spy16/pgbase/errors"
+	"github.com/spy16/pgbase/log"
+	"github.com/spy16/pgbase/strutils"
+)
+
+// KeyKindTOTP is the auth key kind used for storing TOTP enrollment of
+// a user. The key is of the form 'totp/<user-id>'.
+const KeyKindTOTP = "totp"
+
+const (
+	maxMFAAttempts    = 5
+	recoveryCodeCount = 10
+	recoveryCodeLen   = 10
+)
+
+var errInvalidCode = errors.MissingAuth.Coded("invalid_code")
+
+// TOTPEnrollment holds the details required for configuring an
+// authenticator app.
+type TOTPEnrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+type totpKey struct {
+	Secret        string   `json:"secret"`
+	Confirmed     bool     `json:"confirmed"`
+	LastStep      int64    `json:"last_step"`
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+// EnrollTOTP generates a new TOTP secret for the user. Enrollment must be
+// completed by calling ConfirmTOTP with a code generated from the secret.
+// Returns errors.Conflict if the user already has TOTP enabled.
+func (auth *Auth) EnrollTOTP(ctx context.Context, userID string) (*TOTPEnrollment, error) {
+	u, err := auth.GetUser(ctx, NewAuthKey(KeyKindID, userID))
+	if err != nil {
+		return nil, err
+	}
+
+	var existing totpKey
+	keyID := NewAuthKey(KeyKindTOTP, userID)
+	if err := getUserKey(ctx, auth.conn, userID, keyID, &existing); err != nil {
+		if !errors.Is(err, errors.NotFound) {
+			return nil, err
+		}
+	} else if existing.Confirmed {
+		return nil, errors.Conflict.Coded("totp_enabled")
+	}
+
+	key := totpKey{Secret: newTOTPSecret()}
+	if err := putUserKey(ctx, auth.conn, userID, keyID, key); err != nil {
+		return nil, err
+	}
+
+	return &TOTPEnrollment{
+		Secret: key.Secret,
+		URI:    totpURI(auth.cfg.TOTPIssuer, u.Email, key.Secret),
+	}, nil
+}
+
+// ConfirmTOTP completes the TOTP enrollment if the code is valid and
+// returns the one-time recovery codes. Recovery codes are stored hashed
+// and cannot be retrieved again.
+func (auth *Auth) ConfirmTOTP(ctx context.Context, userID, code string) ([]string, error) {
+	tx, err := auth.conn.Begin(ctx)
+	if err != nil {
+		return nil, translateErr(err)
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	var key totpKey
+	keyID := NewAuthKey(KeyKindTOTP, userID)
+	if err := lockUserKey(ctx, tx, userID, keyID, &key); err != nil {
+		if errors.Is(err, errors.NotFound) {
+			return nil, errors.NotFound.Coded("totp_not_enrolled")
+		}
+		return nil, err
+	} else if key.Confirmed {
+		return nil, errors.Conflict.Coded("totp_enabled")
+	}
+
+	step, ok := checkTOTP(key.Secret, code, time.Now(), key.LastStep)
+	if !ok {
+		return nil, errInvalidCode
+	}
+
+	var codes []string
+	for i := 0; i < recoveryCodeCount; i++ {
+		c := newSecretCode(recoveryCodeLen, strutils.CharsetLower+strutils.CharsetNums)
+		codes = append(codes, c[:recoveryCodeLen/2]+"-"+c[recoveryCodeLen/2:])
+		key.RecoveryCodes = append(key.RecoveryCodes, hashRecoveryCode(c))
+	}
+	key.Confirmed = true
+	key.LastStep = step
+
+	if err := putUserKey(ctx, tx, userID, keyID, key); err != nil {
+		return nil, err
+	} else if err := tx.Commit(ctx); err != nil {
+		return nil, translateErr(err)
+	}
+	return codes, nil
+}
+
+// DisableTOTP removes the TOTP enrollment of the user. A valid TOTP or
+// recovery code is required.
+func (auth *Auth) DisableTOTP(ctx context.Context, userID, code string) error {
+	if err := auth.verifySecondFactor(ctx, userID, code); err != nil {
+		return err
+	}
+	return deleteUserKey(ctx, auth.conn, userID, NewAuthKey(KeyKindTOTP, userID))
+}
+
+// CompleteMFAChallenge verifies the second-factor code for the challenge
+// issued during login and returns the user on success. The challenge is
+// invalidated after success or too many failed attempts. Wrong codes count
+// towards the login throttle of the user, so that starting new challenges
+// does not give more guesses.
+func (auth *Auth) CompleteMFAChallenge(ctx context.Context, challenge, code string) (*User, error) {
+	u, _, err := auth.completeMFAChallenge(ctx, challenge, code)
+	return u, err
+}
+
+// completeMFAChallenge implements CompleteMFAChallenge and also returns the
+// throttle account of the primary login the challenge was issued for.
+func (auth *Auth) completeMFAChallenge(ctx context.Context, challenge, code string) (*User, string, error) {
+	var errChallenge = errors.MissingAuth.Coded("invalid_challenge")
+
+	challenge = strings.TrimSpace(challenge)
+	ut, err := claimTokenAttempt(ctx, auth.conn, tokenKindMFAChallenge, challenge, maxMFAAttempts)
+	if err != nil {
+		if errors.Is(err, errors.NotFound) {
+			return nil, "", errChallenge
+		}
+		return nil, "", err
+	} else if ut.UserID == nil {
+		return nil, "", errChallenge.Hintf("challenge has no user")
+	}
+
+	userID := *ut.UserID
+	account, ip := mfaAccount(userID), curClient(ctx).IP
+	if err := auth.checkLoginThrottle(ctx, account, ip); err != nil {
+		return nil, "", err
+	}
+
+	if err := auth.verifySecondFactor(ctx, userID, code); err != nil {
+		if errors.Is(err, errInvalidCode) {
+			if err := auth.recordLoginFailure(ctx, account, ip); err != nil {
+				log.Warn(ctx, "failed to record login failure", log.Fields{"error": err.Error()})
+			}
+		}
+		return nil, "", err
+	}
+
+	if _, err := consumeToken(ctx, auth.conn, tokenKindMFAChallenge, challenge); err != nil {
+		if errors.Is(err, errors.NotFound) {
+			return nil, "", errChallenge
+		}
+		return nil, "", err
+	}
+
+	// The user may have been disabled since the first factor was checked.
+	u, err := auth.GetUser(ctx, NewAuthKey(KeyKindID, userID))
+	if err != nil {
+		return nil, "", err
+	} else if err := auth.checkLoginAllowed(u); err != nil {
+		return nil, "", err
+	}
+
+	primary, _ := ut.Attribs["account"].(string)
+	return u, primary, nil
+}
+
+// mfaEnabled returns true if the user has a confirmed second factor.
+func (auth *Auth) mfaEnabled(ctx context.Context, userID string) (bool, error) {
+	var key totpKey
+	if err := getUserKey(ctx, auth.conn, userID, NewAuthKey(KeyKindTOTP, userID), &key); err != nil {
+		if errors.Is(err, errors.NotFound) {
+			return false, nil
+		}
+		return false, err
+	}
+	return key.Confirmed, nil
+}
+
+// startMFAChallenge issues a short-lived challenge to be completed using
+// CompleteMFAChallenge. The throttle account of the primary login (if any)
+// is kept with the challenge so that it can be reset once login completes.
+func (auth *Auth) startMFAChallenge(ctx context.Context, userID, account string) (string, error) {
+	var attribs map[string]any
+	if account != "" {
+		attribs = map[string]any{"account": account}
+	}
+	return issueToken(ctx, auth.conn, tokenKindMFAChallenge, &userID, auth.cfg.MFAChallengeTTL, attribs)
+}
+
+// mfaAccount returns the subject used for counting wrong second-factor
+// codes of the user. It does not depend on how the first factor was
+// passed, so that switching login methods does not give more guesses.
+// IDs are case-sensitive and are not normalised like other accounts.
+func mfaAccount(userID string) string {
+	return NewAuthKey(KeyKindID, userID)
+}
+
+// verifySecondFactor checks the code against the TOTP enrollment of the
+// user. Recovery codes are also accepted and are removed once used. The
+// enrollment is locked while checking so that concurrent requests cannot
+// replay a TOTP step or spend a recovery code twice.
+func (auth *Auth) verifySecondFactor(ctx context.Context, userID, code string) error {
+	tx, err := auth.conn.Begin(ctx)
+	if err != nil {
+		return translateErr(err)
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	var key totpKey
+	keyID := NewAuthKey(KeyKindTOTP, userID)
+	if err := lockUserKey(ctx, tx, userID, keyID, &key); err != nil {
+		if errors.Is(err, errors.NotFound) {
+			return errors.NotFound.Coded("totp_not_enrolled")
+		}
+		return err
+	} else if !key.Confirmed {
+		return errors.NotFound.Coded("totp_not_enrolled")
+	}
+
+	if step, ok := checkTOTP(key.Secret, code, time.Now(), key.LastStep); ok {
+		key.LastStep = step
+	} else if i := matchRecoveryCode(key.RecoveryCodes, code); i >= 0 {
+		key.RecoveryCodes = append(key.RecoveryCodes[:i], key.RecoveryCodes[i+1:]...)
+	} else {
+		return errInvalidCode
+	}
+
+	if err := putUserKey(ctx, tx, userID, keyID, key); err != nil {
+		return err
+	}
+	return translateErr(tx.Commit(ctx))
+}
+
+// matchRecoveryCode returns the index of the hashed recovery code matching
+// the code, or -1 if none matches.
+func matchRecoveryCode(hashes []string, code string) int {
+	codeHash := hashRecoveryCode(code)
+	for i, h := range hashes {
+		if subtle.ConstantTimeCompare([]byte(h), []byte(codeHash)) == 1 {
+			return i
+		}
+	}
+	return -1
+}
+
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	code = strings.NewReplacer("-", "", " ", "").Replace(code)
+	return hashToken(code)
+}
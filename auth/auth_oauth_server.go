@@ -0,0 +1,690 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/url"
+	"strings"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/golang-jwt/jwt/v4"
+
+	"github.com/spy16/pgbase/errors"
+	"github.com/spy16/pgbase/strutils"
+)
+
+// Scopes supported by the authorization server.
+const (
+	ScopeOpenID        = "openid"
+	ScopeProfile       = "profile"
+	ScopeEmail         = "email"
+	ScopeOfflineAccess = "offline_access"
+)
+
+const (
+	oauthCodeTTL          = 1 * time.Minute
+	maxOAuthClientName    = 64
+	pkceMethodS256        = "S256"
+	tokenTypeBearer       = "Bearer"
+	oauthResponseTypeCode = "code"
+
+	grantTypeAuthCode     = "authorization_code"
+	grantTypeRefreshToken = "refresh_token"
+)
+
+var supportedScopes = []string{ScopeOpenID, ScopeProfile, ScopeEmail, ScopeOfflineAccess}
+
+// reservedClaims are the claims set by the auth module itself. User data
+// fields with these names are never copied into tokens.
+var reservedClaims = []string{
+	"iss", "sub", "aud", "exp", "nbf", "iat", "jti", "typ", "nonce", "azp", "auth_time",
+	"at_hash", "acr", "amr", "sid", "scope", "client_id", "tid", "kind", "roles", "perms",
+	"org", "org_role", "email", "email_verified", "preferred_username", "updated_at",
+}
+
+// Errors returned by the authorization server. The codes are the error
+// codes defined by RFC 6749 so that they can be sent to clients as is.
+var (
+	errOAuthInvalidRequest = errors.InvalidInput.Coded("invalid_request")
+	errOAuthInvalidClient  = errors.MissingAuth.Coded("invalid_client")
+	errOAuthInvalidGrant   = errors.InvalidInput.Coded("invalid_grant")
+	errOAuthInvalidScope   = errors.InvalidInput.Coded("invalid_scope")
+	errOAuthInvalidToken   = errors.MissingAuth.Coded("invalid_token")
+	errOAuthAccessDenied   = errors.Forbidden.Coded("access_denied")
+	errOAuthNeedsConsent   = errors.Forbidden.Coded("consent_required")
+)
+
+// OAuthClient is an application registered with the authorization server.
+// Public clients (e.g., SPAs, mobile apps) have no secret and must rely on
+// PKCE alone. First-party clients are not asked for consent.
+type OAuthClient struct {
+	ID           string    `json:"id"`
+	Name         string    `json:"name"`
+	RedirectURIs []string  `json:"redirect_uris"`
+	Scopes       []string  `json:"scopes"`
+	FirstParty   bool      `json:"first_party"`
+	Public       bool      `json:"public"`
+	CreatedAt    time.Time `json:"created_at"`
+
+	// Secret is the plaintext client secret. It is set only when the
+	// client is registered and cannot be retrieved afterwards.
+	Secret string `json:"secret,omitempty"`
+}
+
+// AuthorizeRequest represents the parameters of an authorization request
+// of the authorization-code flow.
+type AuthorizeRequest struct {
+	ResponseType        string `json:"response_type"`
+	ClientID            string `json:"client_id"`
+	RedirectURI         string `json:"redirect_uri"`
+	Scope               string `json:"scope"`
+	State               string `json:"state"`
+	Nonce               string `json:"nonce"`
+	CodeChallenge       string `json:"code_challenge"`
+	CodeChallengeMethod string `json:"code_challenge_method"`
+}
+
+// TokenResponse is the successful response of the token endpoint.
+type TokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+	Scope        string `json:"scope"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	IDToken      string `json:"id_token,omitempty"`
+}
+
+// RegisterClient registers a new OAuth client. Scopes default to all the
+// supported scopes. The returned client carries the plaintext secret for
+// confidential clients.
+func (auth *Auth) RegisterClient(ctx context.Context, c OAuthClient) (*OAuthClient, error) {
+	c.Name = strings.TrimSpace(c.Name)
+	if c.Name == "" || len(c.Name) > maxOAuthClientName {
+		return nil, errors.InvalidInput.Coded("invalid_name").
+			Hintf("name must be 1-%d characters", maxOAuthClientName)
+	}
+
+	if len(c.RedirectURIs) == 0 {
+		return nil, errors.InvalidInput.Coded("invalid_redirect_uri").Hintf("at least one redirect uri is required")
+	}
+	for _, uri := range c.RedirectURIs {
+		if err := validateRedirectURI(uri); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(c.Scopes) == 0 {
+		c.Scopes = supportedScopes
+	}
+	for _, scope := range c.Scopes {
+		if !strutils.OneOf(scope, supportedScopes) {
+			return nil, errOAuthInvalidScope.Hintf("scope '%s' is not supported", scope)
+		}
+	}
+
+	c.ID = strutils.RandStr(16)
+	c.CreatedAt = time.Now()
+
+	var secretHash *string
+	if !c.Public {
+		c.Secret = newSecretToken()
+		h := hashToken(c.Secret)
+		secretHash = &h
+	}
+
+	q, args, err := sq.Insert("oauth_clients").
+		Columns("id", "name", "secret_hash", "redirect_uris", "scopes", "first_party", "created_at").
+		Values(c.ID, c.Name, secretHash, c.RedirectURIs, c.Scopes, c.FirstParty, c.CreatedAt).
+		PlaceholderFormat(sq.Dollar).ToSql()
+	if err != nil {
+		return nil, errors.InternalIssue.CausedBy(err)
+	}
+
+	if _, err := auth.conn.Exec(ctx, q, args...); err != nil {
+		return nil, translateErr(err)
+	}
+	return &c, nil
+}
+
+// ListClients returns all the registered OAuth clients.
+func (auth *Auth) ListClients(ctx context.Context) ([]OAuthClient, error) {
+	q, args, err := sq.Select("id", "name", "secret_hash IS NULL", "redirect_uris", "scopes", "first_party", "created_at").
+		From("oauth_clients").
+		OrderBy("created_at DESC").
+		PlaceholderFormat(sq.Dollar).ToSql()
+	if err != nil {
+		return nil, errors.InternalIssue.CausedBy(err)
+	}
+
+	rows, err := auth.conn.Query(ctx, q, args...)
+	if err != nil {
+		return nil, translateErr(err)
+	}
+	defer rows.Close()
+
+	res := []OAuthClient{}
+	for rows.Next() {
+		var c OAuthClient
+		if err := rows.Scan(&c.ID, &c.Name, &c.Public, &c.RedirectURIs, &c.Scopes,
+			&c.FirstParty, &c.CreatedAt); err != nil {
+			return nil, translateErr(err)
+		}
+		res = append(res, c)
+	}
+	return res, translateErr(rows.Err())
+}
+
+// DeleteClient deletes the OAuth client along with the consents granted
+// to it. Refresh tokens issued to the client are invalidated.
+func (auth *Auth) DeleteClient(ctx context.Context, clientID string) error {
+	tx, err := auth.conn.Begin(ctx)
+	if err != nil {
+		return translateErr(err)
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	tag, err := tx.Exec(ctx, "DELETE FROM oauth_clients WHERE id=$1", clientID)
+	if err != nil {
+		return translateErr(err)
+	} else if tag.RowsAffected() == 0 {
+		return errors.NotFound.Coded("client_not_found")
+	}
+
+	if err := revokeClientTokens(ctx, tx, sq.Expr("attribs->>'client_id'=?", clientID)); err != nil {
+		return err
+	}
+	return translateErr(tx.Commit(ctx))
+}
+
+// GrantConsent records the consent of the user for the client to access
+// the given scopes. Scopes are added to any previously granted ones.
+func (auth *Auth) GrantConsent(ctx context.Context, userID, clientID string, scopes []string) error {
+	q, args, err := sq.Insert("oauth_consents").
+		Columns("user_id", "client_id", "scopes", "granted_at").
+		Values(userID, clientID, scopes, time.Now()).
+		Suffix(`ON CONFLICT (user_id, client_id) DO UPDATE SET
+			scopes=(SELECT array_agg(DISTINCT s) FROM unnest(oauth_consents.scopes || excluded.scopes) AS s),
+			granted_at=excluded.granted_at`).
+		PlaceholderFormat(sq.Dollar).ToSql()
+	if err != nil {
+		return errors.InternalIssue.CausedBy(err)
+	}
+
+	if _, err := auth.conn.Exec(ctx, q, args...); err != nil {
+		return translateErr(err)
+	}
+
+	auth.recordEvent(ctx, EventOAuthConsentGranted, userID, map[string]any{
+		"client_id": clientID,
+		"scopes":    scopes,
+	})
+	return nil
+}
+
+// RevokeConsent revokes the consent granted by the user to the client and
+// invalidates the refresh tokens issued to the client for the user.
+func (auth *Auth) RevokeConsent(ctx context.Context, userID, clientID string) error {
+	tx, err := auth.conn.Begin(ctx)
+	if err != nil {
+		return translateErr(err)
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	tag, err := tx.Exec(ctx, "DELETE FROM oauth_consents WHERE user_id=$1 AND client_id=$2", userID, clientID)
+	if err != nil {
+		return translateErr(err)
+	} else if tag.RowsAffected() == 0 {
+		return errors.NotFound.Coded("consent_not_found")
+	}
+
+	err = revokeClientTokens(ctx, tx, sq.Expr("attribs->>'client_id'=? AND attribs->>'user_id'=?", clientID, userID))
+	if err != nil {
+		return err
+	}
+	return translateErr(tx.Commit(ctx))
+}
+
+// authorizeClient returns the client of the authorization request after
+// verifying the redirect uri is registered for it. Errors returned here
+// must not be sent to the redirect uri since it cannot be trusted.
+func (auth *Auth) authorizeClient(ctx context.Context, req AuthorizeRequest) (*OAuthClient, error) {
+	client, _, err := auth.getClient(ctx, req.ClientID)
+	if err != nil {
+		if errors.Is(err, errors.NotFound) {
+			return nil, errOAuthInvalidClient.Hintf("unknown client")
+		}
+		return nil, err
+	}
+
+	if !strutils.OneOf(req.RedirectURI, client.RedirectURIs) {
+		return nil, errOAuthInvalidRequest.Hintf("redirect_uri is not registered for the client")
+	}
+	return client, nil
+}
+
+// needsConsent returns true if the user must be asked for consent before
+// the client can be given access to the scopes.
+func (auth *Auth) needsConsent(ctx context.Context, client OAuthClient, userID string, scopes []string) (bool, error) {
+	if client.FirstParty {
+		return false, nil
+	}
+
+	var granted []string
+	err := auth.conn.QueryRow(ctx, "SELECT scopes FROM oauth_consents WHERE user_id=$1 AND client_id=$2",
+		userID, client.ID).Scan(&granted)
+	if err != nil {
+		if err = translateErr(err); errors.Is(err, errors.NotFound) {
+			return true, nil
+		}
+		return false, err
+	}
+
+	for _, scope := range scopes {
+		if !strutils.OneOf(scope, granted) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// issueAuthCode issues an authorization code for the request and returns
+// the redirect uri (with the code) the user-agent must be sent to.
+func (auth *Auth) issueAuthCode(ctx context.Context, userID string, req AuthorizeRequest, scopes []string) (string, error) {
+	// Codes are not tied to the user_id column since issuing a token for
+	// a user invalidates other tokens of the same kind, which would break
+	// concurrent authorizations of different clients.
+	code, err := issueToken(ctx, auth.conn, tokenKindOAuthCode, nil, oauthCodeTTL, map[string]any{
+		"user_id":        userID,
+		"client_id":      req.ClientID,
+		"redirect_uri":   req.RedirectURI,
+		"scope":          strings.Join(scopes, " "),
+		"nonce":          req.Nonce,
+		"code_challenge": req.CodeChallenge,
+	})
+	if err != nil {
+		return "", err
+	}
+	return req.redirect(map[string]string{"code": code}), nil
+}
+
+// authenticateClient verifies the credentials of the client at the token
+// endpoint. Public clients must not present a secret.
+func (auth *Auth) authenticateClient(ctx context.Context, clientID, secret string) (*OAuthClient, error) {
+	if clientID == "" {
+		return nil, errOAuthInvalidClient.Hintf("client_id is required")
+	}
+
+	client, secretHash, err := auth.getClient(ctx, clientID)
+	if err != nil {
+		if errors.Is(err, errors.NotFound) {
+			return nil, errOAuthInvalidClient.Hintf("unknown client")
+		}
+		return nil, err
+	}
+
+	if secretHash == nil {
+		if secret != "" {
+			return nil, errOAuthInvalidClient.Hintf("public clients must not use a secret")
+		}
+		return client, nil
+	}
+
+	if subtle.ConstantTimeCompare([]byte(hashToken(secret)), []byte(*secretHash)) != 1 {
+		return nil, errOAuthInvalidClient.Hintf("client authentication failed")
+	}
+	return client, nil
+}
+
+// ExchangeCode exchanges the authorization code issued to the client for
+// tokens. The redirect uri must match the one used in the authorization
+// request and the verifier must match the PKCE challenge.
+func (auth *Auth) ExchangeCode(ctx context.Context, client OAuthClient, code, redirectURI, verifier string) (*TokenResponse, error) {
+	ut, err := consumeToken(ctx, auth.conn, tokenKindOAuthCode, code)
+	if err != nil {
+		if errors.Is(err, errors.NotFound) {
+			return nil, errOAuthInvalidGrant.Hintf("code is invalid or expired")
+		}
+		return nil, err
+	}
+
+	attribs := ut.Attribs
+	if attribString(attribs, "client_id") != client.ID {
+		return nil, errOAuthInvalidGrant.Hintf("code was issued to another client")
+	} else if attribString(attribs, "redirect_uri") != redirectURI {
+		return nil, errOAuthInvalidGrant.Hintf("redirect_uri does not match")
+	} else if !verifyPKCE(verifier, attribString(attribs, "code_challenge")) {
+		return nil, errOAuthInvalidGrant.Hintf("code_verifier does not match")
+	}
+
+	return auth.issueClientTokens(ctx, client, attribString(attribs, "user_id"),
+		parseScopes(attribString(attribs, "scope")), attribString(attribs, "nonce"))
+}
+
+// RefreshClientToken exchanges the refresh token issued to the client for
+// new tokens. Refresh tokens are single-use and rotated on every use. The
+// scope, if given, must not exceed the originally granted scopes.
+func (auth *Auth) RefreshClientToken(ctx context.Context, client OAuthClient, refreshToken, scope string) (*TokenResponse, error) {
+	ut, err := consumeToken(ctx, auth.conn, tokenKindOAuthRefresh, refreshToken)
+	if err != nil {
+		if errors.Is(err, errors.NotFound) {
+			return nil, errOAuthInvalidGrant.Hintf("refresh token is invalid or expired")
+		}
+		return nil, err
+	}
+
+	if attribString(ut.Attribs, "client_id") != client.ID {
+		return nil, errOAuthInvalidGrant.Hintf("refresh token was issued to another client")
+	}
+
+	scopes := parseScopes(attribString(ut.Attribs, "scope"))
+	if scope != "" {
+		requested := parseScopes(scope)
+		for _, s := range requested {
+			if !strutils.OneOf(s, scopes) {
+				return nil, errOAuthInvalidScope.Hintf("scope '%s' was not granted", s)
+			}
+		}
+		scopes = requested
+	}
+
+	return auth.issueClientTokens(ctx, client, attribString(ut.Attribs, "user_id"), scopes, "")
+}
+
+// UserInfo verifies the access token and returns the claims about the
+// user permitted by the scopes of the token.
+func (auth *Auth) UserInfo(ctx context.Context, accessToken string) (map[string]any, error) {
+	claims := jwt.MapClaims{}
+	tok, err := jwt.ParseWithClaims(accessToken, claims, auth.keys.keyFunc)
+	if err != nil || !tok.Valid {
+		return nil, errOAuthInvalidToken.CausedBy(err).Hintf("parse failed")
+	}
+
+	// Session tokens are signed with the same keys, so the claims unique
+	// to the access tokens must be checked.
+	clientID, _ := claims["client_id"].(string)
+	subject, _ := claims["sub"].(string)
+	if clientID == "" || subject == "" || !claims.VerifyIssuer(auth.issuer(), true) {
+		return nil, errOAuthInvalidToken.Hintf("not an access token")
+	}
+
+	u, err := auth.GetUser(ctx, NewAuthKey(KeyKindID, subject))
+	if err != nil {
+		if errors.Is(err, errors.NotFound) {
+			return nil, errOAuthInvalidToken.Hintf("user not found")
+		}
+		return nil, err
+	} else if u.DisabledAt != nil {
+		return nil, errOAuthInvalidToken.Hintf("user has been disabled")
+	}
+
+	scope, _ := claims["scope"].(string)
+	return userClaims(*u, parseScopes(scope)), nil
+}
+
+func (auth *Auth) issueClientTokens(ctx context.Context, client OAuthClient, userID string, scopes []string, nonce string) (*TokenResponse, error) {
+	u, err := auth.GetUser(ctx, NewAuthKey(KeyKindID, userID))
+	if err != nil {
+		if errors.Is(err, errors.NotFound) {
+			return nil, errOAuthInvalidGrant.Hintf("user not found")
+		}
+		return nil, err
+	} else if err := auth.checkLoginAllowed(u); err != nil {
+		return nil, errOAuthInvalidGrant.CausedBy(err).Hintf("user is not allowed to login")
+	}
+
+	now := time.Now()
+	exp := now.Add(auth.cfg.OAuthAccessTTL)
+	scope := strings.Join(scopes, " ")
+
+	accessToken, err := auth.keys.sign(jwt.MapClaims{
+		"iss":       auth.issuer(),
+		"sub":       u.ID,
+		"aud":       client.ID,
+		"client_id": client.ID,
+		"scope":     scope,
+		"iat":       now.Unix(),
+		"exp":       exp.Unix(),
+		"jti":       strutils.RandStr(16),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	res := TokenResponse{
+		AccessToken: accessToken,
+		TokenType:   tokenTypeBearer,
+		ExpiresIn:   int(auth.cfg.OAuthAccessTTL.Seconds()),
+		Scope:       scope,
+	}
+
+	if strutils.OneOf(ScopeOpenID, scopes) {
+		claims := userClaims(*u, scopes)
+		claims["iss"] = auth.issuer()
+		claims["aud"] = client.ID
+		claims["iat"] = now.Unix()
+		claims["exp"] = exp.Unix()
+		if nonce != "" {
+			claims["nonce"] = nonce
+		}
+
+		res.IDToken, err = auth.keys.sign(jwt.MapClaims(claims))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if strutils.OneOf(ScopeOfflineAccess, scopes) {
+		res.RefreshToken, err = issueToken(ctx, auth.conn, tokenKindOAuthRefresh, nil, auth.cfg.RefreshTTL, map[string]any{
+			"user_id":   u.ID,
+			"client_id": client.ID,
+			"scope":     scope,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	auth.recordEvent(ctx, EventOAuthTokenIssued, u.ID, map[string]any{
+		"client_id": client.ID,
+		"scope":     scope,
+	})
+	return &res, nil
+}
+
+func (auth *Auth) getClient(ctx context.Context, clientID string) (*OAuthClient, *string, error) {
+	q, args, err := sq.Select("id", "name", "secret_hash", "redirect_uris", "scopes", "first_party", "created_at").
+		From("oauth_clients").
+		Where(sq.Eq{"id": clientID}).
+		PlaceholderFormat(sq.Dollar).ToSql()
+	if err != nil {
+		return nil, nil, errors.InternalIssue.CausedBy(err)
+	}
+
+	var c OAuthClient
+	var secretHash *string
+	if err := auth.conn.QueryRow(ctx, q, args...).Scan(&c.ID, &c.Name, &secretHash,
+		&c.RedirectURIs, &c.Scopes, &c.FirstParty, &c.CreatedAt); err != nil {
+		return nil, nil, translateErr(err)
+	}
+	c.Public = secretHash == nil
+	return &c, secretHash, nil
+}
+
+func revokeClientTokens(ctx context.Context, db querier, where sq.Sqlizer) error {
+	q, args, err := sq.Update("user_tokens").
+		Where(sq.Eq{
+			"kind":    tokenKindOAuthRefresh,
+			"used_at": nil,
+		}).
+		Where(where).
+		Set("used_at", time.Now()).
+		PlaceholderFormat(sq.Dollar).ToSql()
+	if err != nil {
+		return errors.InternalIssue.CausedBy(err)
+	}
+
+	_, err = db.Exec(ctx, q, args...)
+	return translateErr(err)
+}
+
+func authorizeRequestFrom(q url.Values) AuthorizeRequest {
+	return AuthorizeRequest{
+		ResponseType:        q.Get("response_type"),
+		ClientID:            q.Get("client_id"),
+		RedirectURI:         q.Get("redirect_uri"),
+		Scope:               q.Get("scope"),
+		State:               q.Get("state"),
+		Nonce:               q.Get("nonce"),
+		CodeChallenge:       q.Get("code_challenge"),
+		CodeChallengeMethod: q.Get("code_challenge_method"),
+	}
+}
+
+// validate validates the authorization request against the client and
+// returns the requested scopes. PKCE with S256 is mandatory for all the
+// clients.
+func (req AuthorizeRequest) validate(client OAuthClient) ([]string, error) {
+	if req.ResponseType != oauthResponseTypeCode {
+		return nil, errors.InvalidInput.Coded("unsupported_response_type").
+			Hintf("only response_type=code is supported")
+	} else if req.CodeChallenge == "" || req.CodeChallengeMethod != pkceMethodS256 {
+		return nil, errOAuthInvalidRequest.Hintf("PKCE with code_challenge_method=S256 is required")
+	}
+
+	scopes := parseScopes(req.Scope)
+	if len(scopes) == 0 {
+		return nil, errOAuthInvalidScope.Hintf("scope is required")
+	}
+	for _, scope := range scopes {
+		if !strutils.OneOf(scope, client.Scopes) {
+			return nil, errOAuthInvalidScope.Hintf("scope '%s' is not allowed for the client", scope)
+		}
+	}
+	return scopes, nil
+}
+
+// params returns the request as query parameters so that it can be passed
+// along to the login and consent pages.
+func (req AuthorizeRequest) params() map[string]string {
+	params := map[string]string{
+		"response_type":         req.ResponseType,
+		"client_id":             req.ClientID,
+		"redirect_uri":          req.RedirectURI,
+		"scope":                 req.Scope,
+		"state":                 req.State,
+		"nonce":                 req.Nonce,
+		"code_challenge":        req.CodeChallenge,
+		"code_challenge_method": req.CodeChallengeMethod,
+	}
+	for k, v := range params {
+		if v == "" {
+			delete(params, k)
+		}
+	}
+	return params
+}
+
+// redirect returns the redirect uri of the request with the given params
+// and the state added.
+func (req AuthorizeRequest) redirect(params map[string]string) string {
+	if req.State != "" {
+		params["state"] = req.State
+	}
+	return withQuery(req.RedirectURI, params)
+}
+
+// errorRedirect returns the redirect uri of the request with the error
+// added as defined in RFC 6749 (Section 4.1.2.1).
+func (req AuthorizeRequest) errorRedirect(err error) string {
+	params := map[string]string{"error": oauthErrorCode(err)}
+	if hint := errors.E(err).DebugHint; hint != "" {
+		params["error_description"] = hint
+	}
+	return req.redirect(params)
+}
+
+// oauthErrorCode returns the RFC 6749 error code for the error.
+func oauthErrorCode(err error) string {
+	e := errors.E(err)
+	if e.Status >= 500 {
+		return "server_error"
+	}
+
+	switch e.Code {
+	case "invalid_request", "invalid_client", "invalid_grant", "invalid_scope",
+		"unauthorized_client", "unsupported_grant_type", "unsupported_response_type",
+		"access_denied", "consent_required", "login_required", "invalid_token":
+		return e.Code
+	}
+	return "invalid_request"
+}
+
+// userClaims returns the OpenID Connect claims about the user permitted by
+// the scopes.
+func userClaims(u User, scopes []string) map[string]any {
+	claims := map[string]any{"sub": u.ID}
+
+	if strutils.OneOf(ScopeProfile, scopes) {
+		for k, v := range u.Data {
+			if s, isStr := v.(string); v == nil || (isStr && s == "") || strutils.OneOf(k, reservedClaims) {
+				continue
+			}
+			claims[k] = v
+		}
+		if u.Username != "" {
+			claims["preferred_username"] = u.Username
+		}
+		claims["updated_at"] = u.UpdatedAt.Unix()
+	}
+
+	if strutils.OneOf(ScopeEmail, scopes) && u.Email != "" {
+		claims["email"] = u.Email
+		claims["email_verified"] = u.VerifiedAt != nil
+	}
+	return claims
+}
+
+// parseScopes splits the space-delimited scope string into unique scopes.
+func parseScopes(scope string) []string {
+	var scopes []string
+	for _, s := range strings.Fields(scope) {
+		if !strutils.OneOf(s, scopes) {
+			scopes = append(scopes, s)
+		}
+	}
+	return scopes
+}
+
+// verifyPKCE returns true if the verifier matches the S256 challenge as
+// defined in RFC 7636.
+func verifyPKCE(verifier, challenge string) bool {
+	if len(verifier) < 43 || len(verifier) > 128 || challenge == "" {
+		return false
+	}
+
+	sum := sha256.Sum256([]byte(verifier))
+	computed := base64.RawURLEncoding.EncodeToString(sum[:])
+	return subtle.ConstantTimeCompare([]byte(computed), []byte(challenge)) == 1
+}
+
+func validateRedirectURI(uri string) error {
+	var errInvalid = errors.InvalidInput.Coded("invalid_redirect_uri")
+
+	u, err := url.Parse(uri)
+	if err != nil {
+		return errInvalid.CausedBy(err).Hintf("redirect uri '%s' is not valid", uri)
+	} else if !u.IsAbs() || u.Fragment != "" {
+		return errInvalid.Hintf("redirect uri '%s' must be absolute and without fragment", uri)
+	} else if u.Scheme == "http" && u.Hostname() != "localhost" && u.Hostname() != "127.0.0.1" {
+		return errInvalid.Hintf("redirect uri '%s' must use https", uri)
+	}
+	return nil
+}
+
+func attribString(attribs map[string]any, key string) string {
+	s, _ := attribs[key].(string)
+	return s
+}
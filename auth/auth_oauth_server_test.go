@@ -0,0 +1,158 @@
+package auth
+
+import (
+	"context"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/spy16/pgbase/errors"
+)
+
+func TestVerifyPKCE(t *testing.T) {
+	// Example from RFC 7636, Appendix B.
+	verifier := "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	challenge := "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"
+
+	assert.True(t, verifyPKCE(verifier, challenge))
+	assert.False(t, verifyPKCE(verifier+"x", challenge))
+	assert.False(t, verifyPKCE("short", challenge))
+	assert.False(t, verifyPKCE(verifier, ""))
+}
+
+func TestAuthorizeRequest_validate(t *testing.T) {
+	client := OAuthClient{ID: "c1", Scopes: []string{ScopeOpenID, ScopeEmail}}
+	valid := AuthorizeRequest{
+		ResponseType:        "code",
+		ClientID:            "c1",
+		RedirectURI:         "https://app.example.com/cb",
+		Scope:               "openid email openid",
+		CodeChallenge:       "challenge",
+		CodeChallengeMethod: "S256",
+	}
+
+	scopes, err := valid.validate(client)
+	require.NoError(t, err)
+	assert.Equal(t, []string{ScopeOpenID, ScopeEmail}, scopes)
+
+	table := []struct {
+		title  string
+		modify func(req *AuthorizeRequest)
+		want   string
+	}{
+		{title: "Token", modify: func(req *AuthorizeRequest) { req.ResponseType = "token" }, want: "unsupported_response_type"},
+		{title: "NoPKCE", modify: func(req *AuthorizeRequest) { req.CodeChallenge = "" }, want: "invalid_request"},
+		{title: "PlainPKCE", modify: func(req *AuthorizeRequest) { req.CodeChallengeMethod = "plain" }, want: "invalid_request"},
+		{title: "NoScope", modify: func(req *AuthorizeRequest) { req.Scope = " " }, want: "invalid_scope"},
+		{title: "ScopeNotAllowed", modify: func(req *AuthorizeRequest) { req.Scope = "openid profile" }, want: "invalid_scope"},
+	}
+
+	for _, tt := range table {
+		t.Run(tt.title, func(t *testing.T) {
+			req := valid
+			tt.modify(&req)
+
+			_, err := req.validate(client)
+			require.Error(t, err)
+			assert.Equal(t, tt.want, errors.E(err).Code)
+		})
+	}
+}
+
+func TestAuthorizeRequest_errorRedirect(t *testing.T) {
+	req := AuthorizeRequest{RedirectURI: "https://app.example.com/cb?x=1", State: "xyz"}
+
+	u, err := url.Parse(req.errorRedirect(errOAuthAccessDenied.Hintf("denied")))
+	require.NoError(t, err)
+
+	q := u.Query()
+	assert.Equal(t, "1", q.Get("x"))
+	assert.Equal(t, "xyz", q.Get("state"))
+	assert.Equal(t, "access_denied", q.Get("error"))
+	assert.Equal(t, "denied", q.Get("error_description"))
+}
+
+func TestOAuthErrorCode(t *testing.T) {
+	assert.Equal(t, "invalid_grant", oauthErrorCode(errOAuthInvalidGrant.Hintf("expired")))
+	assert.Equal(t, "invalid_request", oauthErrorCode(errors.NotFound))
+	assert.Equal(t, "server_error", oauthErrorCode(errors.New("boom")))
+}
+
+func TestUserClaims(t *testing.T) {
+	verifiedAt := time.Now()
+	u := User{
+		ID:         "u1",
+		Email:      "bob@example.com",
+		Username:   "bob",
+		VerifiedAt: &verifiedAt,
+		Data:       UserData{"name": "Bob", "picture": ""},
+	}
+
+	claims := userClaims(u, []string{ScopeOpenID})
+	assert.Equal(t, map[string]any{"sub": "u1"}, claims)
+
+	claims = userClaims(u, []string{ScopeOpenID, ScopeProfile, ScopeEmail})
+	assert.Equal(t, "Bob", claims["name"])
+	assert.Equal(t, "bob", claims["preferred_username"])
+	assert.Equal(t, "bob@example.com", claims["email"])
+	assert.Equal(t, true, claims["email_verified"])
+	assert.NotContains(t, claims, "picture")
+
+	// User data must not override or inject the claims of the module.
+	u.Data = UserData{"name": "Bob", "sub": "u2", "tid": "sess1", "roles": []string{"admin"}}
+	claims = userClaims(u, []string{ScopeOpenID, ScopeProfile})
+	assert.Equal(t, "u1", claims["sub"])
+	assert.Equal(t, "Bob", claims["name"])
+	assert.NotContains(t, claims, "tid")
+	assert.NotContains(t, claims, "roles")
+}
+
+func TestRestoreSession_clientTokens(t *testing.T) {
+	t.Parallel()
+
+	kr, err := newKeyring([]SigningKey{{ID: "k1", Secret: "secret1", State: KeyStateActive}})
+	require.NoError(t, err)
+
+	baseURL, _ := url.Parse("https://auth.example.com")
+	auth := &Auth{keys: kr, baseURL: baseURL}
+
+	now := time.Now()
+	table := []struct {
+		title  string
+		claims jwt.MapClaims
+	}{
+		{title: "NoType", claims: jwt.MapClaims{}},
+		{title: "IDToken", claims: jwt.MapClaims{"typ": sessionTokenType, "aud": "client1"}},
+		{title: "AccessToken", claims: jwt.MapClaims{"typ": sessionTokenType, "client_id": "client1"}},
+	}
+
+	for _, tt := range table {
+		t.Run(tt.title, func(t *testing.T) {
+			tt.claims["tid"] = "sess1"
+			tt.claims["kind"] = "user"
+			tt.claims["sub"] = "u1"
+			tt.claims["iat"] = now.Unix()
+			tt.claims["exp"] = now.Add(time.Hour).Unix()
+
+			token, err := kr.sign(tt.claims)
+			require.NoError(t, err)
+
+			_, err = auth.RestoreSession(context.Background(), token)
+			require.Error(t, err)
+			assert.Equal(t, "not a session token", errors.E(err).DebugHint)
+		})
+	}
+}
+
+func TestValidateRedirectURI(t *testing.T) {
+	assert.NoError(t, validateRedirectURI("https://app.example.com/cb"))
+	assert.NoError(t, validateRedirectURI("http://localhost:8080/cb"))
+	assert.NoError(t, validateRedirectURI("com.example.app:/cb"))
+	assert.Error(t, validateRedirectURI("/cb"))
+	assert.Error(t, validateRedirectURI("http://app.example.com/cb"))
+	assert.Error(t, validateRedirectURI("https://app.example.com/cb#frag"))
+}
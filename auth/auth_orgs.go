@@ -0,0 +1,475 @@
+package auth
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/jackc/pgx/v5"
+
+	"github.com/spy16/pgbase/errors"
+	"github.com/spy16/pgbase/strutils"
+)
+
+// Roles of members within an organization.
+const (
+	OrgRoleOwner  = "owner"
+	OrgRoleAdmin  = "admin"
+	OrgRoleMember = "member"
+)
+
+const maxOrgNameLen = 100
+
+var (
+	orgRoles       = []string{OrgRoleOwner, OrgRoleAdmin, OrgRoleMember}
+	orgSlugPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{1,62}$`)
+
+	errNotOrgMember = errors.Forbidden.Coded("not_org_member")
+	errOrgRole      = errors.Forbidden.Coded("insufficient_org_role")
+	errLastOwner    = errors.Conflict.Coded("last_owner").Hintf("transfer ownership before removing the last owner")
+)
+
+// Org represents an organization (i.e., a tenant) that users can be
+// members of.
+type Org struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Slug      string    `json:"slug"`
+	CreatedBy string    `json:"created_by"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Membership represents the membership of a user in an organization.
+type Membership struct {
+	Org      Org       `json:"org"`
+	Role     string    `json:"role"`
+	JoinedAt time.Time `json:"joined_at"`
+}
+
+// OrgMember represents a member of an organization.
+type OrgMember struct {
+	UserID   string    `json:"user_id"`
+	Username string    `json:"username"`
+	Email    string    `json:"email"`
+	Role     string    `json:"role"`
+	JoinedAt time.Time `json:"joined_at"`
+}
+
+// CreateOrg creates a new organization with the user as its owner.
+func (auth *Auth) CreateOrg(ctx context.Context, userID, name, slug string) (*Org, error) {
+	name = strings.TrimSpace(name)
+	slug = strings.ToLower(strings.TrimSpace(slug))
+	if name == "" || len(name) > maxOrgNameLen {
+		return nil, errors.InvalidInput.Coded("invalid_name").
+			Hintf("name must be 1-%d characters", maxOrgNameLen)
+	} else if !orgSlugPattern.MatchString(slug) {
+		return nil, errors.InvalidInput.Coded("invalid_slug").
+			Hintf("slug must match '%s'", orgSlugPattern)
+	}
+
+	now := time.Now()
+	org := Org{
+		ID:        strutils.RandStr(16),
+		Name:      name,
+		Slug:      slug,
+		CreatedBy: userID,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+
+	tx, err := auth.conn.Begin(ctx)
+	if err != nil {
+		return nil, translateErr(err)
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	q, args, err := sq.Insert("orgs").
+		Columns("id", "name", "slug", "created_by", "created_at", "updated_at").
+		Values(org.ID, org.Name, org.Slug, org.CreatedBy, org.CreatedAt, org.UpdatedAt).
+		PlaceholderFormat(sq.Dollar).ToSql()
+	if err != nil {
+		return nil, errors.InternalIssue.CausedBy(err)
+	}
+
+	if _, err := tx.Exec(ctx, q, args...); err != nil {
+		err = translateErr(err)
+		if errors.Is(err, errors.Conflict) {
+			return nil, errors.Conflict.Coded("slug_taken").Hintf("slug '%s' is taken", slug)
+		}
+		return nil, err
+	}
+
+	if err := insertOrgMember(ctx, tx, org.ID, userID, OrgRoleOwner, now); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, translateErr(err)
+	}
+	return &org, nil
+}
+
+// ListUserOrgs returns all organizations the user is a member of.
+func (auth *Auth) ListUserOrgs(ctx context.Context, userID string) ([]Membership, error) {
+	q, args, err := sq.Select("o.id", "o.name", "o.slug", "coalesce(o.created_by, '')", "o.created_at",
+		"o.updated_at", "m.role", "m.joined_at").
+		From("org_members AS m").
+		InnerJoin("orgs AS o ON o.id=m.org_id").
+		Where(sq.Eq{"m.user_id": userID}).
+		OrderBy("o.name").
+		PlaceholderFormat(sq.Dollar).ToSql()
+	if err != nil {
+		return nil, errors.InternalIssue.CausedBy(err)
+	}
+
+	rows, err := auth.conn.Query(ctx, q, args...)
+	if err != nil {
+		return nil, translateErr(err)
+	}
+	defer rows.Close()
+
+	res := []Membership{}
+	for rows.Next() {
+		var m Membership
+		if err := rows.Scan(&m.Org.ID, &m.Org.Name, &m.Org.Slug, &m.Org.CreatedBy,
+			&m.Org.CreatedAt, &m.Org.UpdatedAt, &m.Role, &m.JoinedAt); err != nil {
+			return nil, translateErr(err)
+		}
+		res = append(res, m)
+	}
+	return res, translateErr(rows.Err())
+}
+
+// ListOrgMembers returns the members of the organization. The requesting
+// user must be a member of the organization.
+func (auth *Auth) ListOrgMembers(ctx context.Context, orgID, actorID string) ([]OrgMember, error) {
+	if _, err := orgRole(ctx, auth.conn, orgID, actorID); err != nil {
+		return nil, err
+	}
+
+	q, args, err := sq.Select("u.id", "u.username", "u.email", "m.role", "m.joined_at").
+		From("org_members AS m").
+		InnerJoin("users AS u ON u.id=m.user_id").
+		Where(sq.Eq{"m.org_id": orgID}).
+		OrderBy("m.joined_at").
+		PlaceholderFormat(sq.Dollar).ToSql()
+	if err != nil {
+		return nil, errors.InternalIssue.CausedBy(err)
+	}
+
+	rows, err := auth.conn.Query(ctx, q, args...)
+	if err != nil {
+		return nil, translateErr(err)
+	}
+	defer rows.Close()
+
+	res := []OrgMember{}
+	for rows.Next() {
+		var m OrgMember
+		if err := rows.Scan(&m.UserID, &m.Username, &m.Email, &m.Role, &m.JoinedAt); err != nil {
+			return nil, translateErr(err)
+		}
+		res = append(res, m)
+	}
+	return res, translateErr(rows.Err())
+}
+
+// InviteMember sends an invitation to join the organization with the
+// given role to the email. Only owners and admins can invite members and
+// only owners can invite other owners.
+func (auth *Auth) InviteMember(ctx context.Context, orgID, actorID, email, role string) error {
+	email = strings.ToLower(strings.TrimSpace(email))
+	if !strutils.OneOf(role, orgRoles) {
+		return errors.InvalidInput.Coded("invalid_role").Hintf("role must be one of %v", orgRoles)
+	} else if !strutils.IsValidEmail(email) {
+		return errors.InvalidInput.Coded("invalid_email")
+	}
+
+	actorRole, err := orgRole(ctx, auth.conn, orgID, actorID)
+	if err != nil {
+		return err
+	} else if err := checkInviteRole(actorRole, role); err != nil {
+		return err
+	}
+
+	org, err := auth.getOrg(ctx, orgID)
+	if err != nil {
+		return err
+	}
+
+	inviter, err := auth.GetUser(ctx, NewAuthKey(KeyKindID, actorID))
+	if err != nil {
+		return err
+	}
+
+	expiresAt := time.Now().Add(auth.cfg.OrgInviteTTL)
+	token, err := issueToken(ctx, auth.conn, tokenKindOrgInvite, nil, auth.cfg.OrgInviteTTL, map[string]any{
+		"org_id":     orgID,
+		"email":      email,
+		"role":       role,
+		"invited_by": actorID,
+	})
+	if err != nil {
+		return err
+	}
+
+	var link string
+	if auth.cfg.InvitePageRoute != "" {
+		link = withQuery(auth.cfg.InvitePageRoute, map[string]string{"token": token})
+	}
+
+	auth.sendMail(ctx, mailOrgInvite, email, map[string]any{
+		"OrgName":     org.Name,
+		"InviterName": inviter.Username,
+		"Role":        role,
+		"Link":        link,
+		"Token":       token,
+		"ExpiresAt":   expiresAt,
+	})
+	return nil
+}
+
+// AcceptInvite adds the user to the organization the invitation was
+// issued for. The invitation must have been sent to the email of the
+// user.
+func (auth *Auth) AcceptInvite(ctx context.Context, userID, token string) (*Membership, error) {
+	var errToken = errors.InvalidInput.Coded("invalid_invite")
+
+	u, err := auth.GetUser(ctx, NewAuthKey(KeyKindID, userID))
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := auth.conn.Begin(ctx)
+	if err != nil {
+		return nil, translateErr(err)
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	ut, err := consumeToken(ctx, tx, tokenKindOrgInvite, token)
+	if err != nil {
+		if errors.Is(err, errors.NotFound) {
+			return nil, errToken.Hintf("invitation is invalid or has expired")
+		}
+		return nil, err
+	}
+
+	orgID, _ := ut.Attribs["org_id"].(string)
+	email, _ := ut.Attribs["email"].(string)
+	role, _ := ut.Attribs["role"].(string)
+	if !strings.EqualFold(email, u.Email) {
+		return nil, errors.Forbidden.Coded("invite_email_mismatch").
+			Hintf("invitation was sent to a different email")
+	}
+
+	now := time.Now()
+	if err := insertOrgMember(ctx, tx, orgID, userID, role, now); err != nil {
+		if errors.Is(err, errors.Conflict) {
+			return nil, errors.Conflict.Coded("already_member")
+		}
+		return nil, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, translateErr(err)
+	}
+
+	org, err := auth.getOrg(ctx, orgID)
+	if err != nil {
+		return nil, err
+	}
+	return &Membership{Org: *org, Role: role, JoinedAt: now}, nil
+}
+
+// RemoveMember removes the user from the organization. Members can remove
+// themselves (i.e., leave), owners and admins can remove others. Admins
+// cannot remove owners and the last owner cannot be removed. Sessions of
+// the user that have the organization active are revoked.
+func (auth *Auth) RemoveMember(ctx context.Context, orgID, actorID, userID string) error {
+	tx, err := auth.conn.Begin(ctx)
+	if err != nil {
+		return translateErr(err)
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	// Lock the org so that concurrent membership changes cannot race the
+	// role and last-owner checks below.
+	if _, err := tx.Exec(ctx, "SELECT 1 FROM orgs WHERE id=$1 FOR UPDATE", orgID); err != nil {
+		return translateErr(err)
+	}
+
+	actorRole, err := orgRole(ctx, tx, orgID, actorID)
+	if err != nil {
+		return err
+	}
+
+	role, err := orgRole(ctx, tx, orgID, userID)
+	if err != nil {
+		if errors.Is(err, errNotOrgMember) {
+			return errors.NotFound.Coded("member_not_found")
+		}
+		return err
+	}
+
+	q, args, err := sq.Select("count(*)").
+		From("org_members").
+		Where(sq.Eq{
+			"org_id": orgID,
+			"role":   OrgRoleOwner,
+		}).
+		Where(sq.NotEq{"user_id": userID}).
+		PlaceholderFormat(sq.Dollar).ToSql()
+	if err != nil {
+		return errors.InternalIssue.CausedBy(err)
+	}
+
+	var otherOwners int
+	if err := tx.QueryRow(ctx, q, args...).Scan(&otherOwners); err != nil {
+		return translateErr(err)
+	} else if err := checkRemoveMember(actorID == userID, actorRole, role, otherOwners); err != nil {
+		return err
+	}
+
+	q, args, err = sq.Delete("org_members").
+		Where(sq.Eq{
+			"org_id":  orgID,
+			"user_id": userID,
+		}).
+		PlaceholderFormat(sq.Dollar).ToSql()
+	if err != nil {
+		return errors.InternalIssue.CausedBy(err)
+	}
+
+	if _, err := tx.Exec(ctx, q, args...); err != nil {
+		return translateErr(err)
+	}
+
+	// Access tokens of the sessions that have the org active carry it
+	// until they expire. Such sessions are revoked so that the removed
+	// member loses access to the org right away.
+	if err := revokeSessions(ctx, tx, sq.Eq{"org_id": orgID, "user_id": userID}); err != nil {
+		return err
+	}
+
+	return translateErr(tx.Commit(ctx))
+}
+
+// SwitchOrg sets the active organization of the session and returns the
+// session with a new access token carrying the organization. An empty
+// orgID clears the active organization. The refresh token of the session
+// remains valid and is not returned.
+func (auth *Auth) SwitchOrg(ctx context.Context, sess Session, orgID string) (*Session, error) {
+	if sess.ID == "" {
+		return nil, errors.Forbidden.Coded("login_required").Hintf("api keys cannot switch orgs")
+	}
+
+	if orgID != "" {
+		if _, err := orgRole(ctx, auth.conn, orgID, sess.UserID); err != nil {
+			return nil, err
+		}
+	}
+
+	q, args, err := sq.Update("sessions").
+		Where(sq.Eq{
+			"id":         sess.ID,
+			"user_id":    sess.UserID,
+			"revoked_at": nil,
+		}).
+		Set("org_id", sq.Expr("NULLIF(?, '')", orgID)).
+		PlaceholderFormat(sq.Dollar).ToSql()
+	if err != nil {
+		return nil, errors.InternalIssue.CausedBy(err)
+	}
+
+	tag, err := auth.conn.Exec(ctx, q, args...)
+	if err != nil {
+		return nil, translateErr(err)
+	} else if tag.RowsAffected() == 0 {
+		return nil, errors.MissingAuth.Coded("invalid_token").Hintf("session revoked")
+	}
+
+	u, err := auth.GetUser(ctx, NewAuthKey(KeyKindID, sess.UserID))
+	if err != nil {
+		return nil, err
+	}
+	return auth.signSession(ctx, *u, sess.ID, orgID, time.Now())
+}
+
+// checkInviteRole returns error if a member with the actorRole may not
+// invite others with the given role. Only owners and admins can invite
+// and only owners can invite other owners.
+func checkInviteRole(actorRole, role string) error {
+	if actorRole == OrgRoleMember || (role == OrgRoleOwner && actorRole != OrgRoleOwner) {
+		return errOrgRole
+	}
+	return nil
+}
+
+// checkRemoveMember returns error if a member with the actorRole may not
+// remove a member with the given role. Self is true if the member leaves
+// on their own. OtherOwners is the number of owners that would remain.
+func checkRemoveMember(self bool, actorRole, role string, otherOwners int) error {
+	if !self && (actorRole == OrgRoleMember || (role == OrgRoleOwner && actorRole != OrgRoleOwner)) {
+		return errOrgRole
+	} else if role == OrgRoleOwner && otherOwners == 0 {
+		return errLastOwner
+	}
+	return nil
+}
+
+func (auth *Auth) getOrg(ctx context.Context, orgID string) (*Org, error) {
+	q, args, err := sq.Select("id", "name", "slug", "coalesce(created_by, '')", "created_at", "updated_at").
+		From("orgs").
+		Where(sq.Eq{"id": orgID}).
+		PlaceholderFormat(sq.Dollar).ToSql()
+	if err != nil {
+		return nil, errors.InternalIssue.CausedBy(err)
+	}
+
+	var org Org
+	row := auth.conn.QueryRow(ctx, q, args...)
+	if err := row.Scan(&org.ID, &org.Name, &org.Slug, &org.CreatedBy, &org.CreatedAt, &org.UpdatedAt); err != nil {
+		return nil, translateErr(err)
+	}
+	return &org, nil
+}
+
+// orgRole returns the role of the user in the organization. Returns
+// errNotOrgMember if the user is not a member.
+func orgRole(ctx context.Context, db querier, orgID, userID string) (string, error) {
+	q, args, err := sq.Select("role").
+		From("org_members").
+		Where(sq.Eq{
+			"org_id":  orgID,
+			"user_id": userID,
+		}).
+		PlaceholderFormat(sq.Dollar).ToSql()
+	if err != nil {
+		return "", errors.InternalIssue.CausedBy(err)
+	}
+
+	var role string
+	if err := db.QueryRow(ctx, q, args...).Scan(&role); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return "", errNotOrgMember
+		}
+		return "", translateErr(err)
+	}
+	return role, nil
+}
+
+func insertOrgMember(ctx context.Context, db querier, orgID, userID, role string, now time.Time) error {
+	q, args, err := sq.Insert("org_members").
+		Columns("org_id", "user_id", "role", "joined_at").
+		Values(orgID, userID, role, now).
+		PlaceholderFormat(sq.Dollar).ToSql()
+	if err != nil {
+		return errors.InternalIssue.CausedBy(err)
+	}
+
+	_, err = db.Exec(ctx, q, args...)
+	return translateErr(err)
+}
@@ -0,0 +1,74 @@
+package auth
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/spy16/pgbase/errors"
+)
+
+func TestCheckInviteRole(t *testing.T) {
+	t.Parallel()
+
+	table := []struct {
+		actorRole string
+		role      string
+		wantErr   error
+	}{
+		{actorRole: OrgRoleOwner, role: OrgRoleOwner},
+		{actorRole: OrgRoleOwner, role: OrgRoleAdmin},
+		{actorRole: OrgRoleOwner, role: OrgRoleMember},
+		{actorRole: OrgRoleAdmin, role: OrgRoleOwner, wantErr: errOrgRole},
+		{actorRole: OrgRoleAdmin, role: OrgRoleAdmin},
+		{actorRole: OrgRoleAdmin, role: OrgRoleMember},
+		{actorRole: OrgRoleMember, role: OrgRoleAdmin, wantErr: errOrgRole},
+		{actorRole: OrgRoleMember, role: OrgRoleMember, wantErr: errOrgRole},
+	}
+
+	for _, tt := range table {
+		t.Run(tt.actorRole+"_"+tt.role, func(t *testing.T) {
+			err := checkInviteRole(tt.actorRole, tt.role)
+			if tt.wantErr == nil {
+				assert.NoError(t, err)
+			} else {
+				assert.True(t, errors.Is(err, tt.wantErr), "want %v, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestCheckRemoveMember(t *testing.T) {
+	t.Parallel()
+
+	table := []struct {
+		title       string
+		self        bool
+		actorRole   string
+		role        string
+		otherOwners int
+		wantErr     error
+	}{
+		{title: "MemberLeaves", self: true, actorRole: OrgRoleMember, role: OrgRoleMember},
+		{title: "AdminLeaves", self: true, actorRole: OrgRoleAdmin, role: OrgRoleAdmin},
+		{title: "OwnerLeaves", self: true, actorRole: OrgRoleOwner, role: OrgRoleOwner, otherOwners: 1},
+		{title: "LastOwnerLeaves", self: true, actorRole: OrgRoleOwner, role: OrgRoleOwner, wantErr: errLastOwner},
+		{title: "OwnerRemovesOwner", actorRole: OrgRoleOwner, role: OrgRoleOwner, otherOwners: 1},
+		{title: "OwnerRemovesAdmin", actorRole: OrgRoleOwner, role: OrgRoleAdmin},
+		{title: "AdminRemovesMember", actorRole: OrgRoleAdmin, role: OrgRoleMember, otherOwners: 1},
+		{title: "AdminRemovesAdmin", actorRole: OrgRoleAdmin, role: OrgRoleAdmin, otherOwners: 1},
+		{title: "AdminRemovesOwner", actorRole: OrgRoleAdmin, role: OrgRoleOwner, otherOwners: 1, wantErr: errOrgRole},
+		{title: "MemberRemovesMember", actorRole: OrgRoleMember, role: OrgRoleMember, wantErr: errOrgRole},
+	}
+
+	for _, tt := range table {
+		t.Run(tt.title, func(t *testing.T) {
+			err := checkRemoveMember(tt.self, tt.actorRole, tt.role, tt.otherOwners)
+			if tt.wantErr == nil {
+				assert.NoError(t, err)
+			} else {
+				assert.True(t, errors.Is(err, tt.wantErr), "want %v, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,352 @@
+package auth
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"strings"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+
+	"github.com/spy16/pgbase/errors"
+	"github.com/spy16/pgbase/log"
+	"github.com/spy16/pgbase/sms"
+	"github.com/spy16/pgbase/strutils"
+)
+
+// Channels for delivering one-time codes.
+const (
+	ChannelEmail = "email"
+	ChannelSMS   = "sms"
+)
+
+const (
+	otpCodeLen     = 6
+	maxOTPAttempts = 5
+)
+
+var errOTP = errors.MissingAuth.Coded("invalid_otp")
+
+// OTPChallenge identifies a one-time code sent to the user. The code must
+// be submitted along with the challenge ID.
+type OTPChallenge struct {
+	ID        string    `json:"otp_id"`
+	Channel   string    `json:"channel"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// RequestLoginOTP sends a one-time login code over the channel to the user
+// with the given email (or phone for SMS). A challenge is returned even if
+// no such user exists so that callers cannot probe for registered users.
+func (auth *Auth) RequestLoginOTP(ctx context.Context, channel, to string) (*OTPChallenge, error) {
+	to, err := otpDestination(channel, to)
+	if err != nil {
+		return nil, err
+	}
+
+	keyKind := KeyKindEmail
+	if channel == ChannelSMS {
+		keyKind = KeyKindPhone
+	}
+
+	challenge := OTPChallenge{
+		Channel:   channel,
+		ExpiresAt: time.Now().Add(auth.cfg.OTPTTL),
+	}
+
+	u, err := auth.GetUser(ctx, NewAuthKey(keyKind, to))
+	if err != nil && !errors.Is(err, errors.NotFound) {
+		return nil, err
+	} else if u == nil || u.DisabledAt != nil {
+		// A decoy that will never verify.
+		challenge.ID = newSecretToken()
+		return &challenge, nil
+	}
+
+	code := newSecretCode(otpCodeLen, strutils.CharsetNums)
+	challenge.ID, err = auth.issueOTP(ctx, tokenKindLoginOTP, u.ID, map[string]any{
+		"channel":   channel,
+		"to":        to,
+		"code_hash": hashToken(code),
+	})
+	if err != nil {
+		if errors.Is(err, errTooManyAttempts) {
+			// Throttled requests get a decoy as well so that throttling
+			// does not reveal registered destinations.
+			log.Debug(ctx, "login otp throttled", log.Fields{"user_id": u.ID})
+			challenge.ID = newSecretToken()
+			return &challenge, nil
+		}
+		return nil, err
+	}
+
+	auth.sendOTP(ctx, channel, to, code, challenge.ExpiresAt)
+	return &challenge, nil
+}
+
+// VerifyLoginOTP verifies the code sent for the challenge and returns the
+// user on success. The challenge is invalidated after success or too many
+// failed attempts. Failures also count towards the login throttle of the
+// destination and the client IP. Email is marked verified if the code was
+// sent by mail.
+func (auth *Auth) VerifyLoginOTP(ctx context.Context, otpID, code string) (*User, error) {
+	ip := curClient(ctx).IP
+	if err := auth.checkLoginThrottle(ctx, "", ip); err != nil {
+		return nil, err
+	}
+
+	ut, err := auth.claimOTP(ctx, tokenKindLoginOTP, otpID)
+	if err != nil {
+		if errors.Is(err, errOTP) {
+			auth.recordOTPFailure(ctx, "", ip)
+		}
+		return nil, err
+	}
+
+	account := otpAccount(ut.Attribs)
+	if err := auth.checkLoginThrottle(ctx, account, ip); err != nil {
+		return nil, err
+	}
+
+	if err := auth.redeemOTP(ctx, ut, tokenKindLoginOTP, otpID, code); err != nil {
+		if errors.Is(err, errOTP) {
+			auth.recordOTPFailure(ctx, account, ip)
+		}
+		return nil, err
+	} else if err := auth.resetLoginThrottle(ctx, account); err != nil {
+		log.Warn(ctx, "failed to reset login throttle", log.Fields{"error": err.Error()})
+	}
+
+	u, err := auth.GetUser(ctx, NewAuthKey(KeyKindID, *ut.UserID))
+	if err != nil {
+		return nil, err
+	}
+
+	if channel, _ := ut.Attribs["channel"].(string); channel == ChannelEmail && u.VerifiedAt == nil {
+		if u, err = auth.markVerified(ctx, u.ID, loginMethodOTP); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := auth.checkLoginAllowed(u); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// StartPhoneChange sends a one-time code to the phone number. The number
+// is set for the user only once the code is confirmed using ConfirmPhone.
+func (auth *Auth) StartPhoneChange(ctx context.Context, userID, phone string) (*OTPChallenge, error) {
+	phone, err := otpDestination(ChannelSMS, phone)
+	if err != nil {
+		return nil, err
+	}
+
+	exU, err := auth.GetUser(ctx, NewAuthKey(KeyKindPhone, phone))
+	if err != nil && !errors.Is(err, errors.NotFound) {
+		return nil, err
+	} else if exU != nil && exU.ID != userID {
+		return nil, errors.Conflict.Coded("phone_taken").Hintf("phone is used by another account")
+	}
+
+	challenge := OTPChallenge{
+		Channel:   ChannelSMS,
+		ExpiresAt: time.Now().Add(auth.cfg.OTPTTL),
+	}
+
+	code := newSecretCode(otpCodeLen, strutils.CharsetNums)
+	challenge.ID, err = auth.issueOTP(ctx, tokenKindPhoneOTP, userID, map[string]any{
+		"phone":     phone,
+		"code_hash": hashToken(code),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	auth.sendOTP(ctx, ChannelSMS, phone, code, challenge.ExpiresAt)
+	return &challenge, nil
+}
+
+// ConfirmPhone verifies the code sent by StartPhoneChange and sets the
+// phone number of the user.
+func (auth *Auth) ConfirmPhone(ctx context.Context, userID, otpID, code string) error {
+	ut, err := auth.claimOTP(ctx, tokenKindPhoneOTP, otpID)
+	if err != nil {
+		return err
+	} else if *ut.UserID != userID {
+		return errOTP.Hintf("challenge belongs to another user")
+	} else if err := auth.redeemOTP(ctx, ut, tokenKindPhoneOTP, otpID, code); err != nil {
+		return err
+	}
+
+	phone, _ := ut.Attribs["phone"].(string)
+	return auth.setPhone(ctx, userID, &phone)
+}
+
+// RemovePhone removes the phone number of the user.
+func (auth *Auth) RemovePhone(ctx context.Context, userID string) error {
+	return auth.setPhone(ctx, userID, nil)
+}
+
+func (auth *Auth) setPhone(ctx context.Context, userID string, phone *string) error {
+	q, args, err := sq.Update("users").
+		Where(sq.Eq{"id": userID}).
+		Set("phone", phone).
+		Set("updated_at", time.Now()).
+		PlaceholderFormat(sq.Dollar).ToSql()
+	if err != nil {
+		return errors.InternalIssue.CausedBy(err)
+	}
+
+	tag, err := auth.conn.Exec(ctx, q, args...)
+	if err != nil {
+		if err = translateErr(err); errors.Is(err, errors.Conflict) {
+			return errors.Conflict.Coded("phone_taken").Hintf("phone is used by another account")
+		}
+		return err
+	} else if tag.RowsAffected() == 0 {
+		return errors.NotFound.Coded("user_not_found")
+	}
+	return nil
+}
+
+// issueOTP issues a one-time code challenge of given kind for the user.
+// Returns errTooManyAttempts if a challenge of the same kind was issued
+// to the user within the OTPResendInterval.
+func (auth *Auth) issueOTP(ctx context.Context, kind, userID string, attribs map[string]any) (string, error) {
+	tx, err := auth.conn.Begin(ctx)
+	if err != nil {
+		return "", translateErr(err)
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	// Lock the user so that concurrent requests cannot both pass the
+	// resend check.
+	q, args, err := sq.Select().
+		Column(sq.Expr("(SELECT max(created_at) FROM user_tokens WHERE kind=? AND user_id=users.id)", kind)).
+		From("users").
+		Where(sq.Eq{"id": userID}).
+		Suffix("FOR UPDATE").
+		PlaceholderFormat(sq.Dollar).ToSql()
+	if err != nil {
+		return "", errors.InternalIssue.CausedBy(err)
+	}
+
+	var lastIssuedAt *time.Time
+	if err := tx.QueryRow(ctx, q, args...).Scan(&lastIssuedAt); err != nil {
+		return "", translateErr(err)
+	} else if lastIssuedAt != nil {
+		if wait := time.Until(lastIssuedAt.Add(auth.cfg.OTPResendInterval)); wait > 0 {
+			return "", errThrottled(wait)
+		}
+	}
+
+	id, err := issueToken(ctx, tx, kind, &userID, auth.cfg.OTPTTL, attribs)
+	if err != nil {
+		return "", err
+	}
+	return id, translateErr(tx.Commit(ctx))
+}
+
+// claimOTP counts an attempt against the challenge and returns it. Each
+// challenge allows at most maxOTPAttempts attempts.
+func (auth *Auth) claimOTP(ctx context.Context, kind, otpID string) (*userToken, error) {
+	ut, err := claimTokenAttempt(ctx, auth.conn, kind, strings.TrimSpace(otpID), maxOTPAttempts)
+	if err != nil {
+		if errors.Is(err, errors.NotFound) {
+			return nil, errOTP
+		}
+		return nil, err
+	} else if ut.UserID == nil {
+		return nil, errOTP.Hintf("challenge has no user")
+	}
+	return ut, nil
+}
+
+// redeemOTP verifies the code against the challenge claimed using claimOTP
+// and consumes the challenge if the code matches.
+func (auth *Auth) redeemOTP(ctx context.Context, ut *userToken, kind, otpID, code string) error {
+	codeHash, _ := ut.Attribs["code_hash"].(string)
+	if subtle.ConstantTimeCompare([]byte(hashToken(strings.TrimSpace(code))), []byte(codeHash)) != 1 {
+		return errOTP.Hintf("code mismatch")
+	}
+
+	if _, err := consumeToken(ctx, auth.conn, kind, strings.TrimSpace(otpID)); err != nil {
+		if errors.Is(err, errors.NotFound) {
+			return errOTP
+		}
+		return err
+	}
+	return nil
+}
+
+// recordOTPFailure counts the failed login code against the login throttle.
+func (auth *Auth) recordOTPFailure(ctx context.Context, account, ip string) {
+	if err := auth.recordLoginFailure(ctx, account, ip); err != nil {
+		log.Warn(ctx, "failed to record login failure", log.Fields{"error": err.Error()})
+	}
+}
+
+// otpAccount returns the subject used for counting failed logins of the
+// destination the login code was sent to. Email destinations share the
+// counter with password logins using the email.
+func otpAccount(attribs map[string]any) string {
+	channel, _ := attribs["channel"].(string)
+	to, _ := attribs["to"].(string)
+	if to == "" {
+		return ""
+	}
+
+	keyKind := KeyKindEmail
+	if channel == ChannelSMS {
+		keyKind = KeyKindPhone
+	}
+	return throttleAccount(NewAuthKey(keyKind, to))
+}
+
+// sendOTP delivers the code over the channel. Delivery failures are logged
+// and not returned, same as mails.
+func (auth *Auth) sendOTP(ctx context.Context, channel, to, code string, expiresAt time.Time) {
+	switch channel {
+	case ChannelEmail:
+		auth.sendMail(ctx, mailLoginCode, to, map[string]any{
+			"Email":     to,
+			"Code":      code,
+			"ExpiresAt": expiresAt,
+		})
+
+	case ChannelSMS:
+		msg := sms.Message{
+			To: to,
+			Text: fmt.Sprintf("%s is your %s code. It expires in %d minutes.",
+				code, auth.cfg.TOTPIssuer, int(time.Until(expiresAt).Round(time.Minute).Minutes())),
+		}
+		if err := auth.sms.Send(ctx, msg); err != nil {
+			log.Error(ctx, "failed to send sms", err, log.Fields{"channel": channel})
+		}
+	}
+}
+
+// otpDestination validates and normalises the destination for the channel.
+func otpDestination(channel, to string) (string, error) {
+	to = strings.TrimSpace(to)
+
+	switch channel {
+	case ChannelEmail:
+		if !strutils.IsValidEmail(to) {
+			return "", errors.InvalidInput.Hintf("invalid email")
+		}
+		return to, nil
+
+	case ChannelSMS:
+		phone, ok := strutils.NormalizePhone(to)
+		if !ok {
+			return "", errors.InvalidInput.Coded("invalid_phone").Hintf("phone must be in E.164 format")
+		}
+		return phone, nil
+
+	default:
+		return "", errors.InvalidInput.Coded("invalid_channel").Hintf("channel '%s' is not supported", channel)
+	}
+}
@@ -0,0 +1,50 @@
+package auth
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/spy16/pgbase/errors"
+)
+
+func TestOTPDestination(t *testing.T) {
+	table := []struct {
+		channel string
+		to      string
+		want    string
+		wantErr string
+	}{
+		{channel: ChannelEmail, to: " bob@bobmail.com ", want: "bob@bobmail.com"},
+		{channel: ChannelEmail, to: "bobmail.com", wantErr: "invalid_input"},
+		{channel: ChannelSMS, to: "+1 (415) 555-2671", want: "+14155552671"},
+		{channel: ChannelSMS, to: "4155552671", wantErr: "invalid_phone"},
+		{channel: "pigeon", to: "bob", wantErr: "invalid_channel"},
+	}
+
+	for _, tt := range table {
+		t.Run(tt.channel+"/"+tt.to, func(t *testing.T) {
+			got, err := otpDestination(tt.channel, tt.to)
+			if tt.wantErr != "" {
+				require.Error(t, err)
+				assert.Equal(t, tt.wantErr, errors.E(err).Code)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestOTPAccount(t *testing.T) {
+	assert.Equal(t, "email/bob@bobmail.com", otpAccount(map[string]any{
+		"channel": ChannelEmail,
+		"to":      "Bob@BobMail.com",
+	}))
+	assert.Equal(t, "phone/+14155552671", otpAccount(map[string]any{
+		"channel": ChannelSMS,
+		"to":      "+14155552671",
+	}))
+	assert.Equal(t, "", otpAccount(map[string]any{"channel": ChannelSMS}))
+}
@@ -0,0 +1,104 @@
+package auth
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+
+	"github.com/spy16/pgbase/errors"
+)
+
+// RequestPasswordReset issues a single-use password reset token for the
+// user with the given email. No error is returned if the user does not
+// exist so that callers cannot probe for registered emails.
+func (auth *Auth) RequestPasswordReset(ctx context.Context, email string) error {
+	email = strings.TrimSpace(email)
+
+	u, err := auth.GetUser(ctx, NewAuthKey(KeyKindEmail, email))
+	if err != nil {
+		if errors.Is(err, errors.NotFound) {
+			return nil
+		}
+		return err
+	}
+
+	expiresAt := time.Now().Add(auth.cfg.ResetTokenTTL)
+	token, err := issueToken(ctx, auth.conn, tokenKindPasswordReset, &u.ID, auth.cfg.ResetTokenTTL, nil)
+	if err != nil {
+		return err
+	}
+
+	var link string
+	if auth.cfg.ResetPageRoute != "" {
+		link = withQuery(auth.cfg.ResetPageRoute, map[string]string{"token": token})
+	}
+
+	auth.sendMail(ctx, mailPasswordReset, u.Email, map[string]any{
+		"User":      u.Clone(true),
+		"Link":      link,
+		"Token":     token,
+		"ExpiresAt": expiresAt,
+	})
+	return nil
+}
+
+// ResetPassword sets a new password for the user the reset token was
+// issued to. The token is invalidated and all sessions of the user are
+// revoked.
+func (auth *Auth) ResetPassword(ctx context.Context, token, password string) error {
+	var errToken = errors.MissingAuth.Coded("invalid_reset_token")
+
+	// The token is consumed within the transaction so that it can be used
+	// again if the password is rejected by the policy.
+	tx, err := auth.conn.Begin(ctx)
+	if err != nil {
+		return translateErr(err)
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	ut, err := consumeToken(ctx, tx, tokenKindPasswordReset, strings.TrimSpace(token))
+	if err != nil {
+		if errors.Is(err, errors.NotFound) {
+			return errToken
+		}
+		return err
+	} else if ut.UserID == nil {
+		return errToken.Hintf("token has no user")
+	}
+
+	u, err := auth.GetUser(ctx, NewAuthKey(KeyKindID, *ut.UserID))
+	if err != nil {
+		return err
+	}
+
+	pwdHash, err := auth.HashPassword(password, *u)
+	if err != nil {
+		return err
+	}
+
+	q, args, err := sq.Update("users").
+		Where(sq.Eq{"id": *ut.UserID}).
+		Set("pwd_hash", pwdHash).
+		Set("updated_at", time.Now()).
+		PlaceholderFormat(sq.Dollar).ToSql()
+	if err != nil {
+		return errors.InternalIssue.CausedBy(err)
+	}
+
+	if _, err := tx.Exec(ctx, q, args...); err != nil {
+		return translateErr(err)
+	}
+
+	if err := revokeSessions(ctx, tx, sq.Eq{"user_id": *ut.UserID}); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return translateErr(err)
+	}
+
+	auth.recordEvent(ctx, EventPasswordChanged, *ut.UserID, map[string]any{"method": "reset"})
+	return nil
+}
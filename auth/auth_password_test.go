@@ -0,0 +1,49 @@
+package auth
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/spy16/pgbase/errors"
+)
+
+func TestRequestPasswordReset(t *testing.T) {
+	rm := &recordingMailer{}
+	au := newTestAuth(t, Config{}, WithMailer(rm))
+	ctx := context.Background()
+
+	const email = "bob@example.com"
+	registerTestUser(t, au, email, "Correct-Horse-42")
+
+	t.Run("UnknownEmail", func(t *testing.T) {
+		require.NoError(t, au.RequestPasswordReset(ctx, "nobody@example.com"))
+		assert.Empty(t, rm.sent("nobody@example.com"))
+	})
+
+	require.NoError(t, au.RequestPasswordReset(ctx, " "+email+" "))
+	msgs := rm.sent(email)
+	require.Len(t, msgs, 1)
+
+	var token string
+	for _, line := range strings.Split(msgs[0].Text, "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.Contains(line, " ") {
+			token = line
+		}
+	}
+	require.NotEmpty(t, token, "mail carries no token:\n%s", msgs[0].Text)
+
+	require.NoError(t, au.ResetPassword(ctx, token, "Battery-Staple-77"))
+
+	u, err := au.GetUser(ctx, NewAuthKey(KeyKindEmail, email))
+	require.NoError(t, err)
+	assert.True(t, u.CheckPassword("Battery-Staple-77"))
+	assert.False(t, u.CheckPassword("Correct-Horse-42"))
+
+	err = au.ResetPassword(ctx, token, "Another-Secret-99")
+	assert.Equal(t, "invalid_reset_token", errors.E(err).Code)
+}
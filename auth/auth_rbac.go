@@ -0,0 +1,333 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgx/v5/pgconn"
+
+	"github.com/spy16/pgbase/errors"
+	"github.com/spy16/pgbase/httpx"
+)
+
+// permWildcard matches any action (e.g., 'posts:*') or, on its own, any
+// permission at all.
+const permWildcard = "*"
+
+var (
+	roleNamePattern = regexp.MustCompile(`^[a-z][a-z0-9_-]*$`)
+	permPattern     = regexp.MustCompile(`^(\*|[a-z][a-z0-9_-]*(:([a-z][a-z0-9_-]*|\*))*)$`)
+)
+
+// Role is a named set of permissions that can be granted to users.
+// Permissions are of the form 'resource:action' (e.g., 'posts:write').
+type Role struct {
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	Permissions []string  `json:"permissions"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// Grants represents the roles granted to a user and the permissions they
+// resolve to.
+type Grants struct {
+	Roles       []string `json:"roles"`
+	Permissions []string `json:"permissions"`
+
+	version int
+}
+
+// PutRole creates the role or updates it if it exists already.
+func (auth *Auth) PutRole(ctx context.Context, role Role) (*Role, error) {
+	if !roleNamePattern.MatchString(role.Name) {
+		return nil, errors.InvalidInput.Coded("invalid_role").
+			Hintf("role name must match '%s'", roleNamePattern)
+	}
+
+	if role.Permissions == nil {
+		role.Permissions = []string{}
+	}
+	for _, perm := range role.Permissions {
+		if !permPattern.MatchString(perm) {
+			return nil, errors.InvalidInput.Coded("invalid_permission").
+				Hintf("permission '%s' is not valid", perm)
+		}
+	}
+
+	tx, err := auth.conn.Begin(ctx)
+	if err != nil {
+		return nil, translateErr(err)
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	now := time.Now()
+	q, args, err := sq.Insert("roles").
+		Columns("name", "description", "permissions", "created_at", "updated_at").
+		Values(role.Name, role.Description, role.Permissions, now, now).
+		Suffix(`ON CONFLICT (name) DO UPDATE SET description=excluded.description,
+			permissions=excluded.permissions, updated_at=excluded.updated_at
+			RETURNING created_at, updated_at`).
+		PlaceholderFormat(sq.Dollar).ToSql()
+	if err != nil {
+		return nil, errors.InternalIssue.CausedBy(err)
+	}
+
+	if err := tx.QueryRow(ctx, q, args...).Scan(&role.CreatedAt, &role.UpdatedAt); err != nil {
+		return nil, translateErr(err)
+	}
+
+	// Permissions of the role may have changed for the users holding it.
+	if err := bumpGrantsVersion(ctx, tx, roleHolders(role.Name)); err != nil {
+		return nil, err
+	} else if err := tx.Commit(ctx); err != nil {
+		return nil, translateErr(err)
+	}
+	return &role, nil
+}
+
+// DeleteRole deletes the role and revokes it from all users.
+func (auth *Auth) DeleteRole(ctx context.Context, name string) error {
+	tx, err := auth.conn.Begin(ctx)
+	if err != nil {
+		return translateErr(err)
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	// Holders must be found before the grants are deleted by the cascade.
+	if err := bumpGrantsVersion(ctx, tx, roleHolders(name)); err != nil {
+		return err
+	}
+
+	q, args, err := sq.Delete("roles").
+		Where(sq.Eq{"name": name}).
+		PlaceholderFormat(sq.Dollar).ToSql()
+	if err != nil {
+		return errors.InternalIssue.CausedBy(err)
+	}
+
+	tag, err := tx.Exec(ctx, q, args...)
+	if err != nil {
+		return translateErr(err)
+	} else if tag.RowsAffected() == 0 {
+		return errors.NotFound.Coded("role_not_found")
+	}
+	return translateErr(tx.Commit(ctx))
+}
+
+// ListRoles returns all the defined roles.
+func (auth *Auth) ListRoles(ctx context.Context) ([]Role, error) {
+	q, args, err := sq.Select("name", "description", "permissions", "created_at", "updated_at").
+		From("roles").
+		OrderBy("name").
+		PlaceholderFormat(sq.Dollar).ToSql()
+	if err != nil {
+		return nil, errors.InternalIssue.CausedBy(err)
+	}
+
+	rows, err := auth.conn.Query(ctx, q, args...)
+	if err != nil {
+		return nil, translateErr(err)
+	}
+	defer rows.Close()
+
+	res := []Role{}
+	for rows.Next() {
+		var role Role
+		if err := rows.Scan(&role.Name, &role.Description, &role.Permissions,
+			&role.CreatedAt, &role.UpdatedAt); err != nil {
+			return nil, translateErr(err)
+		}
+		res = append(res, role)
+	}
+	return res, translateErr(rows.Err())
+}
+
+// AssignRole grants the role to the user. Assigning a role that the user
+// already has is a no-op. Access tokens issued to the user before the
+// change are rejected, so that sessions pick up the new grants when they
+// are refreshed.
+func (auth *Auth) AssignRole(ctx context.Context, userID, role string) error {
+	tx, err := auth.conn.Begin(ctx)
+	if err != nil {
+		return translateErr(err)
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	q, args, err := sq.Insert("user_roles").
+		Columns("user_id", "role", "granted_at").
+		Values(userID, role, time.Now()).
+		Suffix("ON CONFLICT (user_id, role) DO NOTHING").
+		PlaceholderFormat(sq.Dollar).ToSql()
+	if err != nil {
+		return errors.InternalIssue.CausedBy(err)
+	}
+
+	tag, err := tx.Exec(ctx, q, args...)
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == pgerrcode.ForeignKeyViolation {
+			return errors.NotFound.Coded("role_not_found").Hintf("user or role does not exist")
+		}
+		return translateErr(err)
+	} else if tag.RowsAffected() == 0 {
+		return nil
+	}
+
+	if err := bumpGrantsVersion(ctx, tx, sq.Eq{"id": userID}); err != nil {
+		return err
+	}
+	return translateErr(tx.Commit(ctx))
+}
+
+// RevokeRole removes the role from the user. Like AssignRole, access
+// tokens issued before the change are rejected.
+func (auth *Auth) RevokeRole(ctx context.Context, userID, role string) error {
+	tx, err := auth.conn.Begin(ctx)
+	if err != nil {
+		return translateErr(err)
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	q, args, err := sq.Delete("user_roles").
+		Where(sq.Eq{
+			"user_id": userID,
+			"role":    role,
+		}).
+		PlaceholderFormat(sq.Dollar).ToSql()
+	if err != nil {
+		return errors.InternalIssue.CausedBy(err)
+	}
+
+	tag, err := tx.Exec(ctx, q, args...)
+	if err != nil {
+		return translateErr(err)
+	} else if tag.RowsAffected() == 0 {
+		return errors.NotFound.Coded("role_not_granted")
+	}
+
+	if err := bumpGrantsVersion(ctx, tx, sq.Eq{"id": userID}); err != nil {
+		return err
+	}
+	return translateErr(tx.Commit(ctx))
+}
+
+// UserGrants returns the roles granted to the user and the permissions
+// they resolve to.
+func (auth *Auth) UserGrants(ctx context.Context, userID string) (*Grants, error) {
+	return loadGrants(ctx, auth.conn, userID)
+}
+
+// RequirePermission returns a middleware that rejects requests whose
+// session does not have the given permission. Must be used after the
+// Authenticate middleware.
+func (auth *Auth) RequirePermission(perm string) func(http.Handler) http.Handler {
+	return requireSession(func(sess *Session) error {
+		if !sess.HasPermission(perm) {
+			return errors.Forbidden.Coded("permission_denied").Hintf("requires '%s'", perm)
+		}
+		return nil
+	})
+}
+
+// RequireKind returns a middleware that rejects requests from users that
+// are not of one of the given kinds. Must be used after the Authenticate
+// middleware.
+func (auth *Auth) RequireKind(kinds ...string) func(http.Handler) http.Handler {
+	return requireSession(func(sess *Session) error {
+		for _, kind := range kinds {
+			if sess.UserKind == kind {
+				return nil
+			}
+		}
+		return errors.Forbidden.Coded("kind_not_allowed").Hintf("requires one of %v", kinds)
+	})
+}
+
+func requireSession(check func(sess *Session) error) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return httpx.HandlerFuncE(func(w http.ResponseWriter, r *http.Request) error {
+			sess := CurSession(r.Context())
+			if sess == nil {
+				return errors.MissingAuth
+			} else if err := check(sess); err != nil {
+				return err
+			}
+
+			next.ServeHTTP(w, r)
+			return nil
+		})
+	}
+}
+
+// grantsQuery returns SQL expressions that resolve the roles and the
+// permissions of the user whose id is given by the userIDExpr.
+func grantsQuery(userIDExpr string) (roles, perms string) {
+	roles = `(SELECT coalesce(array_agg(ur.role ORDER BY ur.role), '{}') FROM user_roles AS ur
+		WHERE ur.user_id=` + userIDExpr + `)`
+	perms = `(SELECT coalesce(array_agg(DISTINCT p.perm), '{}') FROM user_roles AS ur
+		JOIN roles AS r ON r.name=ur.role, unnest(r.permissions) AS p(perm)
+		WHERE ur.user_id=` + userIDExpr + `)`
+	return roles, perms
+}
+
+func loadGrants(ctx context.Context, db querier, userID string) (*Grants, error) {
+	roles, perms := grantsQuery("$1")
+	version := "(SELECT grants_version FROM users WHERE id=$1)"
+
+	var g Grants
+	if err := db.QueryRow(ctx, "SELECT "+roles+", "+perms+", coalesce("+version+", 0)", userID).
+		Scan(&g.Roles, &g.Permissions, &g.version); err != nil {
+		return nil, translateErr(err)
+	}
+	return &g, nil
+}
+
+// bumpGrantsVersion marks the grants of the matching users as changed.
+// Access tokens carry the version they were issued with and are rejected
+// by RestoreSession once it is outdated.
+func bumpGrantsVersion(ctx context.Context, db querier, where sq.Sqlizer) error {
+	q, args, err := sq.Update("users").
+		Where(where).
+		Set("grants_version", sq.Expr("grants_version + 1")).
+		PlaceholderFormat(sq.Dollar).ToSql()
+	if err != nil {
+		return errors.InternalIssue.CausedBy(err)
+	}
+
+	_, err = db.Exec(ctx, q, args...)
+	return translateErr(err)
+}
+
+// roleHolders matches the users that have been granted the role.
+func roleHolders(role string) sq.Sqlizer {
+	return sq.Expr("id IN (SELECT user_id FROM user_roles WHERE role = ?)", role)
+}
+
+// matchPermission returns true if the granted permission (which may have
+// wildcards) covers the required permission.
+func matchPermission(granted, required string) bool {
+	if granted == permWildcard || granted == required {
+		return true
+	}
+
+	grantedParts := strings.Split(granted, ":")
+	requiredParts := strings.Split(required, ":")
+	if len(grantedParts) > len(requiredParts) {
+		return false
+	}
+
+	for i, part := range grantedParts {
+		if part == permWildcard && i == len(grantedParts)-1 {
+			return true
+		} else if part != requiredParts[i] {
+			return false
+		}
+	}
+	return len(grantedParts) == len(requiredParts)
+}
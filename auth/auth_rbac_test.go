@@ -0,0 +1,107 @@
+package auth
+
+import (
+	"context"
+	"testing"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMatchPermission(t *testing.T) {
+	t.Parallel()
+
+	table := []struct {
+		granted  string
+		required string
+		want     bool
+	}{
+		{granted: "*", required: "posts:write", want: true},
+		{granted: "posts:write", required: "posts:write", want: true},
+		{granted: "posts:*", required: "posts:write", want: true},
+		{granted: "posts:*", required: "posts:comments:write", want: true},
+		{granted: "posts:read", required: "posts:write", want: false},
+		{granted: "posts", required: "posts:write", want: false},
+		{granted: "posts:write:own", required: "posts:write", want: false},
+		{granted: "users:*", required: "posts:write", want: false},
+	}
+
+	for _, tt := range table {
+		t.Run(tt.granted+"/"+tt.required, func(t *testing.T) {
+			assert.Equal(t, tt.want, matchPermission(tt.granted, tt.required))
+		})
+	}
+}
+
+func TestSession_HasPermission(t *testing.T) {
+	t.Parallel()
+
+	sess := Session{Permissions: []string{"posts:*"}}
+	assert.True(t, sess.HasPermission("posts:write"))
+	assert.False(t, sess.HasPermission("users:write"))
+
+	// API key scopes further restrict the user's permissions.
+	sess.APIKeyID = "key1"
+	sess.Scopes = []string{"posts:read"}
+	assert.True(t, sess.HasPermission("posts:read"))
+	assert.False(t, sess.HasPermission("posts:write"))
+
+	// A key without scopes carries all the permissions of the user.
+	sess.Scopes = nil
+	assert.True(t, sess.HasPermission("posts:write"))
+}
+
+func TestBumpGrantsVersion(t *testing.T) {
+	t.Parallel()
+
+	table := []struct {
+		title    string
+		where    sq.Sqlizer
+		wantSQL  string
+		wantArgs []any
+	}{
+		{
+			title:    "User",
+			where:    sq.Eq{"id": "u1"},
+			wantSQL:  "UPDATE users SET grants_version = grants_version + 1 WHERE id = $1",
+			wantArgs: []any{"u1"},
+		},
+		{
+			title:    "RoleHolders",
+			where:    roleHolders("editor"),
+			wantSQL:  "UPDATE users SET grants_version = grants_version + 1 WHERE id IN (SELECT user_id FROM user_roles WHERE role = $1)",
+			wantArgs: []any{"editor"},
+		},
+	}
+
+	for _, tt := range table {
+		t.Run(tt.title, func(t *testing.T) {
+			db := &recordingDB{}
+			require.NoError(t, bumpGrantsVersion(context.Background(), db, tt.where))
+			require.Len(t, db.queries, 1)
+			assert.Equal(t, tt.wantSQL, db.queries[0])
+			assert.Equal(t, tt.wantArgs, db.args[0])
+		})
+	}
+}
+
+// recordingDB is a querier that records the statements executed on it.
+type recordingDB struct {
+	queries []string
+	args    [][]any
+}
+
+func (db *recordingDB) Exec(_ context.Context, sql string, args ...any) (pgconn.CommandTag, error) {
+	db.queries = append(db.queries, sql)
+	db.args = append(db.args, args)
+	return pgconn.CommandTag{}, nil
+}
+
+func (db *recordingDB) QueryRow(_ context.Context, sql string, args ...any) pgx.Row {
+	db.queries = append(db.queries, sql)
+	db.args = append(db.args, args)
+	return nil
+}
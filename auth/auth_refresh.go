@@ -0,0 +1,163 @@
+package auth
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/jackc/pgx/v5"
+
+	"github.com/spy16/pgbase/errors"
+	"github.com/spy16/pgbase/log"
+)
+
+// RefreshSession exchanges the given refresh token for a new access
+// token and a new refresh token. Every refresh token can be used only
+// once. If an already-used refresh token is presented, the session it
+// belongs to (and hence the whole token family) is revoked.
+func (auth *Auth) RefreshSession(ctx context.Context, refreshToken string) (*Session, error) {
+	var errToken = errors.MissingAuth.Coded("invalid_refresh_token")
+
+	refreshToken = strings.TrimSpace(refreshToken)
+	if refreshToken == "" {
+		return nil, errToken.Hintf("empty token")
+	}
+
+	tx, err := auth.conn.Begin(ctx)
+	if err != nil {
+		return nil, translateErr(err)
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	var sessionID, userID, orgID string
+	var expiresAt time.Time
+	var usedAt, revokedAt *time.Time
+
+	q, args, err := sq.Select("rt.session_id", "rt.expires_at", "rt.used_at", "s.user_id", "s.revoked_at", "coalesce(s.org_id, '')").
+		From("refresh_tokens AS rt").
+		InnerJoin("sessions AS s ON s.id=rt.session_id").
+		Where(sq.Eq{"rt.token_hash": hashToken(refreshToken)}).
+		Suffix("FOR UPDATE OF rt").
+		PlaceholderFormat(sq.Dollar).ToSql()
+	if err != nil {
+		return nil, errors.InternalIssue.CausedBy(err)
+	}
+
+	row := tx.QueryRow(ctx, q, args...)
+	if err := row.Scan(&sessionID, &expiresAt, &usedAt, &userID, &revokedAt, &orgID); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, errToken.Hintf("unknown token")
+		}
+		return nil, translateErr(err)
+	}
+
+	now := time.Now()
+	if revokedAt != nil {
+		return nil, errToken.Hintf("session revoked")
+	} else if usedAt != nil {
+		// Token reuse indicates that the token has leaked. Revoke the
+		// entire family so that neither party can continue using it.
+		log.Warn(ctx, "refresh token reuse detected", log.Fields{
+			"session_id": sessionID,
+			"user_id":    userID,
+		})
+		if err := revokeSessions(ctx, tx, sq.Eq{"id": sessionID}); err != nil {
+			return nil, err
+		} else if err := tx.Commit(ctx); err != nil {
+			return nil, translateErr(err)
+		}
+		return nil, errors.MissingAuth.Coded("refresh_token_reused")
+	} else if now.After(expiresAt) {
+		return nil, errToken.Hintf("token expired")
+	}
+
+	q, args, err = sq.Update("refresh_tokens").
+		Where(sq.Eq{"token_hash": hashToken(refreshToken)}).
+		Set("used_at", now).
+		PlaceholderFormat(sq.Dollar).ToSql()
+	if err != nil {
+		return nil, errors.InternalIssue.CausedBy(err)
+	}
+
+	if _, err := tx.Exec(ctx, q, args...); err != nil {
+		return nil, translateErr(err)
+	}
+
+	newRefreshToken := newSecretToken()
+	newExpiresAt := now.Add(auth.cfg.RefreshTTL)
+	if err := insertRefreshToken(ctx, tx, sessionID, newRefreshToken, now, newExpiresAt); err != nil {
+		return nil, err
+	}
+
+	q, args, err = sq.Update("sessions").
+		Where(sq.Eq{"id": sessionID}).
+		Set("last_seen_at", now).
+		Set("expires_at", newExpiresAt).
+		PlaceholderFormat(sq.Dollar).ToSql()
+	if err != nil {
+		return nil, errors.InternalIssue.CausedBy(err)
+	}
+
+	if _, err := tx.Exec(ctx, q, args...); err != nil {
+		return nil, translateErr(err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, translateErr(err)
+	}
+
+	u, err := auth.GetUser(ctx, NewAuthKey(KeyKindID, userID))
+	if err != nil {
+		if errors.Is(err, errors.NotFound) {
+			return nil, errToken.Hintf("user not found")
+		}
+		return nil, err
+	} else if u.DisabledAt != nil {
+		return nil, errDisabled
+	}
+
+	sess, err := auth.signSession(ctx, *u, sessionID, orgID, now)
+	if err != nil {
+		return nil, err
+	}
+	sess.RefreshToken = newRefreshToken
+	return sess, nil
+}
+
+// revokeRefreshSession revokes the active session the refresh token was
+// issued for and returns the IDs of the session and its user. Empty IDs
+// are returned if there is no such session.
+func (auth *Auth) revokeRefreshSession(ctx context.Context, refreshToken string) (string, string, error) {
+	q, args, err := sq.Update("sessions").
+		Where(sq.Eq{"revoked_at": nil}).
+		Where("id = (SELECT session_id FROM refresh_tokens WHERE token_hash = ?)", hashToken(strings.TrimSpace(refreshToken))).
+		Set("revoked_at", time.Now()).
+		Suffix("RETURNING id, user_id").
+		PlaceholderFormat(sq.Dollar).ToSql()
+	if err != nil {
+		return "", "", errors.InternalIssue.CausedBy(err)
+	}
+
+	var sessionID, userID string
+	if err := auth.conn.QueryRow(ctx, q, args...).Scan(&sessionID, &userID); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return "", "", nil
+		}
+		return "", "", translateErr(err)
+	}
+	return sessionID, userID, nil
+}
+
+func insertRefreshToken(ctx context.Context, tx pgx.Tx, sessionID, token string, now, expiresAt time.Time) error {
+	q, args, err := sq.Insert("refresh_tokens").
+		Columns("token_hash", "session_id", "created_at", "expires_at").
+		Values(hashToken(token), sessionID, now, expiresAt).
+		PlaceholderFormat(sq.Dollar).ToSql()
+	if err != nil {
+		return errors.InternalIssue.CausedBy(err)
+	}
+
+	_, err = tx.Exec(ctx, q, args...)
+	return translateErr(err)
+}
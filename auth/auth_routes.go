@@ -1,8 +1,10 @@
 package auth
 
 import (
+	"context"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 	"time"
 
@@ -11,6 +13,7 @@ import (
 
 	"github.com/spy16/pgbase/errors"
 	"github.com/spy16/pgbase/httpx"
+	"github.com/spy16/pgbase/log"
 	"github.com/spy16/pgbase/strutils"
 )
 
@@ -22,17 +25,100 @@ const (
 
 // Routes installs auth module routes onto the given router.
 func (auth *Auth) Routes(r chi.Router) {
-	r.Post("/register", auth.handleRegister)
-	r.Post("/login", auth.handleLogin)
-	r.Get("/logout", auth.handleLogout)
+	r.Group(func(r chi.Router) {
+		r.Use(clientMiddleware)
+
+		r.Post("/register", auth.handleRegister)
+		r.Post("/login", auth.handleLogin)
+		r.Post("/login/2fa", auth.handleLoginMFA)
+		r.Post("/login/magic", auth.handleMagicLinkRequest)
+		r.Get("/login/magic/verify", auth.handleMagicLinkPage)
+		r.Post("/login/magic/verify", auth.handleMagicLinkVerify)
+		r.Post("/login/otp", auth.handleOTPRequest)
+		r.Post("/login/otp/verify", auth.handleOTPVerify)
+		r.Post("/refresh", auth.handleRefresh)
+		r.Get("/logout", auth.handleLogout)
+
+		r.Get("/verify", auth.handleVerify)
+		r.Post("/verify/resend", auth.handleResendVerify)
+		r.Get("/email/confirm", auth.handleConfirmEmailChange)
+
+		r.Post("/password/forgot", auth.handleForgotPassword)
+		r.Post("/password/reset", auth.handleResetPassword)
+
+		r.Post("/webauthn/login/begin", httpx.HandlerFuncE(auth.handlePasskeyLoginBegin))
+		r.Post("/webauthn/login/finish", auth.handlePasskeyLoginFinish)
+
+		r.Get("/.well-known/jwks.json", auth.handleJWKS)
+		r.Get("/.well-known/openid-configuration", auth.handleDiscovery)
+
+		r.Get("/oauth/authorize", auth.handleAuthorize)
+		r.Post("/oauth/token", auth.handleToken)
+		r.Get("/oauth/userinfo", auth.handleUserInfo)
+		r.Post("/oauth/userinfo", auth.handleUserInfo)
+
+		r.Get("/oauth2", auth.handleOAuth2Redirect)
+		r.Get("/oauth2/cb", auth.handleOAuth2Callback)
+
+		r.Group(func(r chi.Router) {
+			r.Use(auth.Authenticate())
+
+			r.Get("/me", httpx.HandlerFuncE(auth.handleWhoAmI))
+
+			r.Post("/oauth/authorize/consent", auth.handleConsent)
+
+			r.Post("/email", httpx.HandlerFuncE(auth.handleRequestEmailChange))
+
+			r.Post("/phone", httpx.HandlerFuncE(auth.handleStartPhoneChange))
+			r.Post("/phone/confirm", httpx.HandlerFuncE(auth.handleConfirmPhone))
+			r.Delete("/phone", httpx.HandlerFuncE(auth.handleRemovePhone))
+
+			r.Get("/oauth2/link", auth.handleOAuth2Link)
+			r.Get("/identities", httpx.HandlerFuncE(auth.handleListIdentities))
+			r.Delete("/identities/{provider}/{id}", httpx.HandlerFuncE(auth.handleUnlinkIdentity))
+
+			r.Get("/api-keys", httpx.HandlerFuncE(auth.handleListAPIKeys))
+			r.Post("/api-keys", httpx.HandlerFuncE(auth.handleCreateAPIKey))
+			r.Delete("/api-keys/{id}", httpx.HandlerFuncE(auth.handleRevokeAPIKey))
+
+			r.Get("/orgs", httpx.HandlerFuncE(auth.handleListOrgs))
+			r.Post("/orgs", httpx.HandlerFuncE(auth.handleCreateOrg))
+			r.Post("/orgs/switch", httpx.HandlerFuncE(auth.handleSwitchOrg))
+			r.Post("/orgs/invites/accept", httpx.HandlerFuncE(auth.handleAcceptInvite))
+			r.Get("/orgs/{org_id}/members", httpx.HandlerFuncE(auth.handleListOrgMembers))
+			r.Post("/orgs/{org_id}/invites", httpx.HandlerFuncE(auth.handleInviteMember))
+			r.Delete("/orgs/{org_id}/members/{user_id}", httpx.HandlerFuncE(auth.handleRemoveMember))
 
-	r.Get("/oauth2", auth.handleOAuth2Redirect)
-	r.Get("/oauth2/cb", auth.handleOAuth2Callback)
+			r.Post("/2fa/totp/enroll", httpx.HandlerFuncE(auth.handleTOTPEnroll))
+			r.Post("/2fa/totp/confirm", httpx.HandlerFuncE(auth.handleTOTPConfirm))
+			r.Post("/2fa/totp/disable", httpx.HandlerFuncE(auth.handleTOTPDisable))
 
+			r.Post("/webauthn/register/begin", httpx.HandlerFuncE(auth.handlePasskeyRegisterBegin))
+			r.Post("/webauthn/register/finish", httpx.HandlerFuncE(auth.handlePasskeyRegisterFinish))
+		})
+	})
+}
+
+// AdminRoutes installs the user-management routes onto the given router.
+// All routes require a session with the PermManageUsers permission.
+func (auth *Auth) AdminRoutes(r chi.Router) {
 	r.Group(func(r chi.Router) {
-		r.Use(auth.Authenticate())
+		r.Use(clientMiddleware, auth.Authenticate(), auth.RequirePermission(PermManageUsers))
+
+		r.Get("/users", httpx.HandlerFuncE(auth.handleAdminListUsers))
+		r.Get("/users/{user_id}", httpx.HandlerFuncE(auth.handleAdminGetUser))
+		r.Delete("/users/{user_id}", httpx.HandlerFuncE(auth.handleAdminDeleteUser))
+		r.Post("/users/{user_id}/disable", httpx.HandlerFuncE(auth.handleAdminDisableUser))
+		r.Post("/users/{user_id}/enable", httpx.HandlerFuncE(auth.handleAdminEnableUser))
+		r.Post("/users/{user_id}/logout", httpx.HandlerFuncE(auth.handleAdminLogoutUser))
 
-		r.Get("/me", httpx.HandlerFuncE(auth.handleWhoAmI))
+		r.Get("/events", httpx.HandlerFuncE(auth.handleAdminListEvents))
+		r.Get("/lockouts", httpx.HandlerFuncE(auth.handleAdminListLockouts))
+		r.Delete("/lockouts", httpx.HandlerFuncE(auth.handleAdminClearLockout))
+
+		r.Get("/oauth-clients", httpx.HandlerFuncE(auth.handleAdminListClients))
+		r.Post("/oauth-clients", httpx.HandlerFuncE(auth.handleAdminRegisterClient))
+		r.Delete("/oauth-clients/{client_id}", httpx.HandlerFuncE(auth.handleAdminDeleteClient))
 	})
 }
 
@@ -45,12 +131,12 @@ func (auth *Auth) handleRegister(w http.ResponseWriter, r *http.Request) {
 			return nil, errors.MissingAuth.Hintf("invalid email")
 		}
 
-		pwdHash, err := HashPassword(creds.Password)
+		u := NewUser(creds.Kind, creds.Username, creds.Email)
+
+		pwdHash, err := auth.HashPassword(creds.Password, u)
 		if err != nil {
 			return nil, err
 		}
-
-		u := NewUser(creds.Kind, creds.Username, creds.Email)
 		u.PwdHash = &pwdHash
 
 		registeredU, err := auth.RegisterUser(r.Context(), u, nil)
@@ -72,6 +158,19 @@ func (auth *Auth) handleRegister(w http.ResponseWriter, r *http.Request) {
 }
 
 func (auth *Auth) handleOAuth2Redirect(w http.ResponseWriter, r *http.Request) {
+	auth.startOAuth2(w, r, "")
+}
+
+func (auth *Auth) handleOAuth2Link(w http.ResponseWriter, r *http.Request) {
+	session := CurSession(r.Context())
+	if session == nil {
+		writeErr(w, r, auth.cfg.LoginPageRoute, errors.MissingAuth)
+		return
+	}
+	auth.startOAuth2(w, r, session.UserID)
+}
+
+func (auth *Auth) startOAuth2(w http.ResponseWriter, r *http.Request, linkUserID string) {
 	prepareRedirection := func() (string, *oauth2FlowState, error) {
 		q := r.URL.Query()
 		userKind := q.Get("kind")
@@ -104,6 +203,7 @@ func (auth *Auth) handleOAuth2Redirect(w http.ResponseWriter, r *http.Request) {
 			Provider:   p.Name(),
 			Session:    sess.Marshal(),
 			RedirectTo: r.FormValue(redirectToParam),
+			LinkUserID: linkUserID,
 		}, nil
 	}
 
@@ -120,216 +220,1477 @@ func (auth *Auth) handleOAuth2Redirect(w http.ResponseWriter, r *http.Request) {
 func (auth *Auth) handleOAuth2Callback(w http.ResponseWriter, r *http.Request) {
 	var errInvalidCB = errors.InvalidInput.Coded("invalid_callback")
 
-	processCallback := func() (*User, error) {
+	authorize := func() (*oauth2FlowState, *goth.User, error) {
 		flowState := popOAuthState(w, r)
 		if flowState == nil {
-			return nil, errInvalidCB.Hintf("oauth2 flow state is nil")
+			return nil, nil, errInvalidCB.Hintf("oauth2 flow state is nil")
 		}
 
 		p, err := goth.GetProvider(flowState.Provider)
 		if err != nil {
-			return nil, errInvalidCB.CausedBy(err)
+			return nil, nil, errInvalidCB.CausedBy(err)
 		}
 
 		sess, err := p.UnmarshalSession(flowState.Session)
 		if err != nil {
-			return nil, errInvalidCB.CausedBy(err)
+			return nil, nil, errInvalidCB.CausedBy(err)
 		}
 
 		q := r.URL.Query()
 		if !checkCallbackState(sess, q.Get("state")) {
-			return nil, errInvalidCB.Hintf("state value mismatch")
+			return nil, nil, errInvalidCB.Hintf("state value mismatch")
 		}
 
 		if _, err := sess.Authorize(p, q); err != nil {
-			return nil, errors.InternalIssue.CausedBy(err)
+			return nil, nil, errors.InternalIssue.CausedBy(err)
 		}
 
 		gothUser, err := p.FetchUser(sess)
 		if err != nil {
-			return nil, errors.InternalIssue.CausedBy(err)
+			return nil, nil, errors.InternalIssue.CausedBy(err)
 		}
+		return flowState, &gothUser, nil
+	}
 
-		loginKeyID := NewAuthKey(gothUser.Provider, gothUser.UserID)
-		exU, err := auth.GetUser(r.Context(), loginKeyID)
+	processLogin := func(flowState *oauth2FlowState, gothUser goth.User) (*User, error) {
+		loginKey := identityKey(gothUser)
+		exU, err := auth.GetUser(r.Context(), loginKey.Key)
 		if err != nil && !errors.Is(err, errors.NotFound) {
 			return nil, errors.InternalIssue.CausedBy(err)
 		}
 
 		if exU == nil {
-			// new user registration
-			newU := NewUser(flowState.UserKind, "", gothUser.Email)
-			newU.Data = userDataFromGothUser(gothUser)
-
-			loginKey := Key{
-				Key: loginKeyID,
-				Attribs: map[string]any{
-					"user_id":       gothUser.UserID,
-					"expires_at":    gothUser.ExpiresAt.Unix(),
-					"access_token":  gothUser.AccessToken,
-					"refresh_token": gothUser.RefreshToken,
-					"raw_data":      gothUser.RawData,
-				},
+			exU, err = auth.GetUser(r.Context(), NewAuthKey(KeyKindEmail, gothUser.Email))
+			if err != nil && !errors.Is(err, errors.NotFound) {
+				return nil, errors.InternalIssue.CausedBy(err)
 			}
 
-			exU, err = auth.RegisterUser(r.Context(), newU, []Key{loginKey})
-			if err != nil {
-				if !errors.OneOf(err, []error{errors.Conflict}) {
-					err = errors.InternalIssue.CausedBy(err)
+			if exU != nil {
+				// An account with the same email exists. Identities are linked
+				// automatically only if the provider is trusted for it and asserts
+				// that it verified the email. Otherwise, user must login and link
+				// explicitly.
+				if !auth.cfg.autoLinkEnabled(flowState.Provider) || !gothEmailVerified(gothUser) {
+					return nil, errors.Conflict.Coded("account_exists").
+						Hintf("login to the existing account and link the identity")
+				}
+
+				if err := auth.LinkIdentity(r.Context(), exU.ID, loginKey); err != nil {
+					return nil, err
+				}
+			} else {
+				// new user registration. No verification mail is sent if the
+				// provider has verified the email already.
+				emailVerified := gothEmailVerified(gothUser)
+				newU := NewUser(flowState.UserKind, "", gothUser.Email)
+				newU.Data = userDataFromGothUser(gothUser)
+				if emailVerified {
+					newU.VerifyToken = nil
+				}
+
+				exU, err = auth.RegisterUser(r.Context(), newU, []Key{loginKey})
+				if err != nil {
+					if !errors.OneOf(err, []error{errors.Conflict}) {
+						err = errors.InternalIssue.CausedBy(err)
+					}
+					return nil, err
+				}
+
+				if emailVerified {
+					if exU, err = auth.markVerified(r.Context(), exU.ID, loginMethodOAuth); err != nil {
+						return nil, err
+					}
 				}
-				return nil, err
 			}
-		} else {
-			// TODO: update existing user
+		} else if err := auth.syncIdentity(r.Context(), exU, gothUser); err != nil {
+			return nil, err
+		}
+
+		if err := auth.checkLoginAllowed(exU); err != nil {
+			return nil, err
 		}
 		return exU, nil
 	}
 
-	u, err := processCallback()
+	processLink := func(flowState *oauth2FlowState, gothUser goth.User) error {
+		// The flow state cookie is not tamper-proof. So the user linking
+		// the identity must be the one currently logged in.
+		token := extractToken(r, auth.cfg.SessionCookie)
+		session, err := auth.RestoreSession(r.Context(), token)
+		if err != nil {
+			return err
+		} else if session.UserID != flowState.LinkUserID {
+			return errors.Forbidden.Hintf("session user does not match link flow")
+		}
+
+		return auth.LinkIdentity(r.Context(), session.UserID, identityKey(gothUser))
+	}
+
+	flowState, gothUser, err := authorize()
 	if err != nil {
 		writeErr(w, r, auth.cfg.LoginPageRoute, err)
 		return
 	}
-	auth.finishLogin(w, r, *u)
-}
 
-func (auth *Auth) handleVerify(w http.ResponseWriter, r *http.Request) {
-	q := r.URL.Query()
+	if flowState.LinkUserID != "" {
+		if err := processLink(flowState, *gothUser); err != nil {
+			writeErr(w, r, auth.cfg.LoginPageRoute, err)
+			return
+		}
 
-	id := q.Get("id")
-	verifyToken := q.Get("token")
+		writeSuccess(w, r, flowState.RedirectTo, http.StatusOK, map[string]any{
+			"identity": newIdentity(identityKey(*gothUser)),
+		})
+		return
+	}
 
-	u, err := auth.VerifyUser(r.Context(), id, verifyToken)
+	u, err := processLogin(flowState, *gothUser)
 	if err != nil {
-		if errors.Is(err, errors.NotFound) {
-			err = errors.MissingAuth
-		}
 		writeErr(w, r, auth.cfg.LoginPageRoute, err)
 		return
 	}
+	auth.beginLogin(w, r, *u, "")
+}
+
+func (auth *Auth) handleListIdentities(w http.ResponseWriter, r *http.Request) error {
+	session := CurSession(r.Context())
+	if session == nil {
+		return errors.MissingAuth
+	}
 
-	auth.finishLogin(w, r, *u)
+	identities, err := auth.ListIdentities(r.Context(), session.UserID)
+	if err != nil {
+		return err
+	}
+
+	httpx.WriteJSON(w, r, http.StatusOK, identities)
+	return nil
 }
 
-func (auth *Auth) handleLogin(w http.ResponseWriter, r *http.Request) {
-	doLogin := func() (*User, error) {
-		var creds userCreds
-		if err := creds.readFrom(r); err != nil {
-			return nil, err
-		}
+func (auth *Auth) handleUnlinkIdentity(w http.ResponseWriter, r *http.Request) error {
+	session := CurSession(r.Context())
+	if session == nil {
+		return errors.MissingAuth
+	}
 
-		keyKind := KeyKindUsername
-		keyValue := creds.Username
-		if creds.Email != "" {
-			keyKind = KeyKindEmail
-			keyValue = creds.Email
-		}
+	key := NewAuthKey(chi.URLParam(r, "provider"), chi.URLParam(r, "id"))
+	if err := auth.UnlinkIdentity(r.Context(), session.UserID, key); err != nil {
+		return err
+	}
 
-		u, err := auth.GetUser(r.Context(), NewAuthKey(keyKind, keyValue))
-		if err != nil {
-			if errors.Is(err, errors.NotFound) {
-				err = errors.MissingAuth.Hintf("user not found")
-			}
-			return nil, err
-		} else if !u.CheckPassword(creds.Password) {
-			return nil, errors.MissingAuth.Hintf("password mismatch")
-		} else if creds.Email != "" && creds.Email != u.Email {
-			return nil, errors.MissingAuth.Hintf("email mismatch")
-		} else if u.Kind != creds.Kind {
-			return nil, errors.MissingAuth.Hintf("user kind mismatch")
-		}
+	httpx.WriteJSON(w, r, http.StatusNoContent, nil)
+	return nil
+}
 
-		return u, nil
+func (auth *Auth) handleListAPIKeys(w http.ResponseWriter, r *http.Request) error {
+	session := CurSession(r.Context())
+	if session == nil {
+		return errors.MissingAuth
 	}
 
-	u, err := doLogin()
+	keys, err := auth.ListAPIKeys(r.Context(), session.UserID)
 	if err != nil {
-		writeErr(w, r, auth.cfg.LoginPageRoute, err)
-		return
+		return err
 	}
 
-	auth.finishLogin(w, r, *u)
+	httpx.WriteJSON(w, r, http.StatusOK, keys)
+	return nil
 }
 
-func (auth *Auth) handleWhoAmI(w http.ResponseWriter, r *http.Request) error {
+func (auth *Auth) handleCreateAPIKey(w http.ResponseWriter, r *http.Request) error {
 	session := CurSession(r.Context())
 	if session == nil {
 		return errors.MissingAuth
+	} else if session.APIKeyID != "" {
+		// API keys must not be able to mint new (possibly broader) keys.
+		return errors.Forbidden.Coded("login_required").Hintf("api keys cannot create api keys")
 	}
 
-	u, err := auth.GetUser(r.Context(), NewAuthKey(KeyKindID, session.UserID))
+	var req struct {
+		Name      string     `json:"name"`
+		Scopes    []string   `json:"scopes"`
+		ExpiresAt *time.Time `json:"expires_at"`
+	}
+	if err := httpx.ReadJSON(r, &req); err != nil {
+		return err
+	}
+
+	key, err := auth.CreateAPIKey(r.Context(), session.UserID, req.Name, req.Scopes, req.ExpiresAt)
 	if err != nil {
-		if errors.Is(err, errors.NotFound) {
-			return errors.MissingAuth
-		}
-		return errors.InternalIssue.CausedBy(err)
+		return err
 	}
 
-	httpx.WriteJSON(w, r, http.StatusOK, u.Clone(true))
+	httpx.WriteJSON(w, r, http.StatusCreated, key)
 	return nil
 }
 
-func (auth *Auth) handleLogout(w http.ResponseWriter, r *http.Request) {
-	http.SetCookie(w, &http.Cookie{
-		Name:     auth.cfg.SessionCookie,
-		Value:    "",
-		Path:     "/",
-		Expires:  time.Now(),
-		Secure:   false,
-		HttpOnly: true,
-		SameSite: http.SameSiteLaxMode,
-	})
-	http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
+func (auth *Auth) handleRevokeAPIKey(w http.ResponseWriter, r *http.Request) error {
+	session := CurSession(r.Context())
+	if session == nil {
+		return errors.MissingAuth
+	}
+
+	if err := auth.RevokeAPIKey(r.Context(), session.UserID, chi.URLParam(r, "id")); err != nil {
+		return err
+	}
+
+	httpx.WriteJSON(w, r, http.StatusNoContent, nil)
+	return nil
+}
+
+func (auth *Auth) handleRequestEmailChange(w http.ResponseWriter, r *http.Request) error {
+	session := CurSession(r.Context())
+	if session == nil {
+		return errors.MissingAuth
+	} else if session.APIKeyID != "" {
+		return errors.Forbidden.Hintf("email cannot be changed using an API key")
+	}
+
+	var req struct {
+		Email    string `json:"email"`
+		Password string `json:"password"`
+	}
+	if err := readRequest(r, &req); err != nil {
+		return err
+	} else if err := auth.checkReauth(r.Context(), *session, req.Password); err != nil {
+		return err
+	}
+
+	if err := auth.RequestEmailChange(r.Context(), session.UserID, req.Email); err != nil {
+		return err
+	}
+
+	httpx.WriteJSON(w, r, http.StatusAccepted, map[string]any{})
+	return nil
 }
 
-func (auth *Auth) finishLogin(w http.ResponseWriter, r *http.Request, user User) {
-	session, err := auth.CreateSession(r.Context(), user)
+func (auth *Auth) handleStartPhoneChange(w http.ResponseWriter, r *http.Request) error {
+	session := CurSession(r.Context())
+	if session == nil {
+		return errors.MissingAuth
+	}
+
+	var req struct {
+		Phone string `json:"phone"`
+	}
+	if err := readRequest(r, &req); err != nil {
+		return err
+	}
+
+	challenge, err := auth.StartPhoneChange(r.Context(), session.UserID, req.Phone)
 	if err != nil {
-		writeErr(w, r, auth.cfg.LoginPageRoute, err)
-		return
+		return err
 	}
 
-	http.SetCookie(w, &http.Cookie{
-		Name:     auth.cfg.SessionCookie,
-		Value:    session.Token,
-		Path:     "/",
-		Expires:  session.ExpiresAt,
-		Secure:   false,
-		HttpOnly: true,
-		SameSite: http.SameSiteLaxMode,
-	})
+	httpx.WriteJSON(w, r, http.StatusAccepted, challenge)
+	return nil
+}
 
-	writeSuccess(w, r, auth.cfg.LoginPageRoute, http.StatusOK, map[string]any{
-		"user":   user.Clone(true),
-		"token":  session.Token,
-		"expiry": session.ExpiresAt,
-	})
+func (auth *Auth) handleConfirmPhone(w http.ResponseWriter, r *http.Request) error {
+	session := CurSession(r.Context())
+	if session == nil {
+		return errors.MissingAuth
+	}
+
+	var req struct {
+		OTPID string `json:"otp_id"`
+		Code  string `json:"code"`
+	}
+	if err := readRequest(r, &req); err != nil {
+		return err
+	}
+
+	if err := auth.ConfirmPhone(r.Context(), session.UserID, req.OTPID, req.Code); err != nil {
+		return err
+	}
+
+	httpx.WriteJSON(w, r, http.StatusNoContent, nil)
+	return nil
 }
 
-func userDataFromGothUser(gu goth.User) UserData {
-	// TODO: extract more from raw data?
-	return map[string]any{
-		"name":      gu.Name,
-		"picture":   gu.AvatarURL,
-		"location":  gu.Location,
-		"nick_name": gu.NickName,
+func (auth *Auth) handleRemovePhone(w http.ResponseWriter, r *http.Request) error {
+	session := CurSession(r.Context())
+	if session == nil {
+		return errors.MissingAuth
+	}
+
+	if err := auth.RemovePhone(r.Context(), session.UserID); err != nil {
+		return err
 	}
+
+	httpx.WriteJSON(w, r, http.StatusNoContent, nil)
+	return nil
 }
 
-func writeErr(w http.ResponseWriter, r *http.Request, redirectTo string, err error) {
-	isFormSubmit := strings.Contains(r.Header.Get("Content-Type"), contentTypeForm)
-	if isFormSubmit {
-		u, parseErr := url.Parse(redirectTo)
-		if parseErr == nil {
-			q := u.Query()
-			q.Set("err_code", errors.E(err).Code)
-			u.RawQuery = q.Encode()
-			u.JoinPath()
-			http.Redirect(w, r, u.String(), http.StatusSeeOther)
-			return
-		}
+func (auth *Auth) handleListOrgs(w http.ResponseWriter, r *http.Request) error {
+	session := CurSession(r.Context())
+	if session == nil {
+		return errors.MissingAuth
 	}
-	httpx.WriteErr(w, r, err)
+
+	orgs, err := auth.ListUserOrgs(r.Context(), session.UserID)
+	if err != nil {
+		return err
+	}
+
+	httpx.WriteJSON(w, r, http.StatusOK, orgs)
+	return nil
+}
+
+func (auth *Auth) handleCreateOrg(w http.ResponseWriter, r *http.Request) error {
+	session := CurSession(r.Context())
+	if session == nil {
+		return errors.MissingAuth
+	}
+
+	var req struct {
+		Name string `json:"name"`
+		Slug string `json:"slug"`
+	}
+	if err := readRequest(r, &req); err != nil {
+		return err
+	}
+
+	org, err := auth.CreateOrg(r.Context(), session.UserID, req.Name, req.Slug)
+	if err != nil {
+		return err
+	}
+
+	httpx.WriteJSON(w, r, http.StatusCreated, org)
+	return nil
+}
+
+func (auth *Auth) handleSwitchOrg(w http.ResponseWriter, r *http.Request) error {
+	session := CurSession(r.Context())
+	if session == nil {
+		return errors.MissingAuth
+	}
+
+	var req struct {
+		OrgID string `json:"org_id"`
+	}
+	if err := readRequest(r, &req); err != nil {
+		return err
+	}
+
+	newSession, err := auth.SwitchOrg(r.Context(), *session, req.OrgID)
+	if err != nil {
+		return err
+	}
+
+	auth.setSessionCookie(w, newSession)
+	httpx.WriteJSON(w, r, http.StatusOK, map[string]any{
+		"token":    newSession.Token,
+		"expiry":   newSession.ExpiresAt,
+		"org_id":   newSession.OrgID,
+		"org_role": newSession.OrgRole,
+	})
+	return nil
+}
+
+func (auth *Auth) handleAcceptInvite(w http.ResponseWriter, r *http.Request) error {
+	session := CurSession(r.Context())
+	if session == nil {
+		return errors.MissingAuth
+	}
+
+	var req struct {
+		Token string `json:"token"`
+	}
+	if err := readRequest(r, &req); err != nil {
+		return err
+	}
+
+	membership, err := auth.AcceptInvite(r.Context(), session.UserID, req.Token)
+	if err != nil {
+		return err
+	}
+
+	httpx.WriteJSON(w, r, http.StatusOK, membership)
+	return nil
+}
+
+func (auth *Auth) handleListOrgMembers(w http.ResponseWriter, r *http.Request) error {
+	session := CurSession(r.Context())
+	if session == nil {
+		return errors.MissingAuth
+	}
+
+	members, err := auth.ListOrgMembers(r.Context(), chi.URLParam(r, "org_id"), session.UserID)
+	if err != nil {
+		return err
+	}
+
+	httpx.WriteJSON(w, r, http.StatusOK, members)
+	return nil
+}
+
+func (auth *Auth) handleInviteMember(w http.ResponseWriter, r *http.Request) error {
+	session := CurSession(r.Context())
+	if session == nil {
+		return errors.MissingAuth
+	}
+
+	var req struct {
+		Email string `json:"email"`
+		Role  string `json:"role"`
+	}
+	if err := readRequest(r, &req); err != nil {
+		return err
+	}
+
+	if req.Role == "" {
+		req.Role = OrgRoleMember
+	}
+
+	orgID := chi.URLParam(r, "org_id")
+	if err := auth.InviteMember(r.Context(), orgID, session.UserID, req.Email, req.Role); err != nil {
+		return err
+	}
+
+	httpx.WriteJSON(w, r, http.StatusAccepted, nil)
+	return nil
+}
+
+func (auth *Auth) handleRemoveMember(w http.ResponseWriter, r *http.Request) error {
+	session := CurSession(r.Context())
+	if session == nil {
+		return errors.MissingAuth
+	}
+
+	orgID, userID := chi.URLParam(r, "org_id"), chi.URLParam(r, "user_id")
+	if err := auth.RemoveMember(r.Context(), orgID, session.UserID, userID); err != nil {
+		return err
+	}
+
+	httpx.WriteJSON(w, r, http.StatusNoContent, nil)
+	return nil
+}
+
+func (auth *Auth) handleAdminListUsers(w http.ResponseWriter, r *http.Request) error {
+	q := r.URL.Query()
+
+	filter := UserFilter{
+		Kind:        q.Get("kind"),
+		EmailPrefix: q.Get("email_prefix"),
+		Cursor:      q.Get("cursor"),
+	}
+
+	var err error
+	if filter.Verified, err = parseBoolParam(q, "verified"); err != nil {
+		return err
+	}
+	if filter.Disabled, err = parseBoolParam(q, "disabled"); err != nil {
+		return err
+	}
+	if filter.CreatedAfter, err = parseTimeParam(q, "created_after"); err != nil {
+		return err
+	}
+	if filter.CreatedBefore, err = parseTimeParam(q, "created_before"); err != nil {
+		return err
+	}
+	if v := q.Get("limit"); v != "" {
+		if filter.Limit, err = strconv.Atoi(v); err != nil {
+			return errors.InvalidInput.Coded("invalid_limit").CausedBy(err)
+		}
+	}
+
+	page, err := auth.ListUsers(r.Context(), filter)
+	if err != nil {
+		return err
+	}
+
+	for i, u := range page.Users {
+		page.Users[i] = u.Clone(true)
+	}
+
+	httpx.WriteJSON(w, r, http.StatusOK, page)
+	return nil
+}
+
+func (auth *Auth) handleAdminGetUser(w http.ResponseWriter, r *http.Request) error {
+	u, err := auth.GetUser(r.Context(), NewAuthKey(KeyKindID, chi.URLParam(r, "user_id")))
+	if err != nil {
+		return err
+	}
+
+	httpx.WriteJSON(w, r, http.StatusOK, u.Clone(true))
+	return nil
+}
+
+func (auth *Auth) handleAdminDeleteUser(w http.ResponseWriter, r *http.Request) error {
+	if err := auth.DeleteUser(r.Context(), chi.URLParam(r, "user_id")); err != nil {
+		return err
+	}
+
+	httpx.WriteJSON(w, r, http.StatusNoContent, nil)
+	return nil
+}
+
+func (auth *Auth) handleAdminDisableUser(w http.ResponseWriter, r *http.Request) error {
+	if err := auth.DisableUser(r.Context(), chi.URLParam(r, "user_id")); err != nil {
+		return err
+	}
+
+	httpx.WriteJSON(w, r, http.StatusNoContent, nil)
+	return nil
+}
+
+func (auth *Auth) handleAdminEnableUser(w http.ResponseWriter, r *http.Request) error {
+	if err := auth.EnableUser(r.Context(), chi.URLParam(r, "user_id")); err != nil {
+		return err
+	}
+
+	httpx.WriteJSON(w, r, http.StatusNoContent, nil)
+	return nil
+}
+
+func (auth *Auth) handleAdminLogoutUser(w http.ResponseWriter, r *http.Request) error {
+	if err := auth.RevokeAllSessions(r.Context(), chi.URLParam(r, "user_id")); err != nil {
+		return err
+	}
+
+	httpx.WriteJSON(w, r, http.StatusNoContent, nil)
+	return nil
+}
+
+func (auth *Auth) handleAdminListEvents(w http.ResponseWriter, r *http.Request) error {
+	q := r.URL.Query()
+
+	filter := EventFilter{
+		UserID: q.Get("user_id"),
+		Kind:   q.Get("kind"),
+		Cursor: q.Get("cursor"),
+	}
+
+	var err error
+	if filter.Since, err = parseTimeParam(q, "since"); err != nil {
+		return err
+	}
+	if filter.Until, err = parseTimeParam(q, "until"); err != nil {
+		return err
+	}
+	if v := q.Get("limit"); v != "" {
+		if filter.Limit, err = strconv.Atoi(v); err != nil {
+			return errors.InvalidInput.Coded("invalid_limit").CausedBy(err)
+		}
+	}
+
+	page, err := auth.ListEvents(r.Context(), filter)
+	if err != nil {
+		return err
+	}
+
+	httpx.WriteJSON(w, r, http.StatusOK, page)
+	return nil
+}
+
+func (auth *Auth) handleAdminListLockouts(w http.ResponseWriter, r *http.Request) error {
+	lockouts, err := auth.ListLockouts(r.Context())
+	if err != nil {
+		return err
+	}
+
+	httpx.WriteJSON(w, r, http.StatusOK, lockouts)
+	return nil
+}
+
+func (auth *Auth) handleAdminClearLockout(w http.ResponseWriter, r *http.Request) error {
+	q := r.URL.Query()
+	if err := auth.ClearLockout(r.Context(), q.Get("scope"), q.Get("subject")); err != nil {
+		return err
+	}
+
+	httpx.WriteJSON(w, r, http.StatusNoContent, nil)
+	return nil
+}
+
+func (auth *Auth) handleAdminListClients(w http.ResponseWriter, r *http.Request) error {
+	clients, err := auth.ListClients(r.Context())
+	if err != nil {
+		return err
+	}
+
+	httpx.WriteJSON(w, r, http.StatusOK, clients)
+	return nil
+}
+
+func (auth *Auth) handleAdminRegisterClient(w http.ResponseWriter, r *http.Request) error {
+	var req OAuthClient
+	if err := httpx.ReadJSON(r, &req); err != nil {
+		return err
+	}
+
+	client, err := auth.RegisterClient(r.Context(), req)
+	if err != nil {
+		return err
+	}
+
+	httpx.WriteJSON(w, r, http.StatusCreated, client)
+	return nil
+}
+
+func (auth *Auth) handleAdminDeleteClient(w http.ResponseWriter, r *http.Request) error {
+	if err := auth.DeleteClient(r.Context(), chi.URLParam(r, "client_id")); err != nil {
+		return err
+	}
+
+	httpx.WriteJSON(w, r, http.StatusNoContent, nil)
+	return nil
+}
+
+func (auth *Auth) handleAuthorize(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	req := authorizeRequestFrom(r.URL.Query())
+
+	client, err := auth.authorizeClient(ctx, req)
+	if err != nil {
+		httpx.WriteErr(w, r, err)
+		return
+	}
+
+	scopes, err := req.validate(*client)
+	if err != nil {
+		http.Redirect(w, r, req.errorRedirect(err), http.StatusFound)
+		return
+	}
+
+	// The user must login first if there is no valid session cookie. The
+	// login page is expected to send the user back to redirect_to.
+	session, err := auth.RestoreSession(ctx, extractToken(r, auth.cfg.SessionCookie))
+	if err != nil {
+		if auth.cfg.LoginPageRoute == "" {
+			http.Redirect(w, r, req.errorRedirect(errors.MissingAuth.Coded("login_required")), http.StatusFound)
+			return
+		}
+
+		authorizeURL := auth.baseURL.JoinPath("/oauth/authorize")
+		authorizeURL.RawQuery = r.URL.RawQuery
+		loginURL := withQuery(auth.cfg.LoginPageRoute, map[string]string{
+			redirectToParam: authorizeURL.String(),
+		})
+		http.Redirect(w, r, loginURL, http.StatusFound)
+		return
+	}
+
+	needsConsent, err := auth.needsConsent(ctx, *client, session.UserID, scopes)
+	if err != nil {
+		http.Redirect(w, r, req.errorRedirect(err), http.StatusFound)
+		return
+	} else if needsConsent {
+		if auth.cfg.ConsentPageRoute == "" {
+			http.Redirect(w, r, req.errorRedirect(errOAuthNeedsConsent), http.StatusFound)
+			return
+		}
+
+		params := req.params()
+		params["client_name"] = client.Name
+		http.Redirect(w, r, withQuery(auth.cfg.ConsentPageRoute, params), http.StatusFound)
+		return
+	}
+
+	redirectTo, err := auth.issueAuthCode(ctx, session.UserID, req, scopes)
+	if err != nil {
+		http.Redirect(w, r, req.errorRedirect(err), http.StatusFound)
+		return
+	}
+	http.Redirect(w, r, redirectTo, http.StatusFound)
+}
+
+func (auth *Auth) handleConsent(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	session := CurSession(ctx)
+	if session == nil || session.APIKeyID != "" {
+		writeErr(w, r, auth.cfg.ConsentPageRoute, errors.MissingAuth)
+		return
+	}
+
+	var req struct {
+		AuthorizeRequest
+		Approve string `json:"approve"`
+	}
+	if err := readRequest(r, &req); err != nil {
+		writeErr(w, r, auth.cfg.ConsentPageRoute, err)
+		return
+	}
+
+	client, err := auth.authorizeClient(ctx, req.AuthorizeRequest)
+	if err != nil {
+		writeErr(w, r, auth.cfg.ConsentPageRoute, err)
+		return
+	}
+
+	redirectTo, err := func() (string, error) {
+		scopes, err := req.validate(*client)
+		if err != nil {
+			return "", err
+		} else if req.Approve != "true" {
+			return "", errOAuthAccessDenied.Hintf("user denied the request")
+		}
+
+		if err := auth.GrantConsent(ctx, session.UserID, client.ID, scopes); err != nil {
+			return "", err
+		}
+		return auth.issueAuthCode(ctx, session.UserID, req.AuthorizeRequest, scopes)
+	}()
+	if err != nil {
+		redirectTo = req.errorRedirect(err)
+	}
+
+	writeSuccess(w, r, redirectTo, http.StatusOK, map[string]any{
+		redirectToParam: redirectTo,
+	})
+}
+
+func (auth *Auth) handleToken(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	// Token responses must never be cached (RFC 6749, Section 5.1).
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
+
+	if err := r.ParseForm(); err != nil {
+		writeOAuthErr(w, r, errOAuthInvalidRequest.CausedBy(err))
+		return
+	}
+
+	clientID, secret, hasBasic := r.BasicAuth()
+	if hasBasic {
+		// Credentials in the basic auth header are form-urlencoded.
+		clientID, _ = url.QueryUnescape(clientID)
+		secret, _ = url.QueryUnescape(secret)
+	} else {
+		clientID = r.PostForm.Get("client_id")
+		secret = r.PostForm.Get("client_secret")
+	}
+
+	client, err := auth.authenticateClient(ctx, clientID, secret)
+	if err != nil {
+		if hasBasic {
+			w.Header().Set("WWW-Authenticate", `Basic realm="oauth"`)
+		}
+		writeOAuthErr(w, r, err)
+		return
+	}
+
+	var res *TokenResponse
+	switch grantType := r.PostForm.Get("grant_type"); grantType {
+	case grantTypeAuthCode:
+		res, err = auth.ExchangeCode(ctx, *client, r.PostForm.Get("code"),
+			r.PostForm.Get("redirect_uri"), r.PostForm.Get("code_verifier"))
+
+	case grantTypeRefreshToken:
+		res, err = auth.RefreshClientToken(ctx, *client, r.PostForm.Get("refresh_token"), r.PostForm.Get("scope"))
+
+	default:
+		err = errors.InvalidInput.Coded("unsupported_grant_type").Hintf("grant_type '%s' is not supported", grantType)
+	}
+	if err != nil {
+		writeOAuthErr(w, r, err)
+		return
+	}
+
+	httpx.WriteJSON(w, r, http.StatusOK, res)
+}
+
+func (auth *Auth) handleUserInfo(w http.ResponseWriter, r *http.Request) {
+	authH := r.Header.Get(headerAuthz)
+	if !strings.HasPrefix(authH, bearerPrefix) {
+		w.Header().Set("WWW-Authenticate", `Bearer`)
+		httpx.WriteErr(w, r, errOAuthInvalidToken.Hintf("bearer token is required"))
+		return
+	}
+
+	claims, err := auth.UserInfo(r.Context(), strings.TrimSpace(strings.TrimPrefix(authH, bearerPrefix)))
+	if err != nil {
+		if errors.Is(err, errOAuthInvalidToken) {
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		}
+		httpx.WriteErr(w, r, err)
+		return
+	}
+
+	httpx.WriteJSON(w, r, http.StatusOK, claims)
+}
+
+func (auth *Auth) handleJWKS(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	httpx.WriteJSON(w, r, http.StatusOK, auth.keys.jwks())
+}
+
+func (auth *Auth) handleDiscovery(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	httpx.WriteJSON(w, r, http.StatusOK, auth.discoveryDoc())
+}
+
+func (auth *Auth) handleVerify(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	id := q.Get("id")
+	verifyToken := q.Get("token")
+
+	u, err := auth.VerifyUser(r.Context(), id, verifyToken)
+	if err != nil {
+		if errors.Is(err, errors.NotFound) {
+			err = errors.MissingAuth
+		}
+		writeErr(w, r, auth.cfg.LoginPageRoute, err)
+		return
+	}
+
+	auth.beginLogin(w, r, *u, "")
+}
+
+func (auth *Auth) handleConfirmEmailChange(w http.ResponseWriter, r *http.Request) {
+	u, err := auth.ConfirmEmailChange(r.Context(), r.URL.Query().Get("token"))
+	if err != nil {
+		writeErr(w, r, auth.cfg.LoginPageRoute, err)
+		return
+	}
+
+	writeSuccess(w, r, auth.cfg.LoginPageRoute, http.StatusOK, u.Clone(true))
+}
+
+func (auth *Auth) handleResendVerify(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Email string `json:"email"`
+	}
+	if err := readRequest(r, &req); err != nil {
+		writeErr(w, r, auth.cfg.LoginPageRoute, err)
+		return
+	} else if !strutils.IsValidEmail(req.Email) {
+		writeErr(w, r, auth.cfg.LoginPageRoute, errors.InvalidInput.Hintf("invalid email"))
+		return
+	}
+
+	if err := auth.ResendVerification(r.Context(), req.Email); err != nil {
+		writeErr(w, r, auth.cfg.LoginPageRoute, err)
+		return
+	}
+
+	writeSuccess(w, r, auth.cfg.LoginPageRoute, http.StatusAccepted, map[string]any{})
+}
+
+func (auth *Auth) handleLogin(w http.ResponseWriter, r *http.Request) {
+	doLogin := func() (*User, string, error) {
+		var creds userCreds
+		if err := creds.readFrom(r); err != nil {
+			return nil, "", err
+		}
+
+		keyKind := KeyKindUsername
+		keyValue := creds.Username
+		if creds.Email != "" {
+			keyKind = KeyKindEmail
+			keyValue = creds.Email
+		}
+
+		ctx := r.Context()
+		account, ip := throttleAccount(NewAuthKey(keyKind, keyValue)), clientIP(r)
+		if err := auth.checkLoginThrottle(ctx, account, ip); err != nil {
+			return nil, "", err
+		}
+
+		u, err := auth.verifyCreds(ctx, creds, keyKind, keyValue)
+		if err != nil {
+			if errors.Is(err, errors.MissingAuth) {
+				auth.recordLoginFailed(ctx, loginMethodPassword, err, map[string]any{"account": account})
+				if err := auth.recordLoginFailure(ctx, account, ip); err != nil {
+					log.Warn(ctx, "failed to record login failure", log.Fields{"error": err.Error()})
+				}
+			}
+			return nil, "", err
+		}
+
+		if err := auth.upgradePasswordHash(ctx, u, creds.Password); err != nil {
+			log.Warn(ctx, "failed to upgrade password hash", log.Fields{"error": err.Error()})
+		}
+
+		if err := auth.checkLoginAllowed(u); err != nil {
+			return nil, "", err
+		}
+		return u, account, nil
+	}
+
+	u, account, err := doLogin()
+	if err != nil {
+		writeErr(w, r, auth.cfg.LoginPageRoute, err)
+		return
+	}
+
+	auth.beginLogin(w, r, *u, account)
+}
+
+// verifyCreds finds the user identified by the credentials and verifies
+// the password. Returns errors.MissingAuth if the credentials are invalid.
+func (auth *Auth) verifyCreds(ctx context.Context, creds userCreds, keyKind, keyValue string) (*User, error) {
+	u, err := auth.GetUser(ctx, NewAuthKey(keyKind, keyValue))
+	if err != nil {
+		if errors.Is(err, errors.NotFound) {
+			err = errors.MissingAuth.Hintf("user not found")
+		}
+		return nil, err
+	} else if !u.CheckPassword(creds.Password) {
+		return nil, errors.MissingAuth.Hintf("password mismatch")
+	} else if creds.Email != "" && creds.Email != u.Email {
+		return nil, errors.MissingAuth.Hintf("email mismatch")
+	} else if u.Kind != creds.Kind {
+		return nil, errors.MissingAuth.Hintf("user kind mismatch")
+	}
+	return u, nil
+}
+
+func (auth *Auth) handleForgotPassword(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Email string `json:"email"`
+	}
+	if err := readRequest(r, &req); err != nil {
+		writeErr(w, r, auth.cfg.ResetPageRoute, err)
+		return
+	} else if !strutils.IsValidEmail(req.Email) {
+		writeErr(w, r, auth.cfg.ResetPageRoute, errors.InvalidInput.Hintf("invalid email"))
+		return
+	}
+
+	if err := auth.RequestPasswordReset(r.Context(), req.Email); err != nil {
+		writeErr(w, r, auth.cfg.ResetPageRoute, err)
+		return
+	}
+
+	writeSuccess(w, r, auth.cfg.ResetPageRoute, http.StatusAccepted, map[string]any{})
+}
+
+func (auth *Auth) handleMagicLinkRequest(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Email string `json:"email"`
+		Kind  string `json:"kind"`
+	}
+	if err := readRequest(r, &req); err != nil {
+		writeErr(w, r, auth.cfg.LoginPageRoute, err)
+		return
+	}
+
+	if err := auth.RequestMagicLink(r.Context(), req.Email, req.Kind); err != nil {
+		writeErr(w, r, auth.cfg.LoginPageRoute, err)
+		return
+	}
+
+	writeSuccess(w, r, auth.cfg.LoginPageRoute, http.StatusAccepted, map[string]any{})
+}
+
+// handleMagicLinkPage serves the page the magic link leads to. Nothing is
+// consumed here so that prefetching the link neither burns the token nor
+// gets a session.
+func (auth *Auth) handleMagicLinkPage(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+
+	if err := magicLinkPage.Execute(w, map[string]string{
+		"Action": auth.baseURL.JoinPath("/login/magic/verify").String(),
+		"Token":  r.URL.Query().Get("token"),
+	}); err != nil {
+		log.Warn(r.Context(), "failed to render magic link page", log.Fields{"error": err.Error()})
+	}
+}
+
+func (auth *Auth) handleMagicLinkVerify(w http.ResponseWriter, r *http.Request) {
+	doVerify := func() (*User, error) {
+		var req struct {
+			Token string `json:"token"`
+		}
+		if err := auth.checkSameOrigin(r); err != nil {
+			return nil, err
+		} else if err := readRequest(r, &req); err != nil {
+			return nil, err
+		}
+		return auth.ConsumeMagicLink(r.Context(), req.Token)
+	}
+
+	u, err := doVerify()
+	if err != nil {
+		auth.recordLoginFailed(r.Context(), loginMethodMagicLink, err, nil)
+		writeErr(w, r, auth.cfg.LoginPageRoute, err)
+		return
+	}
+
+	// The magic link only replaces the password. Users with a second
+	// factor enabled must still complete the challenge.
+	auth.beginLogin(w, r, *u, "")
+}
+
+func (auth *Auth) handleOTPRequest(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Channel string `json:"channel"`
+		To      string `json:"to"`
+	}
+	if err := readRequest(r, &req); err != nil {
+		writeErr(w, r, auth.cfg.LoginPageRoute, err)
+		return
+	}
+
+	challenge, err := auth.RequestLoginOTP(r.Context(), req.Channel, req.To)
+	if err != nil {
+		writeErr(w, r, auth.cfg.LoginPageRoute, err)
+		return
+	}
+
+	redirectTo := withQuery(auth.cfg.LoginPageRoute, map[string]string{"otp_id": challenge.ID})
+	writeSuccess(w, r, redirectTo, http.StatusAccepted, challenge)
+}
+
+func (auth *Auth) handleOTPVerify(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		OTPID string `json:"otp_id"`
+		Code  string `json:"code"`
+	}
+	if err := readRequest(r, &req); err != nil {
+		writeErr(w, r, auth.cfg.LoginPageRoute, err)
+		return
+	}
+
+	u, err := auth.VerifyLoginOTP(r.Context(), req.OTPID, req.Code)
+	if err != nil {
+		auth.recordLoginFailed(r.Context(), loginMethodOTP, err, nil)
+		redirectTo := withQuery(auth.cfg.LoginPageRoute, map[string]string{"otp_id": req.OTPID})
+		writeErr(w, r, redirectTo, err)
+		return
+	}
+	auth.beginLogin(w, r, *u, "")
+}
+
+func (auth *Auth) handleResetPassword(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+	if err := readRequest(r, &req); err != nil {
+		writeErr(w, r, auth.cfg.ResetPageRoute, err)
+		return
+	}
+
+	if err := auth.ResetPassword(r.Context(), req.Token, req.Password); err != nil {
+		writeErr(w, r, auth.cfg.ResetPageRoute, err)
+		return
+	}
+
+	writeSuccess(w, r, auth.cfg.LoginPageRoute, http.StatusOK, map[string]any{})
+}
+
+func (auth *Auth) handleWhoAmI(w http.ResponseWriter, r *http.Request) error {
+	session := CurSession(r.Context())
+	if session == nil {
+		return errors.MissingAuth
+	}
+
+	u, err := auth.GetUser(r.Context(), NewAuthKey(KeyKindID, session.UserID))
+	if err != nil {
+		if errors.Is(err, errors.NotFound) {
+			return errors.MissingAuth
+		}
+		return errors.InternalIssue.CausedBy(err)
+	}
+
+	httpx.WriteJSON(w, r, http.StatusOK, u.Clone(true))
+	return nil
+}
+
+func (auth *Auth) handleLogout(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	var sessionID, userID string
+	if token := extractToken(r, auth.cfg.SessionCookie); token != "" {
+		if sess, err := auth.RestoreSession(ctx, token); err == nil {
+			sessionID, userID = sess.ID, sess.UserID
+		}
+	}
+
+	if sessionID != "" {
+		if err := auth.RevokeSession(ctx, sessionID); err != nil {
+			log.Warn(ctx, "failed to revoke session", log.Fields{
+				"session_id": sessionID,
+				"error":      err.Error(),
+			})
+			sessionID = ""
+		}
+	} else if c, err := r.Cookie(auth.refreshCookie()); err == nil {
+		// The access token may have expired while the session is still
+		// alive. The refresh token identifies the session in that case.
+		sessionID, userID, err = auth.revokeRefreshSession(ctx, c.Value)
+		if err != nil {
+			log.Warn(ctx, "failed to revoke session", log.Fields{"error": err.Error()})
+		}
+	}
+
+	if sessionID != "" {
+		auth.recordEvent(ctx, EventLogout, userID, map[string]any{"session_id": sessionID})
+	}
+
+	auth.clearSessionCookie(w)
+	http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
+}
+
+func (auth *Auth) handleLoginMFA(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Challenge string `json:"challenge"`
+		Code      string `json:"code"`
+	}
+	if err := readRequest(r, &req); err != nil {
+		writeErr(w, r, auth.cfg.MFAPageRoute, err)
+		return
+	}
+
+	u, account, err := auth.completeMFAChallenge(r.Context(), req.Challenge, req.Code)
+	if err != nil {
+		auth.recordLoginFailed(r.Context(), loginMethodTOTP, err, nil)
+		redirectTo := withQuery(auth.cfg.MFAPageRoute, map[string]string{"challenge": req.Challenge})
+		writeErr(w, r, redirectTo, err)
+		return
+	}
+
+	auth.finishLogin(w, r, *u, account)
+}
+
+func (auth *Auth) handleTOTPEnroll(w http.ResponseWriter, r *http.Request) error {
+	session := CurSession(r.Context())
+	if session == nil {
+		return errors.MissingAuth
+	}
+
+	enrollment, err := auth.EnrollTOTP(r.Context(), session.UserID)
+	if err != nil {
+		return err
+	}
+
+	httpx.WriteJSON(w, r, http.StatusOK, enrollment)
+	return nil
+}
+
+func (auth *Auth) handleTOTPConfirm(w http.ResponseWriter, r *http.Request) error {
+	session := CurSession(r.Context())
+	if session == nil {
+		return errors.MissingAuth
+	}
+
+	var req struct {
+		Code string `json:"code"`
+	}
+	if err := readRequest(r, &req); err != nil {
+		return err
+	}
+
+	codes, err := auth.ConfirmTOTP(r.Context(), session.UserID, req.Code)
+	if err != nil {
+		return err
+	}
+
+	httpx.WriteJSON(w, r, http.StatusOK, map[string]any{
+		"recovery_codes": codes,
+	})
+	return nil
+}
+
+func (auth *Auth) handleTOTPDisable(w http.ResponseWriter, r *http.Request) error {
+	session := CurSession(r.Context())
+	if session == nil {
+		return errors.MissingAuth
+	}
+
+	var req struct {
+		Code string `json:"code"`
+	}
+	if err := readRequest(r, &req); err != nil {
+		return err
+	}
+
+	if err := auth.DisableTOTP(r.Context(), session.UserID, req.Code); err != nil {
+		return err
+	}
+
+	httpx.WriteJSON(w, r, http.StatusNoContent, nil)
+	return nil
+}
+
+func (auth *Auth) handlePasskeyRegisterBegin(w http.ResponseWriter, r *http.Request) error {
+	session := CurSession(r.Context())
+	if session == nil {
+		return errors.MissingAuth
+	}
+
+	opts, err := auth.BeginPasskeyRegistration(r.Context(), session.UserID)
+	if err != nil {
+		return err
+	}
+
+	httpx.WriteJSON(w, r, http.StatusOK, opts)
+	return nil
+}
+
+func (auth *Auth) handlePasskeyRegisterFinish(w http.ResponseWriter, r *http.Request) error {
+	session := CurSession(r.Context())
+	if session == nil {
+		return errors.MissingAuth
+	}
+
+	var req struct {
+		Name       string            `json:"name"`
+		Credential PasskeyCredential `json:"credential"`
+	}
+	if err := httpx.ReadJSON(r, &req); err != nil {
+		return err
+	}
+
+	if err := auth.FinishPasskeyRegistration(r.Context(), session.UserID, req.Name, req.Credential); err != nil {
+		return err
+	}
+
+	httpx.WriteJSON(w, r, http.StatusCreated, map[string]any{})
+	return nil
+}
+
+func (auth *Auth) handlePasskeyLoginBegin(w http.ResponseWriter, r *http.Request) error {
+	opts, err := auth.BeginPasskeyLogin(r.Context())
+	if err != nil {
+		return err
+	}
+
+	httpx.WriteJSON(w, r, http.StatusOK, opts)
+	return nil
+}
+
+func (auth *Auth) handlePasskeyLoginFinish(w http.ResponseWriter, r *http.Request) {
+	doLogin := func() (*User, error) {
+		var cred PasskeyCredential
+		if err := httpx.ReadJSON(r, &cred); err != nil {
+			return nil, err
+		}
+
+		u, err := auth.FinishPasskeyLogin(r.Context(), cred)
+		if err != nil {
+			return nil, err
+		} else if err := auth.checkLoginAllowed(u); err != nil {
+			return nil, err
+		}
+		return u, nil
+	}
+
+	u, err := doLogin()
+	if err != nil {
+		auth.recordLoginFailed(r.Context(), loginMethodPasskey, err, nil)
+		writeErr(w, r, auth.cfg.LoginPageRoute, err)
+		return
+	}
+
+	auth.finishLogin(w, r, *u, "")
+}
+
+func (auth *Auth) handleRefresh(w http.ResponseWriter, r *http.Request) {
+	doRefresh := func() (*Session, error) {
+		var req struct {
+			RefreshToken string `json:"refresh_token"`
+		}
+
+		// Browser clients logged in through the cookie have the refresh
+		// token in a cookie and need not send it in the body.
+		if c, err := r.Cookie(auth.refreshCookie()); err == nil && isEmptyBody(r) {
+			req.RefreshToken = c.Value
+		} else if err := readRequest(r, &req); err != nil {
+			return nil, err
+		}
+		return auth.RefreshSession(r.Context(), req.RefreshToken)
+	}
+
+	session, err := doRefresh()
+	if err != nil {
+		writeErr(w, r, auth.cfg.LoginPageRoute, err)
+		return
+	}
+
+	auth.setSessionCookie(w, session)
+	writeSuccess(w, r, auth.cfg.LoginPageRoute, http.StatusOK, map[string]any{
+		"token":         session.Token,
+		"expiry":        session.ExpiresAt,
+		"refresh_token": session.RefreshToken,
+	})
+}
+
+// beginLogin completes the login of a user who has passed the primary
+// authentication. If the user has a second factor enabled, a challenge
+// is issued instead of a session. Account is the throttle account of the
+// primary authentication (if any) and is reset only by finishLogin.
+func (auth *Auth) beginLogin(w http.ResponseWriter, r *http.Request, user User, account string) {
+	enabled, err := auth.mfaEnabled(r.Context(), user.ID)
+	if err != nil {
+		writeErr(w, r, auth.cfg.LoginPageRoute, err)
+		return
+	} else if !enabled {
+		auth.finishLogin(w, r, user, account)
+		return
+	}
+
+	challenge, err := auth.startMFAChallenge(r.Context(), user.ID, account)
+	if err != nil {
+		writeErr(w, r, auth.cfg.LoginPageRoute, err)
+		return
+	}
+
+	redirectTo := withQuery(auth.cfg.MFAPageRoute, map[string]string{"challenge": challenge})
+	writeSuccess(w, r, redirectTo, http.StatusAccepted, map[string]any{
+		"mfa_required": true,
+		"challenge":    challenge,
+		"expiry":       time.Now().Add(auth.cfg.MFAChallengeTTL),
+	})
+}
+
+func (auth *Auth) finishLogin(w http.ResponseWriter, r *http.Request, user User, account string) {
+	ctx := withClient(r.Context(), r)
+
+	session, err := auth.CreateSession(ctx, user)
+	if err != nil {
+		writeErr(w, r, auth.cfg.LoginPageRoute, err)
+		return
+	}
+
+	// Failure counters are reset only once all the factors have been
+	// passed, so that knowing the password gives no extra guesses at the
+	// second factor.
+	for _, subject := range []string{account, mfaAccount(user.ID)} {
+		if subject == "" {
+			continue
+		}
+		if err := auth.resetLoginThrottle(ctx, subject); err != nil {
+			log.Warn(ctx, "failed to reset login throttle", log.Fields{"error": err.Error()})
+		}
+	}
+	auth.recordEvent(ctx, EventLoginSucceeded, user.ID, map[string]any{"session_id": session.ID})
+
+	if auth.cfg.NotifyLogins {
+		notice := map[string]any{
+			"User":   user.Clone(true),
+			"Time":   time.Now(),
+			"Client": curClient(ctx),
+		}
+		go auth.sendMail(context.Background(), mailLoginNotice, user.Email, notice)
+	}
+
+	auth.setSessionCookie(w, session)
+	writeSuccess(w, r, auth.cfg.LoginPageRoute, http.StatusOK, map[string]any{
+		"user":          user.Clone(true),
+		"token":         session.Token,
+		"expiry":        session.ExpiresAt,
+		"refresh_token": session.RefreshToken,
+	})
+}
+
+// setSessionCookie sets the access token of the session as a cookie. The
+// refresh token is set as a separate cookie sent only to the refresh route,
+// so that browser clients can get new access tokens when the current one
+// expires.
+func (auth *Auth) setSessionCookie(w http.ResponseWriter, session *Session) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     auth.cfg.SessionCookie,
+		Value:    session.Token,
+		Path:     "/",
+		Expires:  session.ExpiresAt,
+		Secure:   false,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	if session.RefreshToken != "" {
+		http.SetCookie(w, &http.Cookie{
+			Name:     auth.refreshCookie(),
+			Value:    session.RefreshToken,
+			Path:     auth.refreshPath(),
+			Expires:  time.Now().Add(auth.cfg.RefreshTTL),
+			Secure:   false,
+			HttpOnly: true,
+			SameSite: http.SameSiteStrictMode,
+		})
+	}
+}
+
+// clearSessionCookie removes the cookies set by setSessionCookie.
+func (auth *Auth) clearSessionCookie(w http.ResponseWriter) {
+	for name, path := range map[string]string{
+		auth.cfg.SessionCookie: "/",
+		auth.refreshCookie():   auth.refreshPath(),
+	} {
+		http.SetCookie(w, &http.Cookie{
+			Name:     name,
+			Value:    "",
+			Path:     path,
+			Expires:  time.Now(),
+			MaxAge:   -1,
+			Secure:   false,
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+}
+
+func (auth *Auth) refreshCookie() string { return auth.cfg.SessionCookie + "_refresh" }
+
+func (auth *Auth) refreshPath() string { return auth.baseURL.JoinPath("/refresh").Path }
+
+func userDataFromGothUser(gu goth.User) UserData {
+	// TODO: extract more from raw data?
+	return map[string]any{
+		"name":      gu.Name,
+		"picture":   gu.AvatarURL,
+		"location":  gu.Location,
+		"nick_name": gu.NickName,
+	}
+}
+
+// checkSameOrigin rejects browser requests sent by pages of other origins,
+// so that other sites cannot submit login forms for the user (i.e., login
+// CSRF). Requests without an Origin header are not from browser forms and
+// are allowed.
+func (auth *Auth) checkSameOrigin(r *http.Request) error {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return nil
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil || u.Scheme != auth.baseURL.Scheme || u.Host != auth.baseURL.Host {
+		return errors.Forbidden.Coded("cross_origin").Hintf("origin '%s' is not allowed", origin)
+	}
+	return nil
+}
+
+func writeErr(w http.ResponseWriter, r *http.Request, redirectTo string, err error) {
+	isFormSubmit := strings.Contains(r.Header.Get("Content-Type"), contentTypeForm)
+	if isFormSubmit {
+		u, parseErr := url.Parse(redirectTo)
+		if parseErr == nil {
+			q := u.Query()
+			q.Set("err_code", errors.E(err).Code)
+			u.RawQuery = q.Encode()
+			u.JoinPath()
+			http.Redirect(w, r, u.String(), http.StatusSeeOther)
+			return
+		}
+	}
+	httpx.WriteErr(w, r, err)
+}
+
+// writeOAuthErr writes the error in the format defined by RFC 6749
+// (Section 5.2) for the token endpoint.
+func writeOAuthErr(w http.ResponseWriter, r *http.Request, err error) {
+	e := errors.E(err)
+
+	status := http.StatusBadRequest
+	if e.Status >= 500 || e.Status == http.StatusUnauthorized {
+		status = e.Status
+	}
+
+	httpx.WriteJSON(w, r, status, map[string]any{
+		"error":             oauthErrorCode(err),
+		"error_description": e.DebugHint,
+	})
 }
 
 func writeSuccess(w http.ResponseWriter, r *http.Request, redirectTo string, status int, v any) {
@@ -0,0 +1,100 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/spy16/pgbase/httpx"
+)
+
+func TestSetSessionCookie(t *testing.T) {
+	t.Parallel()
+
+	baseURL, _ := url.Parse("https://example.com/auth")
+	auth := &Auth{
+		baseURL: baseURL,
+		cfg: Config{
+			SessionCookie: defaultSessionCookie,
+			SessionTTL:    15 * time.Minute,
+			RefreshTTL:    30 * 24 * time.Hour,
+		},
+	}
+
+	rec := httptest.NewRecorder()
+	auth.setSessionCookie(rec, &Session{
+		Token:        "access",
+		ExpiresAt:    time.Now().Add(auth.cfg.SessionTTL),
+		RefreshToken: "refresh",
+	})
+
+	cookies := map[string]*http.Cookie{}
+	for _, c := range rec.Result().Cookies() {
+		cookies[c.Name] = c
+	}
+	require.Len(t, cookies, 2)
+
+	access := cookies[defaultSessionCookie]
+	require.NotNil(t, access)
+	assert.Equal(t, "access", access.Value)
+	assert.Equal(t, "/", access.Path)
+	assert.True(t, access.HttpOnly)
+
+	refresh := cookies[defaultSessionCookie+"_refresh"]
+	require.NotNil(t, refresh)
+	assert.Equal(t, "refresh", refresh.Value)
+	assert.Equal(t, "/auth/refresh", refresh.Path)
+	assert.True(t, refresh.HttpOnly)
+	assert.True(t, refresh.Expires.After(time.Now().Add(29*24*time.Hour)),
+		"refresh cookie must outlive the access token")
+
+	rec = httptest.NewRecorder()
+	auth.clearSessionCookie(rec)
+	for _, c := range rec.Result().Cookies() {
+		assert.Empty(t, c.Value)
+		assert.Equal(t, cookies[c.Name].Path, c.Path, c.Name)
+	}
+	assert.Len(t, rec.Result().Cookies(), 2)
+}
+
+func TestRetryAfterHeader(t *testing.T) {
+	t.Parallel()
+
+	throttled := func(w http.ResponseWriter, r *http.Request) error {
+		return errThrottled(90 * time.Second)
+	}
+
+	table := []struct {
+		title   string
+		handler http.HandlerFunc
+	}{
+		{
+			title:   "HandlerFuncE",
+			handler: httpx.HandlerFuncE(throttled),
+		},
+		{
+			title: "writeErr",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				writeErr(w, r, "/login", throttled(w, r))
+			},
+		},
+	}
+
+	for _, tt := range table {
+		tt := tt
+		t.Run(tt.title, func(t *testing.T) {
+			t.Parallel()
+
+			rec := httptest.NewRecorder()
+			tt.handler(rec, httptest.NewRequest(http.MethodPost, "/email", nil))
+
+			assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+			assert.Equal(t, "90", rec.Header().Get("Retry-After"))
+		})
+	}
+}
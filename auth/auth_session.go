@@ -7,46 +7,120 @@ import (
 	"strings"
 	"time"
 
+	sq "github.com/Masterminds/squirrel"
 	"github.com/golang-jwt/jwt/v4"
+	"github.com/jackc/pgx/v5"
 
 	"github.com/spy16/pgbase/errors"
 	"github.com/spy16/pgbase/httpx"
 	"github.com/spy16/pgbase/strutils"
 )
 
-// CreateSession creates a new session for the given user and returns.
-func (auth *Auth) CreateSession(_ context.Context, u User) (*Session, error) {
+// CreateSession creates a new session for the given user, records it
+// in the sessions table and returns. The returned session carries a
+// short-lived access token and a refresh token that can be exchanged
+// for a new access token using RefreshSession.
+func (auth *Auth) CreateSession(ctx context.Context, u User) (*Session, error) {
 	now := time.Now()
-	expiresAt := now.Add(auth.cfg.SessionTTL)
 	sessionID := strutils.RandStr(8)
 
-	claims := sessionClaims{
-		ID:        sessionID,
-		Kind:      u.Kind,
-		Subject:   u.ID,
-		IssuedAt:  now.Unix(),
-		ExpiresAt: expiresAt.Unix(),
+	sess, err := auth.signSession(ctx, u, sessionID, "", now)
+	if err != nil {
+		return nil, err
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS512, &claims)
+	refreshToken := newSecretToken()
+	refreshExpiresAt := now.Add(auth.cfg.RefreshTTL)
 
-	tokenString, err := token.SignedString([]byte(auth.cfg.SigningSecret))
+	tx, err := auth.conn.Begin(ctx)
+	if err != nil {
+		return nil, translateErr(err)
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	client := curClient(ctx)
+	q, args, err := sq.Insert("sessions").
+		Columns("id", "user_id", "created_at", "last_seen_at", "expires_at", "user_agent", "client_ip").
+		Values(sessionID, u.ID, now, now, refreshExpiresAt, client.UserAgent, client.IP).
+		PlaceholderFormat(sq.Dollar).ToSql()
 	if err != nil {
 		return nil, errors.InternalIssue.CausedBy(err)
 	}
 
+	if _, err := tx.Exec(ctx, q, args...); err != nil {
+		return nil, translateErr(err)
+	}
+
+	if err := insertRefreshToken(ctx, tx, sessionID, refreshToken, now, refreshExpiresAt); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, translateErr(err)
+	}
+
+	sess.RefreshToken = refreshToken
+	return sess, nil
+}
+
+// signSession issues a new access token for the given session of user.
+// Roles and permissions of the user, and the active organization (if
+// any) are embedded in the token so that access checks need not hit the
+// database.
+func (auth *Auth) signSession(ctx context.Context, u User, sessionID, orgID string, now time.Time) (*Session, error) {
+	expiresAt := now.Add(auth.cfg.SessionTTL)
+
+	grants, err := loadGrants(ctx, auth.conn, u.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	var role string
+	if orgID != "" {
+		role, err = orgRole(ctx, auth.conn, orgID, u.ID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	claims := sessionClaims{
+		Type:        sessionTokenType,
+		Issuer:      auth.issuer(),
+		ID:          sessionID,
+		Kind:        u.Kind,
+		Subject:     u.ID,
+		IssuedAt:    now.Unix(),
+		ExpiresAt:   expiresAt.Unix(),
+		Roles:       grants.Roles,
+		Permissions: grants.Permissions,
+		OrgID:       orgID,
+		OrgRole:     role,
+
+		GrantsVersion: grants.version,
+	}
+
+	tokenString, err := auth.keys.sign(&claims)
+	if err != nil {
+		return nil, err
+	}
+
 	return &Session{
-		ID:        sessionID,
-		Token:     tokenString,
-		UserID:    u.ID,
-		UserKind:  u.Kind,
-		ExpiresAt: expiresAt,
+		ID:          sessionID,
+		Token:       tokenString,
+		UserID:      u.ID,
+		UserKind:    u.Kind,
+		ExpiresAt:   expiresAt,
+		Roles:       grants.Roles,
+		Permissions: grants.Permissions,
+		OrgID:       orgID,
+		OrgRole:     role,
 	}, nil
 }
 
 // RestoreSession verifies the given token, restores the session and returns.
-// If token is not valid, errors.MissingAuth will be returned.
-func (auth *Auth) RestoreSession(_ context.Context, token string) (*Session, error) {
+// If token is not valid or has expired, or if the session has been revoked
+// or has expired, errors.MissingAuth will be returned.
+func (auth *Auth) RestoreSession(ctx context.Context, token string) (*Session, error) {
 	var errToken = errors.MissingAuth.Coded("invalid_token")
 
 	token = strings.TrimSpace(token)
@@ -54,14 +128,7 @@ func (auth *Auth) RestoreSession(_ context.Context, token string) (*Session, err
 		return nil, errToken.Hintf("empty token")
 	}
 
-	keyFn := func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, errToken.Hintf("invalid alg=%s", token.Method.Alg())
-		}
-		return []byte(auth.cfg.SigningSecret), nil
-	}
-
-	tok, err := jwt.ParseWithClaims(token, &sessionClaims{}, keyFn)
+	tok, err := jwt.ParseWithClaims(token, &sessionClaims{}, auth.keys.keyFunc)
 	if err != nil || !tok.Valid {
 		return nil, errToken.CausedBy(err).Hintf("parse failed")
 	}
@@ -69,17 +136,141 @@ func (auth *Auth) RestoreSession(_ context.Context, token string) (*Session, err
 	claims, ok := tok.Claims.(*sessionClaims)
 	if !ok {
 		return nil, errToken.Hintf("claims type='%s'", reflect.TypeOf(tok.Claims))
+	} else if claims.Type != sessionTokenType || claims.Audience != nil || claims.ClientID != "" {
+		return nil, errToken.Hintf("not a session token")
+	}
+
+	q, args, err := sq.Update("sessions").
+		Where(sq.Eq{
+			"id":         claims.ID,
+			"user_id":    claims.Subject,
+			"revoked_at": nil,
+		}).
+		Where(sq.Expr("expires_at > now()")).
+		Set("last_seen_at", time.Now()).
+		Suffix(`RETURNING (SELECT u.verified_at FROM users AS u WHERE u.id=sessions.user_id),
+			(SELECT u.disabled_at FROM users AS u WHERE u.id=sessions.user_id),
+			coalesce((SELECT u.grants_version FROM users AS u WHERE u.id=sessions.user_id), 0),
+			coalesce(sessions.org_id, ''),
+			coalesce((SELECT m.role FROM org_members AS m
+				WHERE m.org_id=sessions.org_id AND m.user_id=sessions.user_id), '')`).
+		PlaceholderFormat(sq.Dollar).ToSql()
+	if err != nil {
+		return nil, errors.InternalIssue.CausedBy(err)
+	}
+
+	var verifiedAt, disabledAt *time.Time
+	var grantsVersion int
+	var orgID, role string
+	if err := auth.conn.QueryRow(ctx, q, args...).Scan(&verifiedAt, &disabledAt, &grantsVersion, &orgID, &role); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, errToken.Hintf("session revoked or expired")
+		}
+		return nil, translateErr(err)
+	} else if disabledAt != nil {
+		return nil, errDisabled
+	} else if grantsVersion != claims.GrantsVersion {
+		// Roles of the user have changed since the token was issued. The
+		// client must refresh the session to get a token with the new ones.
+		return nil, errToken.Hintf("grants changed")
+	}
+
+	// The membership may have changed since the token was issued. The org
+	// is honoured only if it is still active for the session and the user
+	// is still a member, with the role they currently have.
+	if orgID != claims.OrgID || role == "" {
+		orgID, role = "", ""
 	}
 
 	return &Session{
-		ID:        claims.ID,
-		Token:     token,
-		UserID:    claims.Subject,
-		UserKind:  claims.Kind,
-		ExpiresAt: time.Unix(claims.ExpiresAt, 0),
+		ID:          claims.ID,
+		Token:       token,
+		UserID:      claims.Subject,
+		UserKind:    claims.Kind,
+		Verified:    verifiedAt != nil,
+		ExpiresAt:   time.Unix(claims.ExpiresAt, 0),
+		Roles:       claims.Roles,
+		Permissions: claims.Permissions,
+		OrgID:       orgID,
+		OrgRole:     role,
 	}, nil
 }
 
+// checkReauth verifies that the user of the session has proven their
+// identity recently, either by giving the current password or by having
+// logged in within the ReauthWindow. Required for changes that would let
+// anyone holding a session token take over the account. Wrong passwords
+// count towards the login throttle of the account.
+func (auth *Auth) checkReauth(ctx context.Context, sess Session, password string) error {
+	var errReauth = errors.Forbidden.Coded("reauth_required")
+
+	if password != "" {
+		u, err := auth.GetUser(ctx, NewAuthKey(KeyKindID, sess.UserID))
+		if err != nil {
+			return err
+		}
+
+		account, ip := throttleAccount(NewAuthKey(KeyKindEmail, u.Email)), curClient(ctx).IP
+		if err := auth.checkLoginThrottle(ctx, account, ip); err != nil {
+			return err
+		} else if !u.CheckPassword(password) {
+			if err := auth.recordLoginFailure(ctx, account, ip); err != nil {
+				return err
+			}
+			return errReauth.Hintf("password mismatch")
+		}
+		return nil
+	}
+
+	q, args, err := sq.Select("created_at").
+		From("sessions").
+		Where(sq.Eq{
+			"id":      sess.ID,
+			"user_id": sess.UserID,
+		}).
+		PlaceholderFormat(sq.Dollar).ToSql()
+	if err != nil {
+		return errors.InternalIssue.CausedBy(err)
+	}
+
+	var loginAt time.Time
+	if err := auth.conn.QueryRow(ctx, q, args...).Scan(&loginAt); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return errReauth.Hintf("session not found")
+		}
+		return translateErr(err)
+	} else if time.Since(loginAt) > auth.cfg.ReauthWindow {
+		return errReauth.Hintf("password is required")
+	}
+	return nil
+}
+
+// RevokeSession revokes the session with given ID. Tokens issued for the
+// session will no longer be accepted by RestoreSession.
+func (auth *Auth) RevokeSession(ctx context.Context, sessionID string) error {
+	return revokeSessions(ctx, auth.conn, sq.Eq{"id": sessionID})
+}
+
+// RevokeAllSessions revokes all active sessions of the given user.
+func (auth *Auth) RevokeAllSessions(ctx context.Context, userID string) error {
+	return revokeSessions(ctx, auth.conn, sq.Eq{"user_id": userID})
+}
+
+func revokeSessions(ctx context.Context, db querier, where sq.Eq) error {
+	where["revoked_at"] = nil
+
+	q, args, err := sq.Update("sessions").
+		Where(where).
+		Set("revoked_at", time.Now()).
+		PlaceholderFormat(sq.Dollar).ToSql()
+	if err != nil {
+		return errors.InternalIssue.CausedBy(err)
+	}
+
+	_, err = db.Exec(ctx, q, args...)
+	return translateErr(err)
+}
+
 // Authenticate returns a middleware that can authenticate incoming
 // requests and inject the user into context.
 func (auth *Auth) Authenticate() func(http.Handler) http.Handler {
@@ -91,9 +282,16 @@ func (auth *Auth) Authenticate() func(http.Handler) http.Handler {
 			if token == "" {
 				ctx = NewCtx(ctx, nil)
 			} else {
-				sess, err := auth.RestoreSession(ctx, token)
+				restore := auth.RestoreSession
+				if isAPIKey(token) {
+					restore = auth.restoreAPIKeySession
+				}
+
+				sess, err := restore(ctx, token)
 				if err != nil {
 					return err
+				} else if auth.cfg.RequireVerified && !sess.Verified {
+					return errUnverified
 				}
 				ctx = NewCtx(ctx, sess)
 			}
@@ -0,0 +1,96 @@
+package auth
+
+import (
+	"context"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/stretchr/testify/require"
+
+	"github.com/spy16/pgbase/mailer"
+	"github.com/spy16/pgbase/strutils"
+)
+
+// testDSNEnv names the environment variable holding the Postgres connection
+// string used by tests that need a database. Such tests are skipped if it
+// is not set.
+const testDSNEnv = "PGBASE_TEST_DSN"
+
+// newTestAuth initialises an Auth in a fresh schema of the test database.
+// The schema is dropped when the test ends. Tests using it must not run in
+// parallel since Init registers goth providers globally.
+func newTestAuth(t *testing.T, cfg Config, opts ...Option) *Auth {
+	t.Helper()
+
+	dsn := os.Getenv(testDSNEnv)
+	if dsn == "" {
+		t.Skipf("%s is not set", testDSNEnv)
+	}
+
+	ctx := context.Background()
+	conn, err := pgx.Connect(ctx, dsn)
+	require.NoError(t, err)
+
+	schemaName := "test_" + strutils.RandStr(12, strutils.CharsetLower)
+	_, err = conn.Exec(ctx, "CREATE SCHEMA "+schemaName+"; SET search_path TO "+schemaName)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_, _ = conn.Exec(ctx, "DROP SCHEMA "+schemaName+" CASCADE")
+		_ = conn.Close(ctx)
+	})
+
+	if cfg.SigningSecret == "" && len(cfg.SigningKeys) == 0 {
+		cfg.SigningSecret = strutils.RandStr(32)
+	}
+
+	au, err := Init(conn, "http://localhost:8080", cfg, opts...)
+	require.NoError(t, err)
+	return au
+}
+
+// registerTestUser registers a user with the given email and password.
+func registerTestUser(t *testing.T, au *Auth, email, password string) *User {
+	t.Helper()
+
+	u := NewUser("", "", email)
+	u.VerifyToken = nil
+	pwdHash, err := au.HashPassword(password, u)
+	require.NoError(t, err)
+	u.PwdHash = &pwdHash
+
+	registered, err := au.RegisterUser(context.Background(), u, nil)
+	require.NoError(t, err)
+	return registered
+}
+
+// recordingMailer collects the messages sent through it.
+type recordingMailer struct {
+	mu   sync.Mutex
+	msgs []mailer.Message
+}
+
+func (rm *recordingMailer) Send(_ context.Context, msg mailer.Message) error {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	rm.msgs = append(rm.msgs, msg)
+	return nil
+}
+
+// sent returns the messages sent to the given address.
+func (rm *recordingMailer) sent(to string) []mailer.Message {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+
+	var res []mailer.Message
+	for _, msg := range rm.msgs {
+		for _, addr := range msg.To {
+			if strings.EqualFold(addr, to) {
+				res = append(res, msg)
+			}
+		}
+	}
+	return res
+}
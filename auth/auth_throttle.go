@@ -0,0 +1,245 @@
+package auth
+
+import (
+	"context"
+	"math"
+	"strings"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+
+	"github.com/spy16/pgbase/errors"
+)
+
+// Scopes of login attempt counters.
+const (
+	LockoutScopeAccount = "account"
+	LockoutScopeIP      = "ip"
+)
+
+// LoginThrottleConf configures the brute-force protection of password
+// logins. Failed attempts are counted per account and per client IP.
+// Once a counter reaches its threshold, further attempts are rejected
+// for a lockout period that doubles with every subsequent failure.
+type LoginThrottleConf struct {
+	Disabled         bool          `mapstructure:"disabled"`
+	AccountThreshold int           `mapstructure:"account_threshold"`
+	IPThreshold      int           `mapstructure:"ip_threshold"`
+	BaseLockout      time.Duration `mapstructure:"base_lockout"`
+	MaxLockout       time.Duration `mapstructure:"max_lockout"`
+
+	// Window is the duration of inactivity after which the failure
+	// counters start over.
+	Window time.Duration `mapstructure:"window"`
+}
+
+// Lockout represents an active lockout of an account or a client IP.
+type Lockout struct {
+	Scope         string    `json:"scope"`
+	Subject       string    `json:"subject"`
+	Failures      int       `json:"failures"`
+	LastFailureAt time.Time `json:"last_failure_at"`
+	LockedUntil   time.Time `json:"locked_until"`
+}
+
+func (conf *LoginThrottleConf) sanitise() {
+	if conf.AccountThreshold <= 0 {
+		conf.AccountThreshold = 5
+	}
+	if conf.IPThreshold <= 0 {
+		conf.IPThreshold = 20
+	}
+	if conf.BaseLockout <= 0 {
+		conf.BaseLockout = 30 * time.Second
+	}
+	if conf.MaxLockout <= 0 {
+		conf.MaxLockout = 1 * time.Hour
+	}
+	if conf.Window <= 0 {
+		conf.Window = 24 * time.Hour
+	}
+}
+
+// lockoutDuration returns the lockout period after the given number of
+// consecutive failures. Zero is returned if threshold is not reached.
+func (conf LoginThrottleConf) lockoutDuration(failures, threshold int) time.Duration {
+	if failures < threshold {
+		return 0
+	}
+
+	exp := float64(failures - threshold)
+	d := float64(conf.BaseLockout) * math.Pow(2, exp)
+	if d > float64(conf.MaxLockout) {
+		return conf.MaxLockout
+	}
+	return time.Duration(d)
+}
+
+// ListLockouts returns all the currently active lockouts.
+func (auth *Auth) ListLockouts(ctx context.Context) ([]Lockout, error) {
+	q, args, err := sq.Select("scope", "subject", "failures", "last_failure_at", "locked_until").
+		From("login_attempts").
+		Where(sq.Gt{"locked_until": time.Now()}).
+		OrderBy("locked_until DESC").
+		PlaceholderFormat(sq.Dollar).ToSql()
+	if err != nil {
+		return nil, errors.InternalIssue.CausedBy(err)
+	}
+
+	rows, err := auth.conn.Query(ctx, q, args...)
+	if err != nil {
+		return nil, translateErr(err)
+	}
+	defer rows.Close()
+
+	res := []Lockout{}
+	for rows.Next() {
+		var l Lockout
+		if err := rows.Scan(&l.Scope, &l.Subject, &l.Failures, &l.LastFailureAt, &l.LockedUntil); err != nil {
+			return nil, translateErr(err)
+		}
+		res = append(res, l)
+	}
+	return res, translateErr(rows.Err())
+}
+
+// ClearLockout resets the failure counter of the account or client IP
+// and lifts any active lockout.
+func (auth *Auth) ClearLockout(ctx context.Context, scope, subject string) error {
+	return resetLoginFailures(ctx, auth.conn, sq.Eq{
+		"scope":   scope,
+		"subject": subject,
+	})
+}
+
+// checkLoginThrottle returns errors.Throttled if the account or the IP
+// is currently locked out.
+func (auth *Auth) checkLoginThrottle(ctx context.Context, account, ip string) error {
+	if auth.cfg.LoginThrottle.Disabled {
+		return nil
+	}
+
+	q, args, err := sq.Select("max(locked_until)").
+		From("login_attempts").
+		Where(sq.Or{
+			sq.Eq{"scope": LockoutScopeAccount, "subject": account},
+			sq.Eq{"scope": LockoutScopeIP, "subject": ip},
+		}).
+		PlaceholderFormat(sq.Dollar).ToSql()
+	if err != nil {
+		return errors.InternalIssue.CausedBy(err)
+	}
+
+	var lockedUntil *time.Time
+	if err := auth.conn.QueryRow(ctx, q, args...).Scan(&lockedUntil); err != nil {
+		return translateErr(err)
+	}
+
+	if lockedUntil != nil {
+		if wait := time.Until(*lockedUntil); wait > 0 {
+			return errThrottled(wait)
+		}
+	}
+	return nil
+}
+
+// recordLoginFailure increments the failure counters of the account and
+// the IP and locks them out if the thresholds have been reached.
+func (auth *Auth) recordLoginFailure(ctx context.Context, account, ip string) error {
+	conf := auth.cfg.LoginThrottle
+	if conf.Disabled {
+		return nil
+	}
+
+	counters := []struct {
+		scope, subject string
+		threshold      int
+	}{
+		{scope: LockoutScopeAccount, subject: account, threshold: conf.AccountThreshold},
+		{scope: LockoutScopeIP, subject: ip, threshold: conf.IPThreshold},
+	}
+
+	now := time.Now()
+	for _, c := range counters {
+		if c.subject == "" {
+			continue
+		}
+
+		q, args, err := sq.Insert("login_attempts").
+			Columns("scope", "subject", "failures", "last_failure_at").
+			Values(c.scope, c.subject, 1, now).
+			Suffix(`ON CONFLICT (scope, subject) DO UPDATE SET
+				failures = CASE WHEN login_attempts.last_failure_at < ? THEN 1 ELSE login_attempts.failures + 1 END,
+				last_failure_at = excluded.last_failure_at
+				RETURNING failures`, now.Add(-conf.Window)).
+			PlaceholderFormat(sq.Dollar).ToSql()
+		if err != nil {
+			return errors.InternalIssue.CausedBy(err)
+		}
+
+		var failures int
+		if err := auth.conn.QueryRow(ctx, q, args...).Scan(&failures); err != nil {
+			return translateErr(err)
+		}
+
+		lockout := conf.lockoutDuration(failures, c.threshold)
+		if lockout == 0 {
+			continue
+		}
+
+		q, args, err = sq.Update("login_attempts").
+			Where(sq.Eq{"scope": c.scope, "subject": c.subject}).
+			Set("locked_until", now.Add(lockout)).
+			PlaceholderFormat(sq.Dollar).ToSql()
+		if err != nil {
+			return errors.InternalIssue.CausedBy(err)
+		}
+
+		if _, err := auth.conn.Exec(ctx, q, args...); err != nil {
+			return translateErr(err)
+		}
+	}
+	return nil
+}
+
+// resetLoginThrottle clears the failure counter of the account after a
+// successful login. The counter of the client IP is left to expire since
+// a login to one account says nothing about the guesses made at others.
+func (auth *Auth) resetLoginThrottle(ctx context.Context, account string) error {
+	if auth.cfg.LoginThrottle.Disabled {
+		return nil
+	}
+
+	return resetLoginFailures(ctx, auth.conn, sq.Eq{
+		"scope":   LockoutScopeAccount,
+		"subject": account,
+	})
+}
+
+func resetLoginFailures(ctx context.Context, db querier, where sq.Sqlizer) error {
+	q, args, err := sq.Delete("login_attempts").
+		Where(where).
+		PlaceholderFormat(sq.Dollar).ToSql()
+	if err != nil {
+		return errors.InternalIssue.CausedBy(err)
+	}
+
+	_, err = db.Exec(ctx, q, args...)
+	return translateErr(err)
+}
+
+// throttleAccount returns the subject used for counting failed logins of
+// the account identified by the auth key.
+func throttleAccount(authKey string) string {
+	return strings.ToLower(strings.TrimSpace(authKey))
+}
+
+// errTooManyAttempts matches the errors returned by errThrottled.
+var errTooManyAttempts = errors.Throttled.Coded("too_many_attempts")
+
+func errThrottled(wait time.Duration) error {
+	secs := int(math.Ceil(wait.Seconds()))
+	return errors.Throttled.Coded("too_many_attempts", map[string]any{
+		"retry_after": secs,
+	}).Hintf("retry after %d seconds", secs)
+}
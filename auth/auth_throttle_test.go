@@ -0,0 +1,21 @@
+package auth
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoginThrottleConf_lockoutDuration(t *testing.T) {
+	t.Parallel()
+
+	conf := LoginThrottleConf{}
+	conf.sanitise()
+
+	assert.Equal(t, time.Duration(0), conf.lockoutDuration(4, 5))
+	assert.Equal(t, 30*time.Second, conf.lockoutDuration(5, 5))
+	assert.Equal(t, 60*time.Second, conf.lockoutDuration(6, 5))
+	assert.Equal(t, 4*time.Minute, conf.lockoutDuration(8, 5))
+	assert.Equal(t, conf.MaxLockout, conf.lockoutDuration(100, 5))
+}
@@ -0,0 +1,131 @@
+package auth
+
+import (
+	"context"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+
+	"github.com/spy16/pgbase/errors"
+)
+
+// Single-use token kinds.
+const (
+	tokenKindVerifyEmail   = "verify_email"
+	tokenKindPasswordReset = "password_reset"
+	tokenKindMFAChallenge  = "mfa_challenge"
+	tokenKindMagicLink     = "magic_link"
+	tokenKindLoginOTP      = "login_otp"
+	tokenKindPhoneOTP      = "phone_otp"
+	tokenKindEmailChange   = "email_change"
+
+	tokenKindPasskeyRegister = "passkey_register"
+	tokenKindPasskeyLogin    = "passkey_login"
+
+	tokenKindOrgInvite = "org_invite"
+
+	tokenKindOAuthCode    = "oauth_code"
+	tokenKindOAuthRefresh = "oauth_refresh"
+)
+
+type userToken struct {
+	UserID   *string
+	Attribs  map[string]any
+	Attempts int
+}
+
+// issueToken creates a new single-use token of the given kind and returns
+// the plaintext value. Only a hash of the token is stored. Any previously
+// issued unused tokens of the same kind for the user are invalidated.
+func issueToken(ctx context.Context, db querier, kind string, userID *string, ttl time.Duration, attribs map[string]any) (string, error) {
+	now := time.Now()
+
+	if userID != nil {
+		q, args, err := sq.Update("user_tokens").
+			Where(sq.Eq{
+				"kind":    kind,
+				"user_id": *userID,
+				"used_at": nil,
+			}).
+			Set("used_at", now).
+			PlaceholderFormat(sq.Dollar).ToSql()
+		if err != nil {
+			return "", errors.InternalIssue.CausedBy(err)
+		}
+
+		if _, err := db.Exec(ctx, q, args...); err != nil {
+			return "", translateErr(err)
+		}
+	}
+
+	token := newSecretToken()
+	q, args, err := sq.Insert("user_tokens").
+		Columns("token_hash", "kind", "user_id", "attribs", "created_at", "expires_at").
+		Values(hashToken(token), kind, userID, attribs, now, now.Add(ttl)).
+		PlaceholderFormat(sq.Dollar).ToSql()
+	if err != nil {
+		return "", errors.InternalIssue.CausedBy(err)
+	}
+
+	if _, err := db.Exec(ctx, q, args...); err != nil {
+		return "", translateErr(err)
+	}
+
+	return token, nil
+}
+
+// consumeToken marks the token of given kind as used and returns its
+// details. Returns errors.NotFound if the token does not exist, has
+// expired or has already been used.
+func consumeToken(ctx context.Context, db querier, kind, token string) (*userToken, error) {
+	now := time.Now()
+
+	q, args, err := sq.Update("user_tokens").
+		Where(sq.Eq{
+			"token_hash": hashToken(token),
+			"kind":       kind,
+			"used_at":    nil,
+		}).
+		Where(sq.Gt{"expires_at": now}).
+		Set("used_at", now).
+		Suffix("RETURNING user_id, attribs").
+		PlaceholderFormat(sq.Dollar).ToSql()
+	if err != nil {
+		return nil, errors.InternalIssue.CausedBy(err)
+	}
+
+	var ut userToken
+	if err := db.QueryRow(ctx, q, args...).Scan(&ut.UserID, &ut.Attribs); err != nil {
+		return nil, translateErr(err)
+	}
+	return &ut, nil
+}
+
+// claimTokenAttempt atomically counts an attempt against the token of
+// given kind and returns its details without consuming it. Since the
+// attempt is counted before the caller compares any secret, concurrent
+// attempts cannot exceed maxAttempts. Returns errors.NotFound if the
+// token does not exist, has expired, has been used or has no attempts
+// left.
+func claimTokenAttempt(ctx context.Context, db querier, kind, token string, maxAttempts int) (*userToken, error) {
+	q, args, err := sq.Update("user_tokens").
+		Where(sq.Eq{
+			"token_hash": hashToken(token),
+			"kind":       kind,
+			"used_at":    nil,
+		}).
+		Where(sq.Gt{"expires_at": time.Now()}).
+		Where(sq.Lt{"attempts": maxAttempts}).
+		Set("attempts", sq.Expr("attempts + 1")).
+		Suffix("RETURNING user_id, attribs, attempts").
+		PlaceholderFormat(sq.Dollar).ToSql()
+	if err != nil {
+		return nil, errors.InternalIssue.CausedBy(err)
+	}
+
+	var ut userToken
+	if err := db.QueryRow(ctx, q, args...).Scan(&ut.UserID, &ut.Attribs, &ut.Attempts); err != nil {
+		return nil, translateErr(err)
+	}
+	return &ut, nil
+}
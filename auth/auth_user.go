@@ -2,34 +2,41 @@ package auth
 
 import (
 	"context"
+	"strings"
 	"time"
 
 	sq "github.com/Masterminds/squirrel"
 	"github.com/jackc/pgx/v5"
 
 	"github.com/spy16/pgbase/errors"
+	"github.com/spy16/pgbase/log"
 	"github.com/spy16/pgbase/strutils"
 )
 
+var (
+	errUnverified = errors.Forbidden.Coded("unverified_user").Hintf("email is not verified")
+	errDisabled   = errors.Forbidden.Coded("user_disabled").Hintf("user has been disabled")
+)
+
 // GetUser finds a user by given key.
 func (auth *Auth) GetUser(ctx context.Context, authKey string) (*User, error) {
 	var u User
 	colNames := []string{
 		"u.id", "u.kind", "u.user_data", "u.email", "u.pwd_hash", "u.username",
-		"u.created_at", "u.updated_at", "u.verified_at", "u.verify_token",
-		"u.attributes",
+		"u.created_at", "u.updated_at", "u.verified_at",
+		"u.disabled_at", "u.attributes", "u.phone",
 	}
 
 	colPtrs := []any{
 		&u.ID, &u.Kind, &u.Data, &u.Email, &u.PwdHash, &u.Username,
-		&u.CreatedAt, &u.UpdatedAt, &u.VerifiedAt, &u.VerifyToken,
-		&u.Attributes,
+		&u.CreatedAt, &u.UpdatedAt, &u.VerifiedAt,
+		&u.DisabledAt, &u.Attributes, &u.Phone,
 	}
 
 	keyKind, val := SplitAuthKey(authKey)
 
 	qb := sq.Select(colNames...).From("users AS u")
-	if strutils.OneOf(keyKind, []string{"id", "email", "username"}) {
+	if strutils.OneOf(keyKind, []string{"id", "email", "username", "phone"}) {
 		qb = qb.Where(sq.Eq{keyKind: val})
 	} else {
 		qb = qb.
@@ -78,44 +85,158 @@ func (auth *Auth) RegisterUser(ctx context.Context, u User, loginKeys []Key) (*U
 		return nil, err
 	}
 
+	if u.VerifyToken != nil {
+		token, err := issueToken(ctx, tx, tokenKindVerifyEmail, &u.ID, auth.cfg.VerifyTokenTTL, nil)
+		if err != nil {
+			return nil, err
+		}
+		u.VerifyToken = &token
+	}
+
 	if err := tx.Commit(ctx); err != nil {
 		return nil, translateErr(err)
 	}
 
+	auth.recordEvent(ctx, EventUserRegistered, u.ID, map[string]any{"kind": u.Kind})
+
+	if u.VerifyToken != nil {
+		auth.sendVerification(ctx, u, *u.VerifyToken)
+	}
+
 	return &u, nil
 }
 
+func (auth *Auth) sendVerification(ctx context.Context, u User, token string) {
+	link := auth.baseURL.JoinPath("/verify").String()
+	link = withQuery(link, map[string]string{
+		"id":    u.ID,
+		"token": token,
+	})
+
+	auth.sendMail(ctx, mailVerifyEmail, u.Email, map[string]any{
+		"User": u.Clone(true),
+		"Link": link,
+	})
+}
+
+// VerifyUser marks the user as verified if the token was issued for the
+// user and has not expired or been used yet.
 func (auth *Auth) VerifyUser(ctx context.Context, userID, token string) (*User, error) {
+	tx, err := auth.conn.Begin(ctx)
+	if err != nil {
+		return nil, translateErr(err)
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	ut, err := consumeToken(ctx, tx, tokenKindVerifyEmail, strings.TrimSpace(token))
+	if err != nil {
+		return nil, err
+	} else if ut.UserID == nil || *ut.UserID != userID {
+		return nil, errors.NotFound
+	}
+
 	now := time.Now()
+	q, args, err := sq.Update("users").
+		Where(sq.Eq{"id": userID}).
+		Set("verified_at", now).
+		Set("updated_at", now).
+		PlaceholderFormat(sq.Dollar).ToSql()
+	if err != nil {
+		return nil, errors.InternalIssue.CausedBy(err)
+	}
+
+	if _, err := tx.Exec(ctx, q, args...); err != nil {
+		return nil, translateErr(err)
+	} else if err := tx.Commit(ctx); err != nil {
+		return nil, translateErr(err)
+	}
 
-	qb := sq.Update("users").
+	auth.recordEvent(ctx, EventUserVerified, userID, nil)
+	return auth.GetUser(ctx, NewAuthKey(KeyKindID, userID))
+}
+
+// ResendVerification issues a new verification token for the user with
+// the given email and sends it. Previously issued tokens are invalidated.
+// Nothing is sent if the user does not exist, is already verified or a
+// token was sent within the configured resend interval. No error is
+// returned in these cases so that callers cannot probe for registered
+// emails.
+func (auth *Auth) ResendVerification(ctx context.Context, email string) error {
+	u, err := auth.GetUser(ctx, NewAuthKey(KeyKindEmail, email))
+	if err != nil {
+		if errors.Is(err, errors.NotFound) {
+			return nil
+		}
+		return err
+	} else if u.VerifiedAt != nil {
+		return nil
+	}
+
+	tx, err := auth.conn.Begin(ctx)
+	if err != nil {
+		return translateErr(err)
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	now := time.Now()
+	q, args, err := sq.Update("users").
 		Where(sq.Eq{
-			"id":           userID,
-			"verify_token": token,
+			"id":          u.ID,
+			"verified_at": nil,
 		}).
-		Set("verified_at", now).
+		Where(sq.Or{
+			sq.Eq{"verify_sent_at": nil},
+			sq.Lt{"verify_sent_at": now.Add(-auth.cfg.VerifyResendInterval)},
+		}).
+		Set("verify_sent_at", now).
 		Set("updated_at", now).
-		Set("verify_token", sq.Expr("null"))
-
-	q, args, err := qb.PlaceholderFormat(sq.Dollar).ToSql()
+		PlaceholderFormat(sq.Dollar).ToSql()
 	if err != nil {
-		return nil, errors.InternalIssue.CausedBy(err)
+		return errors.InternalIssue.CausedBy(err)
 	}
 
-	tag, err := auth.conn.Exec(ctx, q, args...)
+	tag, err := tx.Exec(ctx, q, args...)
 	if err != nil {
-		return nil, translateErr(err)
+		return translateErr(err)
 	} else if tag.RowsAffected() == 0 {
-		return nil, errors.NotFound
+		log.Debug(ctx, "verification resend throttled", log.Fields{"user_id": u.ID})
+		return nil
 	}
 
-	return auth.GetUser(ctx, NewAuthKey(KeyKindID, userID))
+	token, err := issueToken(ctx, tx, tokenKindVerifyEmail, &u.ID, auth.cfg.VerifyTokenTTL, nil)
+	if err != nil {
+		return err
+	} else if err := tx.Commit(ctx); err != nil {
+		return translateErr(err)
+	}
+
+	auth.sendVerification(ctx, *u, token)
+	return nil
+}
+
+// checkLoginAllowed returns error if the user must not be allowed to
+// login based on current configurations.
+func (auth *Auth) checkLoginAllowed(u *User) error {
+	if u.DisabledAt != nil {
+		return errDisabled
+	} else if auth.cfg.RequireVerified && u.VerifiedAt == nil {
+		return errUnverified
+	}
+	return nil
 }
 
 func (auth *Auth) SetPassword(ctx context.Context, id, password string) error {
 	now := time.Now()
 
-	pwdHash, err := HashPassword(password)
+	u, err := auth.GetUser(ctx, NewAuthKey(KeyKindID, id))
+	if err != nil {
+		if errors.Is(err, errors.NotFound) {
+			return nil
+		}
+		return err
+	}
+
+	pwdHash, err := auth.HashPassword(password, *u)
 	if err != nil {
 		return err
 	}
@@ -129,8 +250,13 @@ func (auth *Auth) SetPassword(ctx context.Context, id, password string) error {
 		return errors.InternalIssue.CausedBy(err)
 	}
 
-	_, err = auth.conn.Exec(ctx, q, args...)
-	return translateErr(err)
+	tag, err := auth.conn.Exec(ctx, q, args...)
+	if err != nil {
+		return translateErr(err)
+	} else if tag.RowsAffected() > 0 {
+		auth.recordEvent(ctx, EventPasswordChanged, id, map[string]any{"method": "set"})
+	}
+	return nil
 }
 
 func (auth *Auth) SetUserData(ctx context.Context, id string, data UserData) error {
@@ -149,16 +275,63 @@ func (auth *Auth) SetUserData(ctx context.Context, id string, data UserData) err
 	return translateErr(err)
 }
 
+// HashPassword checks the password of the user against the configured
+// password policy and returns the hash created by the configured hasher.
+// The result can be used as the PwdHash value of the user.
+func (auth *Auth) HashPassword(pwd string, u User) (string, error) {
+	if err := auth.cfg.PasswordPolicy.Check(pwd, u.Username, u.Email); err != nil {
+		return "", err
+	}
+	return auth.hasher.Hash(pwd)
+}
+
+// upgradePasswordHash re-hashes the password of the user with the current
+// hasher if the stored hash uses an outdated scheme or weaker parameters.
+// Must be called only after the password has been verified. The update
+// is skipped if the hash was changed concurrently.
+func (auth *Auth) upgradePasswordHash(ctx context.Context, u *User, pwd string) error {
+	if u.PwdHash == nil || !needsRehash(auth.hasher, *u.PwdHash) {
+		return nil
+	}
+
+	newHash, err := auth.hasher.Hash(pwd)
+	if err != nil {
+		return err
+	}
+
+	q, args, err := sq.Update("users").
+		Where(sq.Eq{
+			"id":       u.ID,
+			"pwd_hash": *u.PwdHash,
+		}).
+		Set("pwd_hash", newHash).
+		PlaceholderFormat(sq.Dollar).ToSql()
+	if err != nil {
+		return errors.InternalIssue.CausedBy(err)
+	}
+
+	if _, err := auth.conn.Exec(ctx, q, args...); err != nil {
+		return translateErr(err)
+	}
+	u.PwdHash = &newHash
+	return nil
+}
+
 func insertUser(ctx context.Context, tx pgx.Tx, u User) error {
+	var verifySentAt *time.Time
+	if u.VerifyToken != nil {
+		verifySentAt = &u.CreatedAt
+	}
+
 	// Insert into users table.
 	colNames := []string{
 		"id", "kind", "user_data", "email", "pwd_hash", "username",
-		"created_at", "updated_at", "verify_token", "attributes",
+		"created_at", "updated_at", "verify_sent_at", "attributes", "phone",
 	}
 
 	colVals := []any{
 		u.ID, u.Kind, u.Data, u.Email, u.PwdHash, u.Username,
-		u.CreatedAt, u.UpdatedAt, u.VerifyToken, u.Attributes,
+		u.CreatedAt, u.UpdatedAt, verifySentAt, u.Attributes, u.Phone,
 	}
 
 	q, args, err := sq.Insert("users").Columns(colNames...).Values(colVals...).
@@ -0,0 +1,202 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"strings"
+	"time"
+
+	"github.com/spy16/pgbase/errors"
+)
+
+// KeyKindWebAuthn is the auth key kind used for storing passkeys. The key
+// is of the form 'webauthn/<base64url-credential-id>'.
+const KeyKindWebAuthn = "webauthn"
+
+const passkeyTimeout = 5 * time.Minute
+
+// PasskeyCreationOptions is the JSON serialisation of the options to be
+// passed to navigator.credentials.create().
+type PasskeyCreationOptions struct {
+	Challenge string `json:"challenge"`
+	RP        struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+	} `json:"rp"`
+	User struct {
+		ID          b64Bytes `json:"id"`
+		Name        string   `json:"name"`
+		DisplayName string   `json:"displayName"`
+	} `json:"user"`
+	PubKeyCredParams       []passkeyParam      `json:"pubKeyCredParams"`
+	Timeout                int64               `json:"timeout"`
+	Attestation            string              `json:"attestation"`
+	ExcludeCredentials     []passkeyDescriptor `json:"excludeCredentials"`
+	AuthenticatorSelection struct {
+		ResidentKey      string `json:"residentKey"`
+		UserVerification string `json:"userVerification"`
+	} `json:"authenticatorSelection"`
+}
+
+// PasskeyRequestOptions is the JSON serialisation of the options to be
+// passed to navigator.credentials.get().
+type PasskeyRequestOptions struct {
+	Challenge        string `json:"challenge"`
+	RPID             string `json:"rpId"`
+	Timeout          int64  `json:"timeout"`
+	UserVerification string `json:"userVerification"`
+}
+
+type passkeyParam struct {
+	Type string `json:"type"`
+	Alg  int    `json:"alg"`
+}
+
+type passkeyDescriptor struct {
+	Type string   `json:"type"`
+	ID   b64Bytes `json:"id"`
+}
+
+// BeginPasskeyRegistration starts the registration of a new passkey for
+// the user and returns the options for the browser.
+func (auth *Auth) BeginPasskeyRegistration(ctx context.Context, userID string) (*PasskeyCreationOptions, error) {
+	u, err := auth.GetUser(ctx, NewAuthKey(KeyKindID, userID))
+	if err != nil {
+		return nil, err
+	}
+
+	existing, err := listUserKeys(ctx, auth.conn, userID, KeyKindWebAuthn)
+	if err != nil {
+		return nil, err
+	}
+
+	challenge, err := issueToken(ctx, auth.conn, tokenKindPasskeyRegister, &u.ID, passkeyTimeout, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := &PasskeyCreationOptions{
+		Challenge:   challenge,
+		Timeout:     passkeyTimeout.Milliseconds(),
+		Attestation: "none",
+		PubKeyCredParams: []passkeyParam{
+			{Type: "public-key", Alg: coseAlgES256},
+			{Type: "public-key", Alg: coseAlgEdDSA},
+			{Type: "public-key", Alg: coseAlgRS256},
+		},
+		ExcludeCredentials: []passkeyDescriptor{},
+	}
+	opts.RP.ID = auth.cfg.WebAuthn.RPID
+	opts.RP.Name = auth.cfg.WebAuthn.RPName
+	opts.User.ID = b64Bytes(u.ID)
+	opts.User.Name = u.Email
+	opts.User.DisplayName = u.Username
+	opts.AuthenticatorSelection.ResidentKey = "required"
+	opts.AuthenticatorSelection.UserVerification = "required"
+
+	for _, k := range existing {
+		_, credID := SplitAuthKey(k.Key)
+		id, err := base64.RawURLEncoding.DecodeString(credID)
+		if err == nil {
+			opts.ExcludeCredentials = append(opts.ExcludeCredentials, passkeyDescriptor{
+				Type: "public-key",
+				ID:   id,
+			})
+		}
+	}
+
+	return opts, nil
+}
+
+// FinishPasskeyRegistration verifies the credential created by the browser
+// and stores it as a passkey of the user.
+func (auth *Auth) FinishPasskeyRegistration(ctx context.Context, userID, name string, cred PasskeyCredential) error {
+	cd, ad, err := auth.cfg.WebAuthn.verifyRegistration(cred)
+	if err != nil {
+		return err
+	}
+
+	ut, err := consumeToken(ctx, auth.conn, tokenKindPasskeyRegister, cd.Challenge)
+	if err != nil {
+		if errors.Is(err, errors.NotFound) {
+			return errBadCredential.Hintf("unknown challenge")
+		}
+		return err
+	} else if ut.UserID == nil || *ut.UserID != userID {
+		return errBadCredential.Hintf("challenge was issued to a different user")
+	}
+
+	name = strings.TrimSpace(name)
+	if name == "" {
+		name = "Passkey"
+	}
+
+	keyID := NewAuthKey(KeyKindWebAuthn, base64.RawURLEncoding.EncodeToString(ad.CredID))
+	return putUserKey(ctx, auth.conn, userID, keyID, passkeyKey{
+		Name:      name,
+		PublicKey: ad.PublicKey,
+		SignCount: ad.SignCount,
+		CreatedAt: time.Now().Unix(),
+	})
+}
+
+// BeginPasskeyLogin starts a passkey login and returns the options for the
+// browser. Only discoverable credentials are supported and hence no user
+// needs to be identified upfront.
+func (auth *Auth) BeginPasskeyLogin(ctx context.Context) (*PasskeyRequestOptions, error) {
+	challenge, err := issueToken(ctx, auth.conn, tokenKindPasskeyLogin, nil, passkeyTimeout, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return &PasskeyRequestOptions{
+		Challenge:        challenge,
+		RPID:             auth.cfg.WebAuthn.RPID,
+		Timeout:          passkeyTimeout.Milliseconds(),
+		UserVerification: "required",
+	}, nil
+}
+
+// FinishPasskeyLogin verifies the assertion created by the browser and
+// returns the user owning the passkey.
+func (auth *Auth) FinishPasskeyLogin(ctx context.Context, cred PasskeyCredential) (*User, error) {
+	var errLogin = errors.MissingAuth.Coded("invalid_credential")
+
+	keyID := NewAuthKey(KeyKindWebAuthn, base64.RawURLEncoding.EncodeToString(cred.RawID))
+	u, err := auth.GetUser(ctx, keyID)
+	if err != nil {
+		if errors.Is(err, errors.NotFound) {
+			return nil, errLogin.Hintf("unknown credential")
+		}
+		return nil, err
+	}
+
+	if len(cred.Response.UserHandle) > 0 && !bytes.Equal(cred.Response.UserHandle, []byte(u.ID)) {
+		return nil, errLogin.Hintf("user handle mismatch")
+	}
+
+	var stored passkeyKey
+	if err := getUserKey(ctx, auth.conn, u.ID, keyID, &stored); err != nil {
+		return nil, err
+	}
+
+	cd, ad, err := auth.cfg.WebAuthn.verifyAssertion(cred, stored)
+	if err != nil {
+		return nil, errLogin.CausedBy(err)
+	}
+
+	if _, err := consumeToken(ctx, auth.conn, tokenKindPasskeyLogin, cd.Challenge); err != nil {
+		if errors.Is(err, errors.NotFound) {
+			return nil, errLogin.Hintf("unknown challenge")
+		}
+		return nil, err
+	}
+
+	stored.SignCount = ad.SignCount
+	if err := putUserKey(ctx, auth.conn, u.ID, keyID, stored); err != nil {
+		return nil, err
+	}
+
+	return u, nil
+}
@@ -0,0 +1,162 @@
+package auth
+
+import (
+	"encoding/binary"
+	"math"
+
+	"github.com/spy16/pgbase/errors"
+)
+
+var errBadCBOR = errors.InvalidInput.Coded("bad_cbor")
+
+// decodeCBOR decodes a single CBOR (RFC 8949) data item from the data and
+// returns it along with the remaining bytes. Only the subset of CBOR used
+// by WebAuthn is supported: definite-length items, integers, byte and text
+// strings, arrays, maps, tags, booleans, null and floats. Maps are decoded
+// as map[any]any with int64 or string keys.
+func decodeCBOR(data []byte) (any, []byte, error) {
+	if len(data) == 0 {
+		return nil, nil, errBadCBOR.Hintf("unexpected end of data")
+	}
+
+	major, info := data[0]>>5, data[0]&0x1f
+	arg, rest, err := readCBORArg(info, data[1:])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch major {
+	case 0: // unsigned int
+		if arg > math.MaxInt64 {
+			return nil, nil, errBadCBOR.Hintf("integer overflow")
+		}
+		return int64(arg), rest, nil
+
+	case 1: // negative int
+		if arg > math.MaxInt64 {
+			return nil, nil, errBadCBOR.Hintf("integer overflow")
+		}
+		return -1 - int64(arg), rest, nil
+
+	case 2, 3: // byte string, text string
+		if uint64(len(rest)) < arg {
+			return nil, nil, errBadCBOR.Hintf("string length exceeds data")
+		}
+		b := append([]byte(nil), rest[:arg]...)
+		if major == 3 {
+			return string(b), rest[arg:], nil
+		}
+		return b, rest[arg:], nil
+
+	case 4: // array
+		if uint64(len(rest)) < arg {
+			return nil, nil, errBadCBOR.Hintf("array length exceeds data")
+		}
+		arr := make([]any, 0, arg)
+		for i := uint64(0); i < arg; i++ {
+			var item any
+			item, rest, err = decodeCBOR(rest)
+			if err != nil {
+				return nil, nil, err
+			}
+			arr = append(arr, item)
+		}
+		return arr, rest, nil
+
+	case 5: // map
+		if uint64(len(rest)) < arg {
+			return nil, nil, errBadCBOR.Hintf("map length exceeds data")
+		}
+		m := make(map[any]any, arg)
+		for i := uint64(0); i < arg; i++ {
+			var k, v any
+			k, rest, err = decodeCBOR(rest)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			switch k.(type) {
+			case int64, string:
+			default:
+				return nil, nil, errBadCBOR.Hintf("unsupported map key type")
+			}
+
+			v, rest, err = decodeCBOR(rest)
+			if err != nil {
+				return nil, nil, err
+			}
+			m[k] = v
+		}
+		return m, rest, nil
+
+	case 6: // tag, decoded as the tagged item itself.
+		return decodeCBOR(rest)
+
+	default: // simple values and floats.
+		switch info {
+		case 20:
+			return false, rest, nil
+		case 21:
+			return true, rest, nil
+		case 22, 23:
+			return nil, rest, nil
+		case 25:
+			return float64(halfToFloat(uint16(arg))), rest, nil
+		case 26:
+			return float64(math.Float32frombits(uint32(arg))), rest, nil
+		case 27:
+			return math.Float64frombits(arg), rest, nil
+		}
+		return nil, nil, errBadCBOR.Hintf("unsupported simple value %d", info)
+	}
+}
+
+func readCBORArg(info byte, data []byte) (uint64, []byte, error) {
+	switch {
+	case info < 24:
+		return uint64(info), data, nil
+
+	case info <= 27:
+		n := 1 << (info - 24)
+		if len(data) < n {
+			return 0, nil, errBadCBOR.Hintf("unexpected end of data")
+		}
+
+		var v uint64
+		switch n {
+		case 1:
+			v = uint64(data[0])
+		case 2:
+			v = uint64(binary.BigEndian.Uint16(data))
+		case 4:
+			v = uint64(binary.BigEndian.Uint32(data))
+		case 8:
+			v = binary.BigEndian.Uint64(data)
+		}
+		return v, data[n:], nil
+
+	default:
+		return 0, nil, errBadCBOR.Hintf("indefinite length items not supported")
+	}
+}
+
+func halfToFloat(h uint16) float32 {
+	sign := uint32(h>>15) << 31
+	exp := uint32(h>>10) & 0x1f
+	frac := uint32(h & 0x3ff)
+
+	switch exp {
+	case 0:
+		f := float32(frac) / (1 << 24)
+		if sign != 0 {
+			f = -f
+		}
+		return f
+
+	case 0x1f:
+		return math.Float32frombits(sign | 0x7f800000 | frac<<13)
+
+	default:
+		return math.Float32frombits(sign | (exp+112)<<23 | frac<<13)
+	}
+}
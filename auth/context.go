@@ -2,11 +2,24 @@ package auth
 
 import (
 	"context"
+	"net"
+	"net/http"
+
+	"github.com/go-chi/chi/v5/middleware"
 )
 
 type ctxKeyType string
 
-var ctxKey = ctxKeyType("auth_session")
+var (
+	ctxKey       = ctxKeyType("auth_session")
+	clientCtxKey = ctxKeyType("auth_client")
+)
+
+type clientInfo struct {
+	IP        string
+	UserAgent string
+	RequestID string
+}
 
 // NewCtx returns a new Go context with auth session injected.
 func NewCtx(ctx context.Context, session *Session) context.Context {
@@ -19,3 +32,54 @@ func CurSession(ctx context.Context) *Session {
 	v, _ := ctx.Value(ctxKey).(*Session)
 	return v
 }
+
+// withClient returns a new Go context with the client information from
+// the request injected.
+func withClient(ctx context.Context, r *http.Request) context.Context {
+	return context.WithValue(ctx, clientCtxKey, clientInfo{
+		IP:        clientIP(r),
+		UserAgent: r.UserAgent(),
+		RequestID: middleware.GetReqID(r.Context()),
+	})
+}
+
+// clientMiddleware injects the client information of the request into
+// the request context.
+func clientMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(withClient(r.Context(), r)))
+	})
+}
+
+// clientIP returns the IP address of the client that sent the request.
+func clientIP(r *http.Request) string {
+	ip := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+	return ip
+}
+
+func curClient(ctx context.Context) clientInfo {
+	v, _ := ctx.Value(clientCtxKey).(clientInfo)
+	return v
+}
+
+// RateLimitKey identifies the client of the request for rate-limiting.
+// Requests authenticated using an API key are identified by the key,
+// other authenticated requests by the user and the rest by client IP.
+// Must be used after the Authenticate middleware. The signature matches
+// ratelimit.KeyFunc.
+func RateLimitKey(r *http.Request) string {
+	sess := CurSession(r.Context())
+	switch {
+	case sess == nil:
+		return "ip:" + clientIP(r)
+
+	case sess.APIKeyID != "":
+		return "api_key:" + sess.APIKeyID
+
+	default:
+		return "user:" + sess.UserID
+	}
+}
@@ -0,0 +1,31 @@
+package auth
+
+// issuer returns the issuer identifier used in the tokens issued by the
+// auth module.
+func (auth *Auth) issuer() string {
+	return auth.baseURL.String()
+}
+
+// discoveryDoc returns the OpenID Connect discovery document that lets
+// other services locate the keys for verifying the tokens and lets OAuth
+// clients locate the endpoints of the authorization server.
+func (auth *Auth) discoveryDoc() map[string]any {
+	return map[string]any{
+		"issuer":                                auth.issuer(),
+		"jwks_uri":                              auth.baseURL.JoinPath("/.well-known/jwks.json").String(),
+		"authorization_endpoint":                auth.baseURL.JoinPath("/oauth/authorize").String(),
+		"token_endpoint":                        auth.baseURL.JoinPath("/oauth/token").String(),
+		"userinfo_endpoint":                     auth.baseURL.JoinPath("/oauth/userinfo").String(),
+		"scopes_supported":                      supportedScopes,
+		"response_types_supported":              []string{oauthResponseTypeCode},
+		"grant_types_supported":                 []string{grantTypeAuthCode, grantTypeRefreshToken},
+		"code_challenge_methods_supported":      []string{pkceMethodS256},
+		"token_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post", "none"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": auth.keys.algs(),
+		"claims_supported": []string{
+			"iss", "sub", "aud", "iat", "exp", "nonce", "typ", "tid", "kind", "roles", "perms", "org", "org_role",
+			"name", "picture", "preferred_username", "updated_at", "email", "email_verified",
+		},
+	}
+}
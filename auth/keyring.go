@@ -0,0 +1,236 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+
+	"github.com/golang-jwt/jwt/v4"
+
+	"github.com/spy16/pgbase/errors"
+	"github.com/spy16/pgbase/strutils"
+)
+
+// States of signing keys.
+const (
+	// KeyStateActive keys are used for signing new tokens and verifying.
+	// Exactly one key must be active.
+	KeyStateActive = "active"
+
+	// KeyStateVerifyOnly keys are used only for verifying tokens. New
+	// keys are introduced (before activation) and old keys are phased
+	// out (until issued tokens expire) in this state.
+	KeyStateVerifyOnly = "verify_only"
+
+	// KeyStateRetired keys are rejected. Tokens signed by them are no
+	// longer valid.
+	KeyStateRetired = "retired"
+)
+
+// defaultKeyID is the ID of the key derived from Config.SigningSecret.
+// Tokens without a 'kid' header (i.e., issued before keyring support)
+// are verified using the key with this ID.
+const defaultKeyID = "default"
+
+// SigningKey is a key used for signing session tokens. HS512 keys need
+// the Secret. RS256, ES256 and EdDSA keys need a PEM encoded private key
+// either inline or in a file, and their public keys are published in the
+// JWKS so that other services can verify tokens.
+type SigningKey struct {
+	ID             string `mapstructure:"id"`
+	Alg            string `mapstructure:"alg"`
+	State          string `mapstructure:"state"`
+	Secret         string `mapstructure:"secret"`
+	PrivateKey     string `mapstructure:"private_key"`
+	PrivateKeyFile string `mapstructure:"private_key_file"`
+}
+
+// keyring holds the signing keys and signs/verifies tokens with them.
+type keyring struct {
+	active *loadedKey
+	byID   map[string]*loadedKey
+	order  []string
+}
+
+type loadedKey struct {
+	SigningKey
+	method    jwt.SigningMethod
+	signKey   any
+	verifyKey any
+}
+
+func newKeyring(keys []SigningKey) (*keyring, error) {
+	kr := &keyring{byID: map[string]*loadedKey{}}
+
+	activeCount := 0
+	for _, k := range keys {
+		if k.ID == "" {
+			return nil, errors.InvalidInput.Hintf("signing keys must have an id")
+		} else if _, exists := kr.byID[k.ID]; exists {
+			return nil, errors.InvalidInput.Hintf("duplicate signing key id '%s'", k.ID)
+		}
+
+		lk, err := loadKey(k)
+		if err != nil {
+			return nil, err
+		}
+
+		switch k.State {
+		case KeyStateActive:
+			kr.active = lk
+			activeCount++
+
+		case KeyStateVerifyOnly, KeyStateRetired:
+
+		default:
+			return nil, errors.InvalidInput.Hintf("signing key '%s' has invalid state '%s'", k.ID, k.State)
+		}
+		kr.byID[k.ID] = lk
+		kr.order = append(kr.order, k.ID)
+	}
+
+	if activeCount != 1 {
+		return nil, errors.InvalidInput.Hintf("exactly one signing key must be active, found %d", activeCount)
+	}
+	return kr, nil
+}
+
+// sign signs the claims with the active key and sets the 'kid' header.
+func (kr *keyring) sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(kr.active.method, claims)
+	token.Header["kid"] = kr.active.ID
+
+	tokenString, err := token.SignedString(kr.active.signKey)
+	if err != nil {
+		return "", errors.InternalIssue.CausedBy(err)
+	}
+	return tokenString, nil
+}
+
+// keyFunc is a jwt.Keyfunc that returns the verification key for the
+// token based on its 'kid' header. The alg of the token must match the
+// alg of the key.
+func (kr *keyring) keyFunc(token *jwt.Token) (any, error) {
+	var errToken = errors.MissingAuth.Coded("invalid_token")
+
+	kid, _ := token.Header["kid"].(string)
+	if kid == "" {
+		kid = defaultKeyID
+	}
+
+	k, found := kr.byID[kid]
+	if !found {
+		return nil, errToken.Hintf("unknown kid '%s'", kid)
+	} else if k.State == KeyStateRetired {
+		return nil, errToken.Hintf("kid '%s' is retired", kid)
+	} else if token.Method.Alg() != k.method.Alg() {
+		return nil, errToken.Hintf("invalid alg=%s", token.Method.Alg())
+	}
+	return k.verifyKey, nil
+}
+
+// jwks returns the public keys of all the asymmetric keys that are not
+// retired.
+func (kr *keyring) jwks() jwkSet {
+	set := jwkSet{Keys: []jwk{}}
+	for _, id := range kr.order {
+		k := kr.byID[id]
+		if _, isHMAC := k.method.(*jwt.SigningMethodHMAC); isHMAC || k.State == KeyStateRetired {
+			continue
+		}
+
+		if jk, err := newPublicJWK(k.ID, k.method.Alg(), k.verifyKey); err == nil {
+			set.Keys = append(set.Keys, jk)
+		}
+	}
+	return set
+}
+
+// algs returns the signing algorithms in use, active key first.
+func (kr *keyring) algs() []string {
+	res := []string{kr.active.method.Alg()}
+	for _, id := range kr.order {
+		k := kr.byID[id]
+		if alg := k.method.Alg(); k.State != KeyStateRetired && !strutils.OneOf(alg, res) {
+			res = append(res, alg)
+		}
+	}
+	return res
+}
+
+func loadKey(k SigningKey) (*loadedKey, error) {
+	var errKey = errors.InvalidInput.Coded("invalid_signing_key")
+
+	if k.Alg == "" {
+		k.Alg = jwt.SigningMethodHS512.Alg()
+	}
+	lk := &loadedKey{SigningKey: k}
+
+	if k.Alg == jwt.SigningMethodHS512.Alg() {
+		if k.Secret == "" {
+			return nil, errKey.Hintf("key '%s' needs a secret", k.ID)
+		}
+		lk.method = jwt.SigningMethodHS512
+		lk.signKey = []byte(k.Secret)
+		lk.verifyKey = lk.signKey
+		return lk, nil
+	}
+
+	priv, err := readPrivateKey(k)
+	if err != nil {
+		return nil, errKey.CausedBy(err).Hintf("key '%s'", k.ID)
+	}
+
+	switch k.Alg {
+	case jwt.SigningMethodRS256.Alg():
+		rsaKey, ok := priv.(*rsa.PrivateKey)
+		if !ok {
+			return nil, errKey.Hintf("key '%s' is not an RSA key", k.ID)
+		}
+		lk.method, lk.signKey, lk.verifyKey = jwt.SigningMethodRS256, rsaKey, &rsaKey.PublicKey
+
+	case jwt.SigningMethodES256.Alg():
+		ecKey, ok := priv.(*ecdsa.PrivateKey)
+		if !ok || ecKey.Curve != elliptic.P256() {
+			return nil, errKey.Hintf("key '%s' is not a P-256 EC key", k.ID)
+		}
+		lk.method, lk.signKey, lk.verifyKey = jwt.SigningMethodES256, ecKey, &ecKey.PublicKey
+
+	case jwt.SigningMethodEdDSA.Alg():
+		edKey, ok := priv.(ed25519.PrivateKey)
+		if !ok {
+			return nil, errKey.Hintf("key '%s' is not an Ed25519 key", k.ID)
+		}
+		lk.method, lk.signKey, lk.verifyKey = jwt.SigningMethodEdDSA, edKey, edKey.Public()
+
+	default:
+		return nil, errKey.Hintf("key '%s' has unsupported alg '%s'", k.ID, k.Alg)
+	}
+	return lk, nil
+}
+
+func readPrivateKey(k SigningKey) (any, error) {
+	data := []byte(k.PrivateKey)
+	if k.PrivateKeyFile != "" {
+		var err error
+		if data, err = os.ReadFile(k.PrivateKeyFile); err != nil {
+			return nil, err
+		}
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+
+	if key, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	} else if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	return x509.ParseECPrivateKey(block.Bytes)
+}
@@ -0,0 +1,180 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeyring(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	claims := sessionClaims{
+		ID:        "sess1",
+		Kind:      "user",
+		Subject:   "user1",
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(time.Hour).Unix(),
+	}
+
+	verify := func(kr *keyring, token string) error {
+		_, err := jwt.ParseWithClaims(token, &sessionClaims{}, kr.keyFunc)
+		return err
+	}
+
+	old, err := newKeyring([]SigningKey{
+		{ID: "k1", Secret: "secret1", State: KeyStateActive},
+		{ID: "k2", Secret: "secret2", State: KeyStateVerifyOnly},
+	})
+	require.NoError(t, err)
+
+	oldToken, err := old.sign(&claims)
+	require.NoError(t, err)
+	assert.NoError(t, verify(old, oldToken))
+
+	// rotate: k2 becomes active, k1 keeps verifying live sessions.
+	rotated, err := newKeyring([]SigningKey{
+		{ID: "k1", Secret: "secret1", State: KeyStateVerifyOnly},
+		{ID: "k2", Secret: "secret2", State: KeyStateActive},
+	})
+	require.NoError(t, err)
+
+	newToken, err := rotated.sign(&claims)
+	require.NoError(t, err)
+	assert.NoError(t, verify(rotated, oldToken))
+	assert.NoError(t, verify(rotated, newToken))
+	assert.NoError(t, verify(old, newToken), "verify-only key must be accepted")
+
+	retired, err := newKeyring([]SigningKey{
+		{ID: "k1", Secret: "secret1", State: KeyStateRetired},
+		{ID: "k2", Secret: "secret2", State: KeyStateActive},
+	})
+	require.NoError(t, err)
+	assert.Error(t, verify(retired, oldToken))
+	assert.NoError(t, verify(retired, newToken))
+
+	// tokens without kid are verified with the default key.
+	legacy := jwt.NewWithClaims(jwt.SigningMethodHS512, &claims)
+	legacyToken, err := legacy.SignedString([]byte("legacy"))
+	require.NoError(t, err)
+
+	withDefault, err := newKeyring([]SigningKey{
+		{ID: defaultKeyID, Secret: "legacy", State: KeyStateVerifyOnly},
+		{ID: "k2", Secret: "secret2", State: KeyStateActive},
+	})
+	require.NoError(t, err)
+	assert.NoError(t, verify(withDefault, legacyToken))
+	assert.Error(t, verify(rotated, legacyToken))
+}
+
+func TestNewKeyring_Invalid(t *testing.T) {
+	t.Parallel()
+
+	table := map[string][]SigningKey{
+		"NoActive":     {{ID: "k1", Secret: "s", State: KeyStateVerifyOnly}},
+		"TwoActive":    {{ID: "k1", Secret: "s", State: KeyStateActive}, {ID: "k2", Secret: "s", State: KeyStateActive}},
+		"DuplicateID":  {{ID: "k1", Secret: "s", State: KeyStateActive}, {ID: "k1", Secret: "s", State: KeyStateRetired}},
+		"InvalidState": {{ID: "k1", Secret: "s", State: "unknown"}},
+		"EmptySecret":  {{ID: "k1", State: KeyStateActive}},
+	}
+
+	for name, keys := range table {
+		keys := keys
+		t.Run(name, func(t *testing.T) {
+			_, err := newKeyring(keys)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestKeyring_Asymmetric(t *testing.T) {
+	t.Parallel()
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	table := map[string]any{
+		"RS256": rsaKey,
+		"ES256": ecKey,
+		"EdDSA": edKey,
+	}
+
+	for alg, priv := range table {
+		alg, priv := alg, priv
+		t.Run(alg, func(t *testing.T) {
+			der, err := x509.MarshalPKCS8PrivateKey(priv)
+			require.NoError(t, err)
+			pemData := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+
+			kr, err := newKeyring([]SigningKey{
+				{ID: "asym", Alg: alg, PrivateKey: string(pemData), State: KeyStateActive},
+				{ID: "hmac", Secret: "secret", State: KeyStateVerifyOnly},
+			})
+			require.NoError(t, err)
+			assert.Equal(t, []string{alg, "HS512"}, kr.algs())
+
+			now := time.Now()
+			token, err := kr.sign(&sessionClaims{
+				ID:        "sess1",
+				Kind:      "user",
+				Subject:   "user1",
+				IssuedAt:  now.Unix(),
+				ExpiresAt: now.Add(time.Hour).Unix(),
+			})
+			require.NoError(t, err)
+
+			_, err = jwt.ParseWithClaims(token, &sessionClaims{}, kr.keyFunc)
+			assert.NoError(t, err)
+
+			// only the asymmetric key is published and it must be usable
+			// by third-parties for verifying the tokens.
+			set := kr.jwks()
+			require.Len(t, set.Keys, 1)
+			assert.Equal(t, "asym", set.Keys[0].Kid)
+			assert.Equal(t, alg, set.Keys[0].Alg)
+
+			pub, err := set.Keys[0].publicKey()
+			require.NoError(t, err)
+
+			_, err = jwt.ParseWithClaims(token, &sessionClaims{}, func(*jwt.Token) (any, error) {
+				return pub, nil
+			})
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestKeyring_AlgMismatch(t *testing.T) {
+	t.Parallel()
+
+	kr, err := newKeyring([]SigningKey{{ID: "k1", Secret: "secret", State: KeyStateActive}})
+	require.NoError(t, err)
+
+	// a token claiming a different alg for the same kid must be rejected.
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, &sessionClaims{
+		Kind: "user", Subject: "u", IssuedAt: 1, ExpiresAt: time.Now().Add(time.Hour).Unix(),
+	})
+	token.Header["kid"] = "k1"
+	signed, err := token.SignedString([]byte("secret"))
+	require.NoError(t, err)
+
+	_, err = jwt.ParseWithClaims(signed, &sessionClaims{}, kr.keyFunc)
+	assert.Error(t, err)
+}
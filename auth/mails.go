@@ -0,0 +1,82 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"embed"
+	"path"
+	"strings"
+	"text/template"
+
+	"github.com/spy16/pgbase/errors"
+	"github.com/spy16/pgbase/log"
+	"github.com/spy16/pgbase/mailer"
+)
+
+// Mail template names.
+const (
+	mailVerifyEmail   = "verify_email"
+	mailPasswordReset = "password_reset"
+	mailLoginNotice   = "login_notice"
+	mailOrgInvite     = "org_invite"
+	mailMagicLink     = "magic_link"
+	mailLoginCode     = "login_code"
+
+	mailEmailChange       = "email_change"
+	mailEmailChangeNotice = "email_change_notice"
+)
+
+//go:embed templates/*.tmpl
+var templatesFS embed.FS
+
+var mailTemplates = loadMailTemplates()
+
+func loadMailTemplates() map[string]*template.Template {
+	files, err := templatesFS.ReadDir("templates")
+	if err != nil {
+		panic(err)
+	}
+
+	res := map[string]*template.Template{}
+	for _, f := range files {
+		name := strings.TrimSuffix(f.Name(), path.Ext(f.Name()))
+		res[name] = template.Must(template.ParseFS(templatesFS, path.Join("templates", f.Name())))
+	}
+	return res
+}
+
+func renderMail(name, to string, data any) (*mailer.Message, error) {
+	tpl, found := mailTemplates[name]
+	if !found {
+		return nil, errors.InternalIssue.Hintf("no mail template named '%s'", name)
+	}
+
+	var subject, text bytes.Buffer
+	if err := tpl.ExecuteTemplate(&subject, "subject", data); err != nil {
+		return nil, errors.InternalIssue.CausedBy(err)
+	} else if err := tpl.ExecuteTemplate(&text, "text", data); err != nil {
+		return nil, errors.InternalIssue.CausedBy(err)
+	}
+
+	return &mailer.Message{
+		To:      []string{to},
+		Subject: strings.TrimSpace(subject.String()),
+		Text:    strings.TrimSpace(text.String()) + "\n",
+	}, nil
+}
+
+// sendMail renders the named template and delivers it using the mailer.
+// Delivery failures are logged and not returned since none of the flows
+// sending mails should fail because of it.
+func (auth *Auth) sendMail(ctx context.Context, name, to string, data any) {
+	msg, err := renderMail(name, to, data)
+	if err == nil {
+		err = auth.mailer.Send(ctx, *msg)
+	}
+
+	if err != nil {
+		log.Error(ctx, "failed to send mail", err, log.Fields{
+			"template": name,
+		})
+	}
+}
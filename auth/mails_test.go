@@ -0,0 +1,80 @@
+package auth
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRenderMail(t *testing.T) {
+	t.Parallel()
+
+	u := NewUser("user", "bob", "bob@bobmail.com")
+	data := map[string]any{
+		"User":      u,
+		"Link":      "http://localhost/verify?token=foo",
+		"Token":     "foo",
+		"Time":      time.Now(),
+		"ExpiresAt": time.Now(),
+		"Client":    clientInfo{IP: "127.0.0.1", UserAgent: "test"},
+		"Email":     u.Email,
+		"Code":      "123456",
+		"NewEmail":  "bobby@bobmail.com",
+		"OrgName":   "Acme",
+		"Role":      OrgRoleMember,
+	}
+
+	for name := range mailTemplates {
+		t.Run(name, func(t *testing.T) {
+			msg, err := renderMail(name, u.Email, data)
+			require.NoError(t, err)
+			assert.NoError(t, msg.Validate())
+			assert.NotContains(t, msg.Subject, "\n")
+		})
+	}
+
+	_, err := renderMail("unknown", u.Email, data)
+	assert.Error(t, err)
+}
+
+func TestRenderMail_passwordReset(t *testing.T) {
+	t.Parallel()
+
+	u := NewUser("user", "bob", "bob@bobmail.com")
+
+	table := []struct {
+		title   string
+		link    string
+		want    string
+		notWant string
+	}{
+		{
+			title:   "WithLink",
+			link:    "http://localhost/reset?token=s3cr3t",
+			want:    "http://localhost/reset?token=s3cr3t",
+			notWant: "Use the following token",
+		},
+		{
+			title:   "WithoutLink",
+			want:    "s3cr3t",
+			notWant: "Open the link",
+		},
+	}
+
+	for _, tt := range table {
+		t.Run(tt.title, func(t *testing.T) {
+			msg, err := renderMail(mailPasswordReset, u.Email, map[string]any{
+				"User":      u,
+				"Link":      tt.link,
+				"Token":     "s3cr3t",
+				"ExpiresAt": time.Now(),
+			})
+			require.NoError(t, err)
+			assert.Equal(t, u.Email, msg.To[0])
+			assert.Contains(t, msg.Text, tt.want)
+			assert.NotContains(t, msg.Text, tt.notWant)
+		})
+	}
+}
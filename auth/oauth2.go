@@ -20,6 +20,7 @@ type oauth2FlowState struct {
 	Provider   string `json:"provider"`
 	Session    string `json:"goth_session"`
 	RedirectTo string `json:"redirect_to"`
+	LinkUserID string `json:"link_user_id,omitempty"`
 }
 
 func setOAuthFlowState(w http.ResponseWriter, state *oauth2FlowState) {
@@ -0,0 +1,423 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/markbates/goth"
+	"golang.org/x/oauth2"
+
+	"github.com/spy16/pgbase/errors"
+	"github.com/spy16/pgbase/strutils"
+)
+
+const (
+	oidcDiscoveryPath = "/.well-known/openid-configuration"
+	oidcJWKSRefresh   = 1 * time.Minute
+)
+
+var errIDToken = errors.MissingAuth.Coded("invalid_id_token")
+
+// OIDCConf holds the configuration of a generic OpenID Connect provider.
+// DiscoveryURL can be the issuer URL or the full URL of the discovery
+// document.
+type OIDCConf struct {
+	DiscoveryURL string   `mapstructure:"discovery_url"`
+	ClientID     string   `mapstructure:"client_id"`
+	ClientSecret string   `mapstructure:"client_secret"`
+	Scopes       []string `mapstructure:"scopes"`
+
+	// AutoLinkVerifiedEmail links identities of the provider to existing
+	// users by email when the ID token has 'email_verified' set. Any
+	// provider can assert any email, so this must be enabled only for
+	// providers that own the email domains of their users.
+	AutoLinkVerifiedEmail bool `mapstructure:"auto_link_verified_email"`
+}
+
+type oidcMetadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	UserInfoEndpoint      string `json:"userinfo_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// newOIDCProvider returns a goth provider for the OIDC provider. Discovery
+// document and keys are fetched lazily on first use.
+func newOIDCProvider(name, callbackURL string, conf OIDCConf) *oidcProvider {
+	scopes := conf.Scopes
+	if !strutils.OneOf("openid", scopes) {
+		scopes = append([]string{"openid"}, scopes...)
+	}
+	conf.Scopes = scopes
+
+	return &oidcProvider{
+		name:        name,
+		conf:        conf,
+		callbackURL: callbackURL,
+		client:      &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// oidcProvider implements goth.Provider for OpenID Connect providers using
+// the authorization code flow with PKCE and nonce validation.
+type oidcProvider struct {
+	name        string
+	conf        OIDCConf
+	callbackURL string
+	client      *http.Client
+
+	mu          sync.Mutex
+	meta        *oidcMetadata
+	keys        map[string]any
+	keysFetched time.Time
+}
+
+func (p *oidcProvider) Name() string { return p.name }
+
+func (p *oidcProvider) SetName(name string) { p.name = name }
+
+func (p *oidcProvider) Debug(_ bool) {}
+
+func (p *oidcProvider) RefreshTokenAvailable() bool { return true }
+
+func (p *oidcProvider) BeginAuth(state string) (goth.Session, error) {
+	cfg, err := p.oauth2Config()
+	if err != nil {
+		return nil, err
+	}
+
+	verifier := newSecretToken()
+	challenge := sha256.Sum256([]byte(verifier))
+	nonce := newSecretToken()
+
+	authURL := cfg.AuthCodeURL(state,
+		oauth2.SetAuthURLParam("nonce", nonce),
+		oauth2.SetAuthURLParam("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:])),
+		oauth2.SetAuthURLParam("code_challenge_method", "S256"),
+	)
+
+	return &oidcSession{
+		AuthURL:      authURL,
+		Nonce:        nonce,
+		CodeVerifier: verifier,
+	}, nil
+}
+
+func (p *oidcProvider) UnmarshalSession(data string) (goth.Session, error) {
+	var sess oidcSession
+	if err := json.Unmarshal([]byte(data), &sess); err != nil {
+		return nil, err
+	}
+	return &sess, nil
+}
+
+func (p *oidcProvider) FetchUser(session goth.Session) (goth.User, error) {
+	sess, ok := session.(*oidcSession)
+	if !ok || sess.IDToken == "" {
+		return goth.User{}, errors.InvalidInput.Hintf("session is not authorized")
+	}
+
+	claims := map[string]any{}
+	for k, v := range sess.Claims {
+		claims[k] = v
+	}
+
+	meta, err := p.discover()
+	if err != nil {
+		return goth.User{}, err
+	}
+
+	if meta.UserInfoEndpoint != "" && sess.AccessToken != "" {
+		info, err := p.fetchUserInfo(meta.UserInfoEndpoint, sess.AccessToken)
+		if err != nil {
+			return goth.User{}, err
+		} else if info["sub"] != claims["sub"] {
+			return goth.User{}, errIDToken.Hintf("userinfo subject mismatch")
+		}
+
+		for k, v := range info {
+			if _, exists := claims[k]; !exists {
+				claims[k] = v
+			}
+		}
+	}
+
+	str := func(key string) string {
+		s, _ := claims[key].(string)
+		return s
+	}
+
+	nickName := str("nickname")
+	if nickName == "" {
+		nickName = str("preferred_username")
+	}
+
+	return goth.User{
+		RawData:      claims,
+		Provider:     p.name,
+		Email:        str("email"),
+		Name:         str("name"),
+		FirstName:    str("given_name"),
+		LastName:     str("family_name"),
+		NickName:     nickName,
+		UserID:       str("sub"),
+		AvatarURL:    str("picture"),
+		Location:     str("locale"),
+		AccessToken:  sess.AccessToken,
+		RefreshToken: sess.RefreshToken,
+		ExpiresAt:    sess.ExpiresAt,
+		IDToken:      sess.IDToken,
+	}, nil
+}
+
+func (p *oidcProvider) RefreshToken(refreshToken string) (*oauth2.Token, error) {
+	cfg, err := p.oauth2Config()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := goth.ContextForClient(p.client)
+	return cfg.TokenSource(ctx, &oauth2.Token{RefreshToken: refreshToken}).Token()
+}
+
+func (p *oidcProvider) oauth2Config() (*oauth2.Config, error) {
+	meta, err := p.discover()
+	if err != nil {
+		return nil, err
+	}
+
+	return &oauth2.Config{
+		ClientID:     p.conf.ClientID,
+		ClientSecret: p.conf.ClientSecret,
+		RedirectURL:  p.callbackURL,
+		Scopes:       p.conf.Scopes,
+		Endpoint: oauth2.Endpoint{
+			AuthURL:  meta.AuthorizationEndpoint,
+			TokenURL: meta.TokenEndpoint,
+		},
+	}, nil
+}
+
+// discover fetches and caches the discovery document of the provider.
+func (p *oidcProvider) discover() (*oidcMetadata, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.meta != nil {
+		return p.meta, nil
+	}
+
+	issuer := strings.TrimSuffix(p.conf.DiscoveryURL, oidcDiscoveryPath)
+	issuer = strings.TrimSuffix(issuer, "/")
+
+	var meta oidcMetadata
+	if err := p.getJSON(issuer+oidcDiscoveryPath, "", &meta); err != nil {
+		return nil, err
+	}
+
+	if strings.TrimSuffix(meta.Issuer, "/") != issuer {
+		return nil, errors.InvalidInput.Coded("invalid_discovery").
+			Hintf("issuer '%s' does not match '%s'", meta.Issuer, issuer)
+	} else if meta.AuthorizationEndpoint == "" || meta.TokenEndpoint == "" || meta.JWKSURI == "" {
+		return nil, errors.InvalidInput.Coded("invalid_discovery").
+			Hintf("required endpoints missing")
+	}
+
+	p.meta = &meta
+	return p.meta, nil
+}
+
+// publicKey returns the signing key with given key-id from the JWKS of
+// the provider. Keys are re-fetched if the key-id is unknown, but not
+// more often than oidcJWKSRefresh.
+func (p *oidcProvider) publicKey(kid string) (any, error) {
+	meta, err := p.discover()
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if key, found := p.keys[kid]; found {
+		return key, nil
+	} else if time.Since(p.keysFetched) < oidcJWKSRefresh {
+		return nil, errIDToken.Hintf("unknown kid '%s'", kid)
+	}
+
+	var set jwkSet
+	if err := p.getJSON(meta.JWKSURI, "", &set); err != nil {
+		return nil, err
+	}
+
+	p.keys = map[string]any{}
+	p.keysFetched = time.Now()
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+
+		pub, err := k.publicKey()
+		if err != nil {
+			continue
+		}
+		p.keys[k.Kid] = pub
+	}
+
+	if key, found := p.keys[kid]; found {
+		return key, nil
+	}
+	return nil, errIDToken.Hintf("unknown kid '%s'", kid)
+}
+
+// verifyIDToken verifies the signature and standard claims of the ID
+// token and returns the claims.
+// Refer https://openid.net/specs/openid-connect-core-1_0.html#IDTokenValidation
+func (p *oidcProvider) verifyIDToken(idToken, nonce string) (jwt.MapClaims, error) {
+	meta, err := p.discover()
+	if err != nil {
+		return nil, err
+	}
+
+	keyFn := func(tok *jwt.Token) (any, error) {
+		switch tok.Method.(type) {
+		case *jwt.SigningMethodRSA, *jwt.SigningMethodECDSA, *jwt.SigningMethodRSAPSS, *jwt.SigningMethodEd25519:
+		default:
+			return nil, errIDToken.Hintf("unsupported alg=%s", tok.Method.Alg())
+		}
+
+		kid, _ := tok.Header["kid"].(string)
+		return p.publicKey(kid)
+	}
+
+	var claims jwt.MapClaims
+	tok, err := jwt.ParseWithClaims(idToken, &claims, keyFn)
+	if err != nil || !tok.Valid {
+		return nil, errIDToken.CausedBy(err)
+	}
+
+	if !claims.VerifyIssuer(meta.Issuer, true) {
+		return nil, errIDToken.Hintf("issuer mismatch")
+	} else if !claims.VerifyAudience(p.conf.ClientID, true) {
+		return nil, errIDToken.Hintf("audience mismatch")
+	} else if !claims.VerifyExpiresAt(time.Now().Unix(), true) {
+		return nil, errIDToken.Hintf("token expired")
+	} else if n, _ := claims["nonce"].(string); n == "" || n != nonce {
+		return nil, errIDToken.Hintf("nonce mismatch")
+	} else if sub, _ := claims["sub"].(string); sub == "" {
+		return nil, errIDToken.Hintf("empty sub claim")
+	}
+
+	if aud, isList := claims["aud"].([]any); isList && len(aud) > 1 {
+		if azp, _ := claims["azp"].(string); azp != p.conf.ClientID {
+			return nil, errIDToken.Hintf("authorized party mismatch")
+		}
+	}
+
+	return claims, nil
+}
+
+func (p *oidcProvider) fetchUserInfo(endpoint, accessToken string) (map[string]any, error) {
+	info := map[string]any{}
+	if err := p.getJSON(endpoint, accessToken, &info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+func (p *oidcProvider) getJSON(u, bearer string, into any) error {
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return errors.InternalIssue.CausedBy(err)
+	}
+	req.Header.Set("Accept", "application/json")
+	if bearer != "" {
+		req.Header.Set(headerAuthz, bearerPrefix+bearer)
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return errors.InternalIssue.CausedBy(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.InternalIssue.Hintf("GET %s returned status %d", u, resp.StatusCode)
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(into); err != nil {
+		return errors.InternalIssue.CausedBy(err)
+	}
+	return nil
+}
+
+// oidcSession implements goth.Session for oidcProvider.
+type oidcSession struct {
+	AuthURL      string         `json:"auth_url"`
+	Nonce        string         `json:"nonce"`
+	CodeVerifier string         `json:"code_verifier"`
+	AccessToken  string         `json:"access_token,omitempty"`
+	RefreshToken string         `json:"refresh_token,omitempty"`
+	ExpiresAt    time.Time      `json:"expires_at,omitempty"`
+	IDToken      string         `json:"id_token,omitempty"`
+	Claims       map[string]any `json:"claims,omitempty"`
+}
+
+func (s *oidcSession) GetAuthURL() (string, error) {
+	if s.AuthURL == "" {
+		return "", errors.New(goth.NoAuthUrlErrorMessage)
+	}
+	return s.AuthURL, nil
+}
+
+func (s *oidcSession) Marshal() string {
+	b, _ := json.Marshal(s)
+	return string(b)
+}
+
+// Authorize exchanges the authorization code for tokens and validates the
+// ID token.
+func (s *oidcSession) Authorize(provider goth.Provider, params goth.Params) (string, error) {
+	p, ok := provider.(*oidcProvider)
+	if !ok {
+		return "", errors.InternalIssue.Hintf("provider is not an oidc provider")
+	}
+
+	cfg, err := p.oauth2Config()
+	if err != nil {
+		return "", err
+	}
+
+	ctx, cancel := context.WithTimeout(goth.ContextForClient(p.client), p.client.Timeout)
+	defer cancel()
+
+	tok, err := cfg.Exchange(ctx, params.Get("code"), oauth2.SetAuthURLParam("code_verifier", s.CodeVerifier))
+	if err != nil {
+		return "", errors.MissingAuth.Coded("code_exchange_failed").CausedBy(err)
+	}
+
+	idToken, _ := tok.Extra("id_token").(string)
+	if idToken == "" {
+		return "", errIDToken.Hintf("no id_token in token response")
+	}
+
+	claims, err := p.verifyIDToken(idToken, s.Nonce)
+	if err != nil {
+		return "", err
+	}
+
+	s.AccessToken = tok.AccessToken
+	s.RefreshToken = tok.RefreshToken
+	s.ExpiresAt = tok.Expiry
+	s.IDToken = idToken
+	s.Claims = claims
+	return tok.AccessToken, nil
+}
@@ -0,0 +1,235 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOIDCProvider(t *testing.T) {
+	t.Parallel()
+
+	idp := newFakeIDP(t)
+	p := newOIDCProvider("corp", "http://localhost/oauth2/cb", OIDCConf{
+		DiscoveryURL: idp.srv.URL,
+		ClientID:     "client1",
+		ClientSecret: "secret1",
+		Scopes:       []string{"email", "profile"},
+	})
+
+	authorize := func(t *testing.T, mutate func(claims jwt.MapClaims)) (*oidcSession, error) {
+		sess, err := p.BeginAuth("state1")
+		require.NoError(t, err)
+
+		authURL, err := sess.GetAuthURL()
+		require.NoError(t, err)
+
+		u, err := url.Parse(authURL)
+		require.NoError(t, err)
+		q := u.Query()
+		assert.Equal(t, "state1", q.Get("state"))
+		assert.Equal(t, "S256", q.Get("code_challenge_method"))
+		assert.Equal(t, "openid email profile", q.Get("scope"))
+
+		code := idp.authorize(q.Get("nonce"), q.Get("code_challenge"), mutate)
+
+		restored, err := p.UnmarshalSession(sess.Marshal())
+		require.NoError(t, err)
+
+		_, err = restored.Authorize(p, url.Values{"code": {code}})
+		return restored.(*oidcSession), err
+	}
+
+	t.Run("Success", func(t *testing.T) {
+		sess, err := authorize(t, nil)
+		require.NoError(t, err)
+
+		gu, err := p.FetchUser(sess)
+		require.NoError(t, err)
+		assert.Equal(t, "corp", gu.Provider)
+		assert.Equal(t, "user123", gu.UserID)
+		assert.Equal(t, "bob@bobmail.com", gu.Email)
+		assert.Equal(t, "Bob", gu.Name)
+		assert.Equal(t, "bobby", gu.NickName)
+		assert.Equal(t, "access-token", gu.AccessToken)
+		assert.Equal(t, true, gu.RawData["email_verified"])
+	})
+
+	t.Run("NonceMismatch", func(t *testing.T) {
+		_, err := authorize(t, func(claims jwt.MapClaims) { claims["nonce"] = "other" })
+		assert.Error(t, err)
+	})
+
+	t.Run("AudienceMismatch", func(t *testing.T) {
+		_, err := authorize(t, func(claims jwt.MapClaims) { claims["aud"] = "client2" })
+		assert.Error(t, err)
+	})
+
+	t.Run("IssuerMismatch", func(t *testing.T) {
+		_, err := authorize(t, func(claims jwt.MapClaims) { claims["iss"] = "https://evil.com" })
+		assert.Error(t, err)
+	})
+
+	t.Run("Expired", func(t *testing.T) {
+		_, err := authorize(t, func(claims jwt.MapClaims) { claims["exp"] = time.Now().Add(-time.Minute).Unix() })
+		assert.Error(t, err)
+	})
+
+	t.Run("BadVerifier", func(t *testing.T) {
+		sess, err := p.BeginAuth("state1")
+		require.NoError(t, err)
+
+		code := idp.authorize("nonce", "not-the-challenge", nil)
+		_, err = sess.Authorize(p, url.Values{"code": {code}})
+		assert.Error(t, err)
+	})
+}
+
+// fakeIDP is a minimal stand-in OpenID Connect provider.
+type fakeIDP struct {
+	t   *testing.T
+	srv *httptest.Server
+	key *rsa.PrivateKey
+
+	mu    sync.Mutex
+	codes map[string]fakeGrant
+}
+
+type fakeGrant struct {
+	nonce     string
+	challenge string
+	mutate    func(claims jwt.MapClaims)
+}
+
+func newFakeIDP(t *testing.T) *fakeIDP {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	idp := &fakeIDP{t: t, key: key, codes: map[string]fakeGrant{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(oidcDiscoveryPath, func(w http.ResponseWriter, r *http.Request) {
+		writeTestJSON(w, map[string]any{
+			"issuer":                 idp.srv.URL,
+			"authorization_endpoint": idp.srv.URL + "/authorize",
+			"token_endpoint":         idp.srv.URL + "/token",
+			"userinfo_endpoint":      idp.srv.URL + "/userinfo",
+			"jwks_uri":               idp.srv.URL + "/jwks",
+		})
+	})
+
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		writeTestJSON(w, jwkSet{Keys: []jwk{{
+			Kty: "RSA",
+			Kid: "key1",
+			Use: "sig",
+			Alg: "RS256",
+			N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		_ = r.ParseForm()
+
+		idp.mu.Lock()
+		grant, found := idp.codes[r.PostForm.Get("code")]
+		delete(idp.codes, r.PostForm.Get("code"))
+		idp.mu.Unlock()
+
+		sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+		if !found || base64.RawURLEncoding.EncodeToString(sum[:]) != grant.challenge {
+			w.WriteHeader(http.StatusBadRequest)
+			writeTestJSON(w, map[string]any{"error": "invalid_grant"})
+			return
+		}
+
+		claims := jwt.MapClaims{
+			"iss":            idp.srv.URL,
+			"sub":            "user123",
+			"aud":            "client1",
+			"exp":            time.Now().Add(time.Hour).Unix(),
+			"iat":            time.Now().Unix(),
+			"nonce":          grant.nonce,
+			"email":          "bob@bobmail.com",
+			"email_verified": true,
+			"name":           "Bob",
+		}
+		if grant.mutate != nil {
+			grant.mutate(claims)
+		}
+
+		tok := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+		tok.Header["kid"] = "key1"
+		idToken, err := tok.SignedString(key)
+		require.NoError(t, err)
+
+		writeTestJSON(w, map[string]any{
+			"access_token": "access-token",
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+			"id_token":     idToken,
+		})
+	})
+
+	mux.HandleFunc("/userinfo", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(headerAuthz) != bearerPrefix+"access-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		writeTestJSON(w, map[string]any{
+			"sub":                "user123",
+			"preferred_username": "bobby",
+		})
+	})
+
+	idp.srv = httptest.NewServer(mux)
+	t.Cleanup(idp.srv.Close)
+	return idp
+}
+
+func (idp *fakeIDP) authorize(nonce, challenge string, mutate func(claims jwt.MapClaims)) string {
+	code := newSecretToken()
+
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	idp.codes[code] = fakeGrant{nonce: nonce, challenge: challenge, mutate: mutate}
+	return code
+}
+
+func writeTestJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func TestConfig_autoLinkEnabled(t *testing.T) {
+	t.Parallel()
+
+	cfg := Config{
+		Google: OAuthConf{AutoLinkVerifiedEmail: true},
+		OIDC: map[string]OIDCConf{
+			"corp":  {AutoLinkVerifiedEmail: true},
+			"other": {},
+		},
+	}
+
+	assert.True(t, cfg.autoLinkEnabled("google"))
+	assert.False(t, cfg.autoLinkEnabled("github"))
+	assert.True(t, cfg.autoLinkEnabled("corp"))
+	assert.False(t, cfg.autoLinkEnabled("other"))
+	assert.False(t, cfg.autoLinkEnabled("unknown"))
+	assert.False(t, Config{}.autoLinkEnabled("google"), "must be off by default")
+}
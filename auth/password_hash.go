@@ -0,0 +1,265 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/spy16/pgbase/errors"
+)
+
+// Password hashing schemes supported out of the box.
+const (
+	SchemeArgon2id = "argon2id"
+	SchemeBcrypt   = "bcrypt"
+)
+
+var errBadHash = errors.InternalIssue.Coded("bad_password_hash")
+
+// PasswordHasher implementations hash passwords using a specific scheme.
+// Hashes must be self-describing (e.g., PHC string format) so that the
+// scheme and parameters can be recovered from the stored hash.
+type PasswordHasher interface {
+	// IDs returns the identifiers of the scheme as they appear in the
+	// first '$' delimited field of the encoded hash.
+	IDs() []string
+
+	// Hash returns the encoded hash of the password.
+	Hash(pwd string) (string, error)
+
+	// Verify returns true if the password matches the encoded hash.
+	Verify(pwd, encoded string) (bool, error)
+
+	// NeedsRehash returns true if the encoded hash (of this scheme) was
+	// created using weaker parameters than the ones of the hasher.
+	NeedsRehash(encoded string) bool
+}
+
+// PasswordHashConf configures the scheme used for hashing new passwords.
+// Hashes of other supported schemes are still verified and upgraded to
+// this scheme on login.
+type PasswordHashConf struct {
+	Scheme     string         `mapstructure:"scheme"`
+	Argon2id   Argon2idHasher `mapstructure:"argon2id"`
+	BcryptCost int            `mapstructure:"bcrypt_cost"`
+}
+
+func (conf *PasswordHashConf) hasher() (PasswordHasher, error) {
+	switch conf.Scheme {
+	case "", SchemeArgon2id:
+		h := conf.Argon2id
+		h.sanitise()
+		return h, nil
+
+	case SchemeBcrypt:
+		cost := conf.BcryptCost
+		if cost <= 0 {
+			cost = defaultBcryptCost
+		}
+		return BcryptHasher{Cost: cost}, nil
+
+	default:
+		return nil, errors.InvalidInput.Hintf("password hashing scheme '%s' is not supported", conf.Scheme)
+	}
+}
+
+var (
+	hashersMu       sync.RWMutex
+	defaultHasher   = PasswordHasher(defaultArgon2id())
+	passwordHashers = map[string]PasswordHasher{}
+)
+
+func init() {
+	RegisterPasswordHasher(defaultHasher)
+	RegisterPasswordHasher(BcryptHasher{Cost: defaultBcryptCost})
+}
+
+// RegisterPasswordHasher makes the hasher available for verifying hashes
+// of its scheme. Registering a hasher with the same ID replaces the old.
+func RegisterPasswordHasher(h PasswordHasher) {
+	hashersMu.Lock()
+	defer hashersMu.Unlock()
+
+	for _, id := range h.IDs() {
+		passwordHashers[id] = h
+	}
+}
+
+// verifyPassword verifies the password against the encoded hash using the
+// hasher registered for the scheme of the hash.
+func verifyPassword(pwd, encoded string) (bool, error) {
+	hashersMu.RLock()
+	h, found := passwordHashers[hashScheme(encoded)]
+	hashersMu.RUnlock()
+
+	if !found {
+		return false, errBadHash.Hintf("unsupported hash scheme '%s'", hashScheme(encoded))
+	}
+	return h.Verify(pwd, encoded)
+}
+
+// needsRehash returns true if the encoded hash must be replaced with the
+// hash generated by the given hasher.
+func needsRehash(h PasswordHasher, encoded string) bool {
+	scheme := hashScheme(encoded)
+	for _, id := range h.IDs() {
+		if id == scheme {
+			return h.NeedsRehash(encoded)
+		}
+	}
+	return true
+}
+
+// hashScheme returns the identifier field of the encoded hash.
+func hashScheme(encoded string) string {
+	parts := strings.SplitN(encoded, "$", 3)
+	if len(parts) < 3 || parts[0] != "" {
+		return ""
+	}
+	return parts[1]
+}
+
+// Argon2idHasher hashes passwords using argon2id and encodes them in PHC
+// string format: $argon2id$v=19$m=<memory>,t=<time>,p=<threads>$<salt>$<hash>.
+type Argon2idHasher struct {
+	Time    uint32 `mapstructure:"time"`
+	Memory  uint32 `mapstructure:"memory"` // in KiB
+	Threads uint8  `mapstructure:"threads"`
+	KeyLen  uint32 `mapstructure:"key_len"`
+	SaltLen uint32 `mapstructure:"salt_len"`
+}
+
+// defaultArgon2id returns the hasher with the parameters recommended by
+// OWASP (19 MiB memory, 2 iterations, 1 degree of parallelism).
+func defaultArgon2id() Argon2idHasher {
+	var h Argon2idHasher
+	h.sanitise()
+	return h
+}
+
+func (h *Argon2idHasher) sanitise() {
+	if h.Time == 0 {
+		h.Time = 2
+	}
+	if h.Memory == 0 {
+		h.Memory = 19 * 1024
+	}
+	if h.Threads == 0 {
+		h.Threads = 1
+	}
+	if h.KeyLen == 0 {
+		h.KeyLen = 32
+	}
+	if h.SaltLen == 0 {
+		h.SaltLen = 16
+	}
+}
+
+func (h Argon2idHasher) IDs() []string { return []string{SchemeArgon2id} }
+
+func (h Argon2idHasher) Hash(pwd string) (string, error) {
+	salt := make([]byte, h.SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", errors.InternalIssue.CausedBy(err)
+	}
+
+	key := argon2.IDKey([]byte(pwd), salt, h.Time, h.Memory, h.Threads, h.KeyLen)
+	return fmt.Sprintf("$%s$v=%d$m=%d,t=%d,p=%d$%s$%s", SchemeArgon2id, argon2.Version,
+		h.Memory, h.Time, h.Threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+func (h Argon2idHasher) Verify(pwd, encoded string) (bool, error) {
+	params, salt, key, err := decodeArgon2id(encoded)
+	if err != nil {
+		return false, err
+	}
+
+	computed := argon2.IDKey([]byte(pwd), salt, params.Time, params.Memory, params.Threads, params.KeyLen)
+	return subtle.ConstantTimeCompare(computed, key) == 1, nil
+}
+
+func (h Argon2idHasher) NeedsRehash(encoded string) bool {
+	params, salt, _, err := decodeArgon2id(encoded)
+	if err != nil {
+		return true
+	}
+	return params.Time < h.Time || params.Memory < h.Memory || params.Threads < h.Threads ||
+		params.KeyLen < h.KeyLen || uint32(len(salt)) < h.SaltLen
+}
+
+func decodeArgon2id(encoded string) (Argon2idHasher, []byte, []byte, error) {
+	var params Argon2idHasher
+
+	// "", "argon2id", "v=19", "m=..,t=..,p=..", salt, hash
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != SchemeArgon2id {
+		return params, nil, nil, errBadHash.Hintf("not an argon2id hash")
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return params, nil, nil, errBadHash.CausedBy(err)
+	} else if version != argon2.Version {
+		return params, nil, nil, errBadHash.Hintf("unsupported argon2 version %d", version)
+	}
+
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Time, &params.Threads); err != nil {
+		return params, nil, nil, errBadHash.CausedBy(err)
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return params, nil, nil, errBadHash.CausedBy(err)
+	}
+
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return params, nil, nil, errBadHash.CausedBy(err)
+	}
+
+	params.KeyLen = uint32(len(key))
+	params.SaltLen = uint32(len(salt))
+	return params, salt, key, nil
+}
+
+const defaultBcryptCost = 12
+
+// BcryptHasher hashes passwords using bcrypt. It is kept mainly for
+// verifying hashes created before argon2id support.
+type BcryptHasher struct {
+	Cost int
+}
+
+func (h BcryptHasher) IDs() []string { return []string{"2a", "2b", "2y"} }
+
+func (h BcryptHasher) Hash(pwd string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(pwd), h.Cost)
+	if err != nil {
+		return "", errors.InternalIssue.CausedBy(err)
+	}
+	return string(hash), nil
+}
+
+func (h BcryptHasher) Verify(pwd, encoded string) (bool, error) {
+	err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(pwd))
+	if err == nil {
+		return true, nil
+	} else if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+		return false, nil
+	}
+	return false, errBadHash.CausedBy(err)
+}
+
+func (h BcryptHasher) NeedsRehash(encoded string) bool {
+	cost, err := bcrypt.Cost([]byte(encoded))
+	return err != nil || cost < h.Cost
+}
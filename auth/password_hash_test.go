@@ -0,0 +1,85 @@
+package auth
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestArgon2idHasher(t *testing.T) {
+	h := defaultArgon2id()
+
+	hash, err := h.Hash("correct horse battery")
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(hash, "$argon2id$v=19$m=19456,t=2,p=1$"))
+	assert.Equal(t, SchemeArgon2id, hashScheme(hash))
+
+	ok, err := h.Verify("correct horse battery", hash)
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	ok, err = h.Verify("wrong horse battery", hash)
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	_, err = h.Verify("correct horse battery", "$argon2id$v=19$m=x$salt$hash")
+	assert.Error(t, err)
+}
+
+func TestUser_CheckPassword(t *testing.T) {
+	argonHash, err := defaultArgon2id().Hash("correct horse battery")
+	require.NoError(t, err)
+
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("correct horse battery"), bcrypt.MinCost)
+	require.NoError(t, err)
+
+	for _, hash := range []string{argonHash, string(bcryptHash)} {
+		u := User{PwdHash: &hash}
+		assert.True(t, u.CheckPassword("correct horse battery"))
+		assert.False(t, u.CheckPassword("wrong horse battery"))
+	}
+
+	unknown := "$md5$abc$def"
+	assert.False(t, (&User{PwdHash: &unknown}).CheckPassword("correct horse battery"))
+	assert.False(t, (&User{}).CheckPassword("correct horse battery"))
+}
+
+func TestNeedsRehash(t *testing.T) {
+	current := defaultArgon2id()
+
+	weaker := current
+	weaker.Time = 1
+	weakHash, err := weaker.Hash("pwd")
+	require.NoError(t, err)
+
+	currentHash, err := current.Hash("pwd")
+	require.NoError(t, err)
+
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("pwd"), bcrypt.MinCost)
+	require.NoError(t, err)
+
+	assert.False(t, needsRehash(current, currentHash))
+	assert.True(t, needsRehash(current, weakHash))
+	assert.True(t, needsRehash(current, string(bcryptHash)))
+	assert.True(t, needsRehash(current, "garbage"))
+
+	assert.False(t, needsRehash(BcryptHasher{Cost: bcrypt.MinCost}, string(bcryptHash)))
+	assert.True(t, needsRehash(BcryptHasher{Cost: bcrypt.MinCost + 1}, string(bcryptHash)))
+	assert.True(t, needsRehash(BcryptHasher{Cost: bcrypt.MinCost}, currentHash))
+}
+
+func TestPasswordHashConf_hasher(t *testing.T) {
+	h, err := (&PasswordHashConf{}).hasher()
+	require.NoError(t, err)
+	assert.Equal(t, defaultArgon2id(), h)
+
+	h, err = (&PasswordHashConf{Scheme: SchemeBcrypt}).hasher()
+	require.NoError(t, err)
+	assert.Equal(t, BcryptHasher{Cost: defaultBcryptCost}, h)
+
+	_, err = (&PasswordHashConf{Scheme: "md5"}).hasher()
+	assert.Error(t, err)
+}
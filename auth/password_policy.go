@@ -0,0 +1,185 @@
+package auth
+
+import (
+	_ "embed"
+	"math"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/spy16/pgbase/errors"
+)
+
+// Reasons a password can be rejected for by the password policy. These
+// are returned in the 'reasons' attribute of the error.
+const (
+	PwdTooShort      = "too_short"
+	PwdTooLong       = "too_long"
+	PwdTooFewClasses = "too_few_classes"
+	PwdContainsUser  = "contains_user_info"
+	PwdCommon        = "common_password"
+	PwdLowEntropy    = "low_entropy"
+)
+
+const minUserInfoPartLen = 3
+
+//go:embed common_passwords.txt
+var commonPasswordsList string
+
+var commonPasswords = loadCommonPasswords(commonPasswordsList)
+
+// PasswordPolicy configures the requirements for new passwords. Zero
+// values are replaced with defaults, so the checks on user info and
+// common passwords must be turned off explicitly.
+type PasswordPolicy struct {
+	MinLength int `mapstructure:"min_length"`
+	MaxLength int `mapstructure:"max_length"`
+
+	// MinClasses is the number of character classes (lowercase, uppercase,
+	// digits and symbols) the password must contain.
+	MinClasses int `mapstructure:"min_classes"`
+
+	// MinEntropy is the minimum estimated entropy (in bits) of the
+	// password. Not checked if zero.
+	MinEntropy float64 `mapstructure:"min_entropy"`
+
+	AllowUserInfo bool `mapstructure:"allow_user_info"`
+	AllowCommon   bool `mapstructure:"allow_common"`
+}
+
+func (p *PasswordPolicy) sanitise() {
+	if p.MinLength <= 0 {
+		p.MinLength = 8
+	}
+	if p.MaxLength <= 0 {
+		p.MaxLength = 128
+	}
+	if p.MinClasses <= 0 {
+		p.MinClasses = 1
+	}
+}
+
+// Check validates the password against the policy. Username and email of
+// the user are used to reject passwords containing them. Returns an
+// errors.InvalidInput with all the failed checks listed in the 'reasons'
+// attribute.
+func (p PasswordPolicy) Check(pwd, username, email string) error {
+	var reasons []string
+
+	length := utf8.RuneCountInString(pwd)
+	if length < p.MinLength {
+		reasons = append(reasons, PwdTooShort)
+	} else if length > p.MaxLength {
+		reasons = append(reasons, PwdTooLong)
+	}
+
+	if classes, _ := charClasses(pwd); classes < p.MinClasses {
+		reasons = append(reasons, PwdTooFewClasses)
+	}
+
+	if !p.AllowUserInfo && containsUserInfo(pwd, username, email) {
+		reasons = append(reasons, PwdContainsUser)
+	}
+
+	if !p.AllowCommon && commonPasswords[strings.ToLower(pwd)] {
+		reasons = append(reasons, PwdCommon)
+	}
+
+	if p.MinEntropy > 0 && estimateEntropy(pwd) < p.MinEntropy {
+		reasons = append(reasons, PwdLowEntropy)
+	}
+
+	if len(reasons) == 0 {
+		return nil
+	}
+
+	return errors.InvalidInput.Coded("weak_password", map[string]any{
+		"reasons":     reasons,
+		"min_length":  p.MinLength,
+		"max_length":  p.MaxLength,
+		"min_classes": p.MinClasses,
+	}).Hintf("password does not meet the policy: %s", strings.Join(reasons, ", "))
+}
+
+// charClasses returns the character classes (lowercase, uppercase, digits
+// and symbols) present in the string along with the combined size of their
+// alphabets.
+func charClasses(s string) (count, poolSize int) {
+	var lower, upper, digit, symbol bool
+	for _, r := range s {
+		switch {
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			symbol = true
+		}
+	}
+
+	for _, c := range []struct {
+		present bool
+		size    int
+	}{{lower, 26}, {upper, 26}, {digit, 10}, {symbol, 33}} {
+		if c.present {
+			count++
+			poolSize += c.size
+		}
+	}
+	return count, poolSize
+}
+
+// containsUserInfo returns true if the password contains the username or
+// the local part of the email (case-insensitive). Very short values are
+// ignored since they would match too many passwords.
+func containsUserInfo(pwd, username, email string) bool {
+	pwd = strings.ToLower(pwd)
+
+	localPart, _, _ := strings.Cut(email, "@")
+	for _, part := range []string{username, localPart} {
+		part = strings.ToLower(strings.TrimSpace(part))
+		if len(part) >= minUserInfoPartLen && strings.Contains(pwd, part) {
+			return true
+		}
+	}
+	return false
+}
+
+// estimateEntropy returns a rough estimate of the entropy (in bits) of the
+// password based on the size of the character pool it uses. Characters
+// that repeat or continue a sequence (e.g., 'aaa', 'abc', '123') of the
+// previous character add only a single bit.
+func estimateEntropy(pwd string) float64 {
+	_, pool := charClasses(pwd)
+	if pool == 0 {
+		return 0
+	}
+
+	perChar := math.Log2(float64(pool))
+
+	var bits float64
+	var prev rune = -1
+	for _, r := range pwd {
+		if prev >= 0 && (r == prev || r == prev+1 || r == prev-1) {
+			bits++
+		} else {
+			bits += perChar
+		}
+		prev = r
+	}
+	return bits
+}
+
+func loadCommonPasswords(list string) map[string]bool {
+	res := map[string]bool{}
+	for _, line := range strings.Split(list, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		res[strings.ToLower(line)] = true
+	}
+	return res
+}
@@ -0,0 +1,96 @@
+package auth
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/spy16/pgbase/errors"
+)
+
+func TestPasswordPolicy_Check(t *testing.T) {
+	var defaultPolicy PasswordPolicy
+	defaultPolicy.sanitise()
+
+	strict := PasswordPolicy{MinLength: 10, MinClasses: 3, MinEntropy: 50}
+	strict.sanitise()
+
+	table := []struct {
+		title  string
+		policy PasswordPolicy
+		pwd    string
+		want   []string
+	}{
+		{title: "Valid", policy: defaultPolicy, pwd: "correct horse battery"},
+		{title: "TooShort", policy: defaultPolicy, pwd: "x7#kQ", want: []string{PwdTooShort}},
+		{title: "TooLong", policy: PasswordPolicy{MinLength: 1, MaxLength: 4, MinClasses: 1}, pwd: "x7#kQ", want: []string{PwdTooLong}},
+		{title: "Common", policy: defaultPolicy, pwd: "Password123", want: []string{PwdCommon}},
+		{title: "Username", policy: defaultPolicy, pwd: "bobby-the-great", want: []string{PwdContainsUser}},
+		{title: "EmailLocalPart", policy: defaultPolicy, pwd: "i-am-Builder99", want: []string{PwdContainsUser}},
+		{title: "AllowUserInfo", policy: PasswordPolicy{MinLength: 8, MaxLength: 128, MinClasses: 1, AllowUserInfo: true}, pwd: "bobby-the-great"},
+		{title: "Classes", policy: strict, pwd: "lowercaseonly", want: []string{PwdTooFewClasses}},
+		{title: "Entropy", policy: strict, pwd: "Aa1aaaaaaaaaaaaa", want: []string{PwdLowEntropy}},
+		{title: "Strict", policy: strict, pwd: "t4K!u9#Zq2mL"},
+		{title: "Multiple", policy: strict, pwd: "bobby", want: []string{PwdTooShort, PwdTooFewClasses, PwdContainsUser, PwdLowEntropy}},
+	}
+
+	for _, tt := range table {
+		t.Run(tt.title, func(t *testing.T) {
+			err := tt.policy.Check(tt.pwd, "bobby", "builder@bobmail.com")
+			if len(tt.want) == 0 {
+				assert.NoError(t, err)
+				return
+			}
+
+			require.Error(t, err)
+			e := errors.E(err)
+			assert.True(t, errors.Is(err, errors.InvalidInput.Coded("weak_password")))
+			assert.Equal(t, tt.want, e.Attribs["reasons"])
+		})
+	}
+}
+
+func TestEstimateEntropy(t *testing.T) {
+	assert.Zero(t, estimateEntropy(""))
+	assert.Less(t, estimateEntropy("aaaaaaaa"), estimateEntropy("aqzmwxnr"))
+	assert.Less(t, estimateEntropy("abcdefgh"), estimateEntropy("aqzmwxnr"))
+	assert.Less(t, estimateEntropy("aqzmwxnr"), estimateEntropy("aQz7wX#r"))
+}
+
+func TestHashPassword(t *testing.T) {
+	_, err := HashPassword("short")
+	assert.Error(t, err)
+
+	hash, err := HashPassword("correct horse battery")
+	require.NoError(t, err)
+
+	u := User{PwdHash: &hash}
+	assert.True(t, u.CheckPassword("correct horse battery"))
+	assert.False(t, u.CheckPassword("wrong horse battery"))
+}
+
+func TestAuth_HashPassword(t *testing.T) {
+	policy := PasswordPolicy{MinLength: 12}
+	policy.sanitise()
+
+	hasher, err := (&PasswordHashConf{Scheme: SchemeBcrypt, BcryptCost: 4}).hasher()
+	require.NoError(t, err)
+
+	au := &Auth{cfg: Config{PasswordPolicy: policy}, hasher: hasher}
+	u := User{Username: "bob", Email: "bob@example.com"}
+
+	_, err = au.HashPassword("short pass", u)
+	assert.Error(t, err, "configured policy must apply")
+
+	_, err = au.HashPassword("bob's long password", u)
+	assert.Error(t, err, "user info must be rejected")
+
+	hash, err := au.HashPassword("correct horse battery", u)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(hash, "$2"), "configured hasher must be used, got %s", hash)
+
+	u.PwdHash = &hash
+	assert.True(t, u.CheckPassword("correct horse battery"))
+}
@@ -9,10 +9,14 @@ CREATE TABLE IF NOT EXISTS users
     created_at   TIMESTAMP WITH TIME ZONE NOT NULL default current_timestamp,
     updated_at   TIMESTAMP WITH TIME ZONE NOT NULL default current_timestamp,
     verified_at  TIMESTAMP WITH TIME ZONE          default null,
-    verify_token TEXT                              DEFAULT NULL,
     attributes   jsonb
 );
 CREATE INDEX IF NOT EXISTS idx_users_kind ON users (kind);
+ALTER TABLE users ADD COLUMN IF NOT EXISTS verify_sent_at TIMESTAMP WITH TIME ZONE DEFAULT NULL;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS disabled_at TIMESTAMP WITH TIME ZONE DEFAULT NULL;
+CREATE INDEX IF NOT EXISTS idx_users_created_at ON users (created_at, id);
+ALTER TABLE users ADD COLUMN IF NOT EXISTS phone TEXT DEFAULT NULL;
+CREATE UNIQUE INDEX IF NOT EXISTS idx_users_phone ON users (phone);
 
 CREATE TABLE IF NOT EXISTS user_keys
 (
@@ -22,4 +26,190 @@ CREATE TABLE IF NOT EXISTS user_keys
 
     FOREIGN KEY (user_id) REFERENCES users (id)
 );
-CREATE INDEX IF NOT EXISTS idx_user_keys_user_id ON user_keys (user_id);
\ No newline at end of file
+CREATE INDEX IF NOT EXISTS idx_user_keys_user_id ON user_keys (user_id);
+
+CREATE TABLE IF NOT EXISTS sessions
+(
+    id           TEXT                     NOT NULL PRIMARY KEY,
+    user_id      TEXT                     NOT NULL,
+    created_at   TIMESTAMP WITH TIME ZONE NOT NULL default current_timestamp,
+    last_seen_at TIMESTAMP WITH TIME ZONE NOT NULL default current_timestamp,
+    expires_at   TIMESTAMP WITH TIME ZONE NOT NULL,
+    revoked_at   TIMESTAMP WITH TIME ZONE          default null,
+    user_agent   TEXT,
+    client_ip    TEXT,
+
+    FOREIGN KEY (user_id) REFERENCES users (id)
+);
+CREATE INDEX IF NOT EXISTS idx_sessions_user_id ON sessions (user_id);
+
+CREATE TABLE IF NOT EXISTS refresh_tokens
+(
+    token_hash TEXT                     NOT NULL PRIMARY KEY,
+    session_id TEXT                     NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL default current_timestamp,
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    used_at    TIMESTAMP WITH TIME ZONE          default null,
+
+    FOREIGN KEY (session_id) REFERENCES sessions (id)
+);
+CREATE INDEX IF NOT EXISTS idx_refresh_tokens_session_id ON refresh_tokens (session_id);
+
+CREATE TABLE IF NOT EXISTS user_tokens
+(
+    token_hash TEXT                     NOT NULL PRIMARY KEY,
+    kind       TEXT                     NOT NULL,
+    user_id    TEXT,
+    attribs    jsonb,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL default current_timestamp,
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    used_at    TIMESTAMP WITH TIME ZONE          default null,
+
+    FOREIGN KEY (user_id) REFERENCES users (id)
+);
+CREATE INDEX IF NOT EXISTS idx_user_tokens_user_id ON user_tokens (user_id);
+ALTER TABLE user_tokens ADD COLUMN IF NOT EXISTS attempts INT NOT NULL DEFAULT 0;
+
+-- Verification tokens used to be kept in plaintext on the users row. They
+-- are moved to user_tokens (hashed like the rest) so that the links that
+-- have been sent already keep working.
+DO
+$$
+    BEGIN
+        IF EXISTS(SELECT 1
+                  FROM information_schema.columns
+                  WHERE table_schema = current_schema()
+                    AND table_name = 'users'
+                    AND column_name = 'verify_token') THEN
+            ALTER TABLE users ADD COLUMN IF NOT EXISTS verify_expires_at TIMESTAMP WITH TIME ZONE DEFAULT NULL;
+
+            INSERT INTO user_tokens (token_hash, kind, user_id, created_at, expires_at)
+            SELECT encode(sha256(convert_to(verify_token, 'UTF8')), 'hex'),
+                   'verify_email',
+                   id,
+                   coalesce(verify_sent_at, created_at),
+                   coalesce(verify_expires_at, current_timestamp + interval '1 day')
+            FROM users
+            WHERE verify_token IS NOT NULL
+              AND verify_token <> ''
+              AND verified_at IS NULL
+            ON CONFLICT (token_hash) DO NOTHING;
+
+            ALTER TABLE users DROP COLUMN verify_token, DROP COLUMN verify_expires_at;
+        END IF;
+    END
+$$;
+
+CREATE TABLE IF NOT EXISTS api_keys
+(
+    id           TEXT                     NOT NULL PRIMARY KEY,
+    user_id      TEXT                     NOT NULL,
+    name         TEXT                     NOT NULL,
+    token_hash   TEXT                     NOT NULL UNIQUE,
+    scopes       TEXT[]                   NOT NULL default '{}',
+    created_at   TIMESTAMP WITH TIME ZONE NOT NULL default current_timestamp,
+    expires_at   TIMESTAMP WITH TIME ZONE          default null,
+    last_used_at TIMESTAMP WITH TIME ZONE          default null,
+    revoked_at   TIMESTAMP WITH TIME ZONE          default null,
+
+    FOREIGN KEY (user_id) REFERENCES users (id)
+);
+CREATE INDEX IF NOT EXISTS idx_api_keys_user_id ON api_keys (user_id);
+
+CREATE TABLE IF NOT EXISTS roles
+(
+    name        TEXT                     NOT NULL PRIMARY KEY,
+    description TEXT                     NOT NULL default '',
+    permissions TEXT[]                   NOT NULL default '{}',
+    created_at  TIMESTAMP WITH TIME ZONE NOT NULL default current_timestamp,
+    updated_at  TIMESTAMP WITH TIME ZONE NOT NULL default current_timestamp
+);
+
+CREATE TABLE IF NOT EXISTS user_roles
+(
+    user_id    TEXT                     NOT NULL,
+    role       TEXT                     NOT NULL,
+    granted_at TIMESTAMP WITH TIME ZONE NOT NULL default current_timestamp,
+
+    PRIMARY KEY (user_id, role),
+    FOREIGN KEY (user_id) REFERENCES users (id),
+    FOREIGN KEY (role) REFERENCES roles (name) ON DELETE CASCADE
+);
+ALTER TABLE users ADD COLUMN IF NOT EXISTS grants_version INT NOT NULL DEFAULT 0;
+
+CREATE TABLE IF NOT EXISTS orgs
+(
+    id         TEXT                     NOT NULL PRIMARY KEY,
+    name       TEXT                     NOT NULL,
+    slug       TEXT                     NOT NULL UNIQUE,
+    created_by TEXT,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL default current_timestamp,
+    updated_at TIMESTAMP WITH TIME ZONE NOT NULL default current_timestamp,
+
+    FOREIGN KEY (created_by) REFERENCES users (id) ON DELETE SET NULL
+);
+
+CREATE TABLE IF NOT EXISTS org_members
+(
+    org_id    TEXT                     NOT NULL,
+    user_id   TEXT                     NOT NULL,
+    role      TEXT                     NOT NULL,
+    joined_at TIMESTAMP WITH TIME ZONE NOT NULL default current_timestamp,
+
+    PRIMARY KEY (org_id, user_id),
+    FOREIGN KEY (org_id) REFERENCES orgs (id) ON DELETE CASCADE,
+    FOREIGN KEY (user_id) REFERENCES users (id)
+);
+CREATE INDEX IF NOT EXISTS idx_org_members_user_id ON org_members (user_id);
+
+ALTER TABLE sessions ADD COLUMN IF NOT EXISTS org_id TEXT REFERENCES orgs (id) ON DELETE SET NULL;
+
+CREATE TABLE IF NOT EXISTS login_attempts
+(
+    scope           TEXT                     NOT NULL,
+    subject         TEXT                     NOT NULL,
+    failures        INT                      NOT NULL default 0,
+    last_failure_at TIMESTAMP WITH TIME ZONE NOT NULL default current_timestamp,
+    locked_until    TIMESTAMP WITH TIME ZONE          default null,
+
+    PRIMARY KEY (scope, subject)
+);
+CREATE INDEX IF NOT EXISTS idx_login_attempts_locked_until ON login_attempts (locked_until);
+
+CREATE TABLE IF NOT EXISTS auth_events
+(
+    id         BIGSERIAL                NOT NULL PRIMARY KEY,
+    kind       TEXT                     NOT NULL,
+    user_id    TEXT,
+    client_ip  TEXT,
+    user_agent TEXT,
+    request_id TEXT,
+    attribs    jsonb,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL default current_timestamp
+);
+CREATE INDEX IF NOT EXISTS idx_auth_events_user_id ON auth_events (user_id, id);
+CREATE INDEX IF NOT EXISTS idx_auth_events_kind ON auth_events (kind, id);
+CREATE INDEX IF NOT EXISTS idx_auth_events_created_at ON auth_events (created_at);
+
+CREATE TABLE IF NOT EXISTS oauth_clients
+(
+    id            TEXT                     NOT NULL PRIMARY KEY,
+    name          TEXT                     NOT NULL,
+    secret_hash   TEXT                              default null,
+    redirect_uris TEXT[]                   NOT NULL,
+    scopes        TEXT[]                   NOT NULL,
+    first_party   BOOLEAN                  NOT NULL default false,
+    created_at    TIMESTAMP WITH TIME ZONE NOT NULL default current_timestamp
+);
+
+CREATE TABLE IF NOT EXISTS oauth_consents
+(
+    user_id    TEXT                     NOT NULL,
+    client_id  TEXT                     NOT NULL,
+    scopes     TEXT[]                   NOT NULL,
+    granted_at TIMESTAMP WITH TIME ZONE NOT NULL default current_timestamp,
+
+    PRIMARY KEY (user_id, client_id),
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE,
+    FOREIGN KEY (client_id) REFERENCES oauth_clients (id) ON DELETE CASCADE
+);
@@ -7,19 +7,74 @@ import (
 )
 
 type Session struct {
-	ID        string
-	Token     string
-	UserID    string
-	UserKind  string
-	ExpiresAt time.Time
+	ID           string
+	Token        string
+	UserID       string
+	UserKind     string
+	Verified     bool
+	ExpiresAt    time.Time
+	RefreshToken string
+	Roles        []string
+	Permissions  []string
+
+	// OrgID is the active organization of the session and OrgRole is the
+	// role of the user in it. Both are empty if no org is active.
+	OrgID   string
+	OrgRole string
+
+	// APIKeyID is set if the request was authenticated using an API key
+	// instead of a login session. Scopes are the scopes of the API key.
+	APIKeyID string
+	Scopes   []string
 }
 
+// sessionTokenType is the 'typ' claim of session tokens. It distinguishes
+// them from the other tokens signed with the same keys (e.g., the tokens
+// issued to OAuth clients).
+const sessionTokenType = "session"
+
 type sessionClaims struct {
+	Type      string `json:"typ"`
+	Issuer    string `json:"iss,omitempty"`
 	ID        string `json:"tid"`
 	Kind      string `json:"kind"`
 	Subject   string `json:"sub"`
 	IssuedAt  int64  `json:"iat"`
 	ExpiresAt int64  `json:"exp"`
+
+	Roles       []string `json:"roles,omitempty"`
+	Permissions []string `json:"perms,omitempty"`
+	OrgID       string   `json:"org,omitempty"`
+	OrgRole     string   `json:"org_role,omitempty"`
+
+	// GrantsVersion is the version of the grants of the user the roles and
+	// permissions were resolved at. See bumpGrantsVersion.
+	GrantsVersion int `json:"grants_ver,omitempty"`
+
+	// Audience and ClientID are never set in session tokens. These are
+	// decoded only to reject the tokens issued to OAuth clients.
+	Audience any    `json:"aud,omitempty"`
+	ClientID string `json:"client_id,omitempty"`
+}
+
+// HasPermission returns true if the session has been granted the given
+// permission. For sessions authenticated using an API key, the key must
+// also have a scope covering the permission (if the key has any scopes).
+func (s Session) HasPermission(perm string) bool {
+	if s.APIKeyID != "" && len(s.Scopes) > 0 && !anyMatches(s.Scopes, perm) {
+		return false
+	}
+	return anyMatches(s.Permissions, perm)
+}
+
+// HasRole returns true if the role has been granted to the session user.
+func (s Session) HasRole(role string) bool {
+	for _, r := range s.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
 }
 
 func (sc sessionClaims) Valid() error {
@@ -29,8 +84,19 @@ func (sc sessionClaims) Valid() error {
 		return errInvalid.Hintf("empty kind claim")
 	} else if sc.IssuedAt >= sc.ExpiresAt {
 		return errInvalid.Hintf("iat > exp")
+	} else if time.Now().Unix() >= sc.ExpiresAt {
+		return errInvalid.Hintf("token expired")
 	} else if sc.Subject == "" {
 		return errInvalid.Hintf("empty sub claim")
 	}
 	return nil
 }
+
+func anyMatches(granted []string, perm string) bool {
+	for _, g := range granted {
+		if matchPermission(g, perm) {
+			return true
+		}
+	}
+	return false
+}
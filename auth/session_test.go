@@ -0,0 +1,95 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/spy16/pgbase/errors"
+)
+
+func TestSessionClaims_Valid(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	valid := sessionClaims{
+		Type:      sessionTokenType,
+		ID:        "sess1",
+		Kind:      "user",
+		Subject:   "u1",
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(time.Minute).Unix(),
+	}
+
+	table := []struct {
+		title  string
+		mutate func(sc *sessionClaims)
+		want   string
+	}{
+		{title: "Valid", mutate: func(sc *sessionClaims) {}},
+		{title: "NoKind", mutate: func(sc *sessionClaims) { sc.Kind = "" }, want: "empty kind claim"},
+		{title: "NoSubject", mutate: func(sc *sessionClaims) { sc.Subject = "" }, want: "empty sub claim"},
+		{
+			title:  "IssuedAfterExpiry",
+			mutate: func(sc *sessionClaims) { sc.IssuedAt = sc.ExpiresAt + 1 },
+			want:   "iat > exp",
+		},
+		{
+			title: "Expired",
+			mutate: func(sc *sessionClaims) {
+				sc.IssuedAt = now.Add(-time.Hour).Unix()
+				sc.ExpiresAt = now.Add(-time.Minute).Unix()
+			},
+			want: "token expired",
+		},
+		{
+			title: "Epoch",
+			mutate: func(sc *sessionClaims) {
+				sc.IssuedAt = 0
+				sc.ExpiresAt = 1
+			},
+			want: "token expired",
+		},
+	}
+
+	for _, tt := range table {
+		t.Run(tt.title, func(t *testing.T) {
+			sc := valid
+			tt.mutate(&sc)
+
+			err := sc.Valid()
+			if tt.want == "" {
+				assert.NoError(t, err)
+			} else {
+				require.Error(t, err)
+				assert.Equal(t, tt.want, errors.E(err).DebugHint)
+			}
+		})
+	}
+}
+
+func TestRestoreSession_expired(t *testing.T) {
+	t.Parallel()
+
+	kr, err := newKeyring([]SigningKey{{ID: "k1", Secret: "secret1", State: KeyStateActive}})
+	require.NoError(t, err)
+	auth := &Auth{keys: kr}
+
+	token, err := kr.sign(&sessionClaims{
+		Type:      sessionTokenType,
+		ID:        "sess1",
+		Kind:      "user",
+		Subject:   "u1",
+		IssuedAt:  time.Now().Add(-time.Hour).Unix(),
+		ExpiresAt: time.Now().Add(-time.Second).Unix(),
+	})
+	require.NoError(t, err)
+
+	_, err = auth.RestoreSession(context.Background(), token)
+	require.Error(t, err)
+	assert.Equal(t, http.StatusUnauthorized, errors.E(err).Status)
+}
@@ -0,0 +1,97 @@
+package auth
+
+import (
+	"encoding/base32"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTOTPCode(t *testing.T) {
+	t.Parallel()
+
+	// Test vectors from RFC 6238 Appendix B (SHA1, truncated to 6 digits).
+	secret := []byte("12345678901234567890")
+	table := []struct {
+		Time int64
+		Want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+
+	for i, tt := range table {
+		t.Run(fmt.Sprintf("Case#%d", i), func(t *testing.T) {
+			got := totpCode(secret, totpStep(time.Unix(tt.Time, 0)))
+			assert.Equal(t, tt.Want, got)
+		})
+	}
+}
+
+func TestCheckTOTP(t *testing.T) {
+	t.Parallel()
+
+	secret := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString([]byte("12345678901234567890"))
+	at := time.Unix(1111111111, 0)
+	step := totpStep(at)
+
+	t.Run("Valid", func(t *testing.T) {
+		got, ok := checkTOTP(secret, "050471", at, 0)
+		assert.True(t, ok)
+		assert.Equal(t, step, got)
+	})
+
+	t.Run("Skew", func(t *testing.T) {
+		_, ok := checkTOTP(secret, "050471", at.Add(totpPeriod*time.Second), 0)
+		assert.True(t, ok)
+
+		_, ok = checkTOTP(secret, "050471", at.Add(3*totpPeriod*time.Second), 0)
+		assert.False(t, ok)
+	})
+
+	t.Run("Replay", func(t *testing.T) {
+		_, ok := checkTOTP(secret, "050471", at, step)
+		assert.False(t, ok)
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		_, ok := checkTOTP(secret, "000000", at, 0)
+		assert.False(t, ok)
+
+		_, ok = checkTOTP(secret, "12345", at, 0)
+		assert.False(t, ok)
+
+		_, ok = checkTOTP("not-base32!", "050471", at, 0)
+		assert.False(t, ok)
+	})
+}
+
+func TestTOTPURI(t *testing.T) {
+	t.Parallel()
+
+	got := totpURI("pgbase", "bob@bobmail.com", "JBSWY3DPEHPK3PXP")
+	assert.Equal(t, "otpauth://totp/pgbase:bob@bobmail.com?algorithm=SHA1&digits=6&issuer=pgbase&period=30&secret=JBSWY3DPEHPK3PXP", got)
+}
+
+func TestMatchRecoveryCode(t *testing.T) {
+	t.Parallel()
+
+	hashes := []string{hashRecoveryCode("abcde12345"), hashRecoveryCode("fghij67890")}
+	assert.Equal(t, 1, matchRecoveryCode(hashes, "FGHIJ-67890"))
+	assert.Equal(t, 0, matchRecoveryCode(hashes, "abcde 12345"))
+	assert.Equal(t, -1, matchRecoveryCode(hashes, "abcde-12346"))
+	assert.Equal(t, -1, matchRecoveryCode(nil, "abcde-12345"))
+}
+
+func TestMFAAccount(t *testing.T) {
+	t.Parallel()
+
+	assert.Equal(t, "id/AbC123", mfaAccount("AbC123"))
+	assert.NotEqual(t, mfaAccount("abc123"), mfaAccount("ABC123"))
+}
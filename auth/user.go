@@ -7,8 +7,6 @@ import (
 	"strings"
 	"time"
 
-	"golang.org/x/crypto/bcrypt"
-
 	"github.com/spy16/pgbase/errors"
 	"github.com/spy16/pgbase/httpx"
 	"github.com/spy16/pgbase/strutils"
@@ -21,10 +19,17 @@ const (
 	KeyKindID       = "id"
 	KeyKindEmail    = "email"
 	KeyKindUsername = "username"
+	KeyKindPhone    = "phone"
 )
 
 const defaultUserKind = "user"
 
+// reservedKeyKinds cannot be used as names of OAuth providers.
+var reservedKeyKinds = []string{
+	KeyKindID, KeyKindEmail, KeyKindUsername, KeyKindPhone, KeyKindTOTP, KeyKindWebAuthn,
+	"google", "github",
+}
+
 var (
 	idPattern       = regexp.MustCompile(`^[a-zA-Z0-9]+$`)
 	usernamePattern = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_]+[A-Za-z0-9]$`)
@@ -37,12 +42,14 @@ type User struct {
 	Kind        string         `json:"kind"`
 	Data        UserData       `json:"data"`
 	Email       string         `json:"email"`
+	Phone       *string        `json:"phone,omitempty"`
 	PwdHash     *string        `json:"pwd_hash,omitempty"`
 	Username    string         `json:"username"`
 	CreatedAt   time.Time      `json:"created_at"`
 	UpdatedAt   time.Time      `json:"updated_at"`
 	VerifiedAt  *time.Time     `json:"verified_at"`
 	VerifyToken *string        `json:"verify_token,omitempty"`
+	DisabledAt  *time.Time     `json:"disabled_at,omitempty"`
 	Attributes  map[string]any `json:"-"`
 }
 
@@ -81,41 +88,45 @@ func (u *User) Validate() error {
 	return nil
 }
 
-// HashPassword hashes and returns the PwdHash value.
+// HashPassword checks the password against the default password policy,
+// hashes and returns the PwdHash value.
+//
+// Deprecated: HashPassword ignores the password policy and hashing scheme
+// configured for the module. Use Auth.HashPassword instead.
 func HashPassword(pwd string) (string, error) {
-	if !strongPassword(pwd) {
-		return "", errors.InvalidInput.Hintf("password is not strong enough")
-	}
-
-	hash, err := bcrypt.GenerateFromPassword([]byte(pwd), 12)
-	if err != nil {
-		return "", errors.InternalIssue.CausedBy(err)
+	var policy PasswordPolicy
+	policy.sanitise()
+	if err := policy.Check(pwd, "", ""); err != nil {
+		return "", err
 	}
-
-	return string(hash), nil
+	return defaultHasher.Hash(pwd)
 }
 
 // CheckPassword returns true if the given password matches the hashed
-// value of the password in the user object. Returns false if mismatch
-// or no password is set for user.
+// value of the password in the user object. Hashes of any registered
+// scheme are supported. Returns false if mismatch or no password is set
+// for user.
 func (u *User) CheckPassword(pwd string) bool {
 	if u.PwdHash == nil {
 		return false
 	}
-	err := bcrypt.CompareHashAndPassword([]byte(*u.PwdHash), []byte(pwd))
-	return err == nil
+	ok, err := verifyPassword(pwd, *u.PwdHash)
+	return err == nil && ok
 }
 
 // Clone returns a deep-clone of the user.
 func (u *User) Clone(safe bool) User {
 	cloned := User{
 		ID:         u.ID,
+		Kind:       u.Kind,
 		Data:       map[string]any{},
 		Email:      u.Email,
+		Phone:      u.Phone,
 		Username:   u.Username,
 		CreatedAt:  u.CreatedAt,
 		UpdatedAt:  u.UpdatedAt,
 		VerifiedAt: u.VerifiedAt,
+		DisabledAt: u.DisabledAt,
 	}
 
 	for k, v := range u.Data {
@@ -141,8 +152,10 @@ func NewUser(kind, username, email string) User {
 		username = fmt.Sprintf("user%s", strutils.RandStr(8, strutils.CharsetNums))
 	}
 
+	// A non-nil token requests email verification. The actual token is
+	// issued by RegisterUser.
 	now := time.Now()
-	token := strutils.RandStr(10)
+	token := ""
 
 	return User{
 		ID:          strutils.RandStr(16),
@@ -157,11 +170,6 @@ func NewUser(kind, username, email string) User {
 	}
 }
 
-func strongPassword(pwd string) bool {
-	// TODO: add more logic here.
-	return len(pwd) >= 8
-}
-
 func (c *userCreds) readFrom(r *http.Request) error {
 	contentType := r.Header.Get("Content-Type")
 	if strings.Contains(contentType, "application/x-www-form-urlencoded") {
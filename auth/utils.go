@@ -1,17 +1,34 @@
 package auth
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"math/big"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/jackc/pgerrcode"
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgconn"
 
 	"github.com/spy16/pgbase/errors"
+	"github.com/spy16/pgbase/httpx"
 )
 
+// querier is implemented by both pgx.Conn and pgx.Tx.
+type querier interface {
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
 const (
 	bearerPrefix = "Bearer "
 	headerAuthz  = "Authorization"
@@ -31,6 +48,88 @@ func extractToken(r *http.Request, cookieName string) string {
 	return strings.TrimSpace(token)
 }
 
+// isEmptyBody returns true if the request is known to have no body.
+func isEmptyBody(r *http.Request) bool {
+	return r.Body == nil || r.Body == http.NoBody || r.ContentLength == 0
+}
+
+// readRequest reads the request body into the given struct pointer. Form
+// submissions are mapped onto the struct using the json field tags, so
+// 'into' must only have string fields.
+func readRequest(r *http.Request, into any) error {
+	if !strings.Contains(r.Header.Get("Content-Type"), contentTypeForm) {
+		return httpx.ReadJSON(r, into)
+	}
+
+	if err := r.ParseForm(); err != nil {
+		return errors.InvalidInput.CausedBy(err)
+	}
+
+	values := map[string]string{}
+	for k := range r.PostForm {
+		values[k] = r.PostForm.Get(k)
+	}
+
+	data, err := json.Marshal(values)
+	if err != nil {
+		return errors.InternalIssue.CausedBy(err)
+	}
+
+	if err := json.Unmarshal(data, into); err != nil {
+		return errors.InvalidInput.Coded("bad_form").CausedBy(err)
+	}
+	return nil
+}
+
+// withQuery returns the URL with the given query parameters added. The
+// URL is returned as is if it cannot be parsed.
+func withQuery(rawURL string, params map[string]string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+
+	q := u.Query()
+	for k, v := range params {
+		q.Set(k, v)
+	}
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// newSecretToken returns a new cryptographically random token suitable
+// for use as a bearer secret.
+func newSecretToken() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// newSecretCode returns a cryptographically random string of length 'n'
+// with characters picked from the charset.
+func newSecretCode(n int, charset string) string {
+	max := big.NewInt(int64(len(charset)))
+
+	b := make([]byte, n)
+	for i := range b {
+		idx, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			panic(err)
+		}
+		b[i] = charset[idx.Int64()]
+	}
+	return string(b)
+}
+
+// hashToken returns the hex-encoded SHA-256 digest of the token. Only
+// this digest is stored for secret tokens.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
 func translateErr(err error) error {
 	if err == nil {
 		return nil
@@ -53,3 +152,33 @@ func translateErr(err error) error {
 
 	return errors.InternalIssue.CausedBy(err)
 }
+
+// parseBoolParam parses the optional boolean query parameter. Returns nil
+// if the parameter is not set.
+func parseBoolParam(q url.Values, name string) (*bool, error) {
+	v := q.Get(name)
+	if v == "" {
+		return nil, nil
+	}
+
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return nil, errors.InvalidInput.Coded("invalid_" + name).CausedBy(err)
+	}
+	return &b, nil
+}
+
+// parseTimeParam parses the optional RFC3339 timestamp query parameter.
+// Returns nil if the parameter is not set.
+func parseTimeParam(q url.Values, name string) (*time.Time, error) {
+	v := q.Get(name)
+	if v == "" {
+		return nil, nil
+	}
+
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return nil, errors.InvalidInput.Coded("invalid_" + name).CausedBy(err)
+	}
+	return &t, nil
+}
@@ -0,0 +1,327 @@
+package auth
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"math/big"
+	"strings"
+
+	"github.com/spy16/pgbase/errors"
+	"github.com/spy16/pgbase/strutils"
+)
+
+// COSE algorithm identifiers supported for passkeys.
+// Refer https://www.iana.org/assignments/cose/cose.xhtml#algorithms
+const (
+	coseAlgES256 = -7
+	coseAlgEdDSA = -8
+	coseAlgRS256 = -257
+)
+
+// Authenticator data flags.
+const (
+	authDataFlagUP = 0x01
+	authDataFlagUV = 0x04
+	authDataFlagAT = 0x40
+)
+
+var errBadCredential = errors.InvalidInput.Coded("invalid_credential")
+
+// WebAuthnConf holds the relying party configurations for passkeys.
+type WebAuthnConf struct {
+	RPID    string   `mapstructure:"rp_id"`
+	RPName  string   `mapstructure:"rp_name"`
+	Origins []string `mapstructure:"origins"`
+}
+
+// b64Bytes is a byte slice that is encoded as unpadded base64url in JSON
+// as required by WebAuthn. Padded input is also accepted.
+type b64Bytes []byte
+
+func (b b64Bytes) MarshalJSON() ([]byte, error) {
+	return json.Marshal(base64.RawURLEncoding.EncodeToString(b))
+}
+
+func (b *b64Bytes) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+
+	decoded, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+	if err != nil {
+		return err
+	}
+	*b = decoded
+	return nil
+}
+
+// PasskeyCredential is the JSON serialisation of the PublicKeyCredential
+// returned by navigator.credentials.create() or get().
+type PasskeyCredential struct {
+	ID       string   `json:"id"`
+	RawID    b64Bytes `json:"rawId"`
+	Type     string   `json:"type"`
+	Response struct {
+		ClientDataJSON    b64Bytes `json:"clientDataJSON"`
+		AttestationObject b64Bytes `json:"attestationObject,omitempty"`
+		AuthenticatorData b64Bytes `json:"authenticatorData,omitempty"`
+		Signature         b64Bytes `json:"signature,omitempty"`
+		UserHandle        b64Bytes `json:"userHandle,omitempty"`
+	} `json:"response"`
+}
+
+type clientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+type authenticatorData struct {
+	RPIDHash  []byte
+	Flags     byte
+	SignCount uint32
+	CredID    []byte
+	PublicKey []byte
+}
+
+// passkeyKey is stored as the attributes of 'webauthn/<credential-id>'
+// auth keys.
+type passkeyKey struct {
+	Name      string `json:"name"`
+	PublicKey []byte `json:"public_key"`
+	SignCount uint32 `json:"sign_count"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+// verifyRegistration verifies the attestation response and returns the
+// parsed client data and authenticator data containing the credential.
+// Attestation statements are not verified, i.e., attestation 'none' is
+// assumed. The challenge must be checked by the caller.
+func (wc WebAuthnConf) verifyRegistration(cred PasskeyCredential) (*clientData, *authenticatorData, error) {
+	cd, err := wc.verifyClientData(cred.Response.ClientDataJSON, "webauthn.create")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	v, _, err := decodeCBOR(cred.Response.AttestationObject)
+	if err != nil {
+		return nil, nil, errBadCredential.CausedBy(err)
+	}
+
+	attObj, ok := v.(map[any]any)
+	if !ok {
+		return nil, nil, errBadCredential.Hintf("attestation object is not a map")
+	}
+
+	rawAuthData, ok := attObj["authData"].([]byte)
+	if !ok {
+		return nil, nil, errBadCredential.Hintf("authData missing")
+	}
+
+	ad, err := wc.verifyAuthData(rawAuthData)
+	if err != nil {
+		return nil, nil, err
+	} else if ad.Flags&authDataFlagAT == 0 || len(ad.CredID) == 0 {
+		return nil, nil, errBadCredential.Hintf("attested credential data missing")
+	} else if !bytes.Equal(ad.CredID, cred.RawID) {
+		return nil, nil, errBadCredential.Hintf("credential id mismatch")
+	}
+
+	if _, _, err := parseCOSEKey(ad.PublicKey); err != nil {
+		return nil, nil, err
+	}
+
+	return cd, ad, nil
+}
+
+// verifyAssertion verifies the assertion response against the stored
+// credential and returns the parsed client data and authenticator data.
+// The challenge must be checked by the caller.
+func (wc WebAuthnConf) verifyAssertion(cred PasskeyCredential, stored passkeyKey) (*clientData, *authenticatorData, error) {
+	cd, err := wc.verifyClientData(cred.Response.ClientDataJSON, "webauthn.get")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ad, err := wc.verifyAuthData(cred.Response.AuthenticatorData)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	pub, alg, err := parseCOSEKey(stored.PublicKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cdHash := sha256.Sum256(cred.Response.ClientDataJSON)
+	signed := append(append([]byte(nil), cred.Response.AuthenticatorData...), cdHash[:]...)
+	if !verifyCOSESignature(pub, alg, signed, cred.Response.Signature) {
+		return nil, nil, errBadCredential.Hintf("signature mismatch")
+	}
+
+	if (ad.SignCount != 0 || stored.SignCount != 0) && ad.SignCount <= stored.SignCount {
+		return nil, nil, errBadCredential.Hintf("sign count did not increase, possibly cloned authenticator")
+	}
+
+	return cd, ad, nil
+}
+
+func (wc WebAuthnConf) verifyClientData(raw []byte, wantType string) (*clientData, error) {
+	var cd clientData
+	if err := json.Unmarshal(raw, &cd); err != nil {
+		return nil, errBadCredential.CausedBy(err)
+	}
+
+	if cd.Type != wantType {
+		return nil, errBadCredential.Hintf("unexpected client data type '%s'", cd.Type)
+	} else if !strutils.OneOf(cd.Origin, wc.Origins) {
+		return nil, errBadCredential.Hintf("origin '%s' not allowed", cd.Origin)
+	} else if cd.Challenge == "" {
+		return nil, errBadCredential.Hintf("empty challenge")
+	}
+	return &cd, nil
+}
+
+func (wc WebAuthnConf) verifyAuthData(raw []byte) (*authenticatorData, error) {
+	ad, err := parseAuthData(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	rpIDHash := sha256.Sum256([]byte(wc.RPID))
+	if !bytes.Equal(ad.RPIDHash, rpIDHash[:]) {
+		return nil, errBadCredential.Hintf("rp id hash mismatch")
+	} else if ad.Flags&authDataFlagUP == 0 {
+		return nil, errBadCredential.Hintf("user not present")
+	} else if ad.Flags&authDataFlagUV == 0 {
+		return nil, errBadCredential.Hintf("user not verified")
+	}
+	return ad, nil
+}
+
+// parseAuthData parses the authenticator data structure.
+// Refer https://www.w3.org/TR/webauthn-2/#sctn-authenticator-data
+func parseAuthData(raw []byte) (*authenticatorData, error) {
+	if len(raw) < 37 {
+		return nil, errBadCredential.Hintf("authenticator data too short")
+	}
+
+	ad := &authenticatorData{
+		RPIDHash:  raw[:32],
+		Flags:     raw[32],
+		SignCount: binary.BigEndian.Uint32(raw[33:37]),
+	}
+
+	if ad.Flags&authDataFlagAT != 0 {
+		rest := raw[37:]
+		if len(rest) < 18 {
+			return nil, errBadCredential.Hintf("attested credential data too short")
+		}
+
+		// skip the 16 byte AAGUID.
+		credIDLen := int(binary.BigEndian.Uint16(rest[16:18]))
+		rest = rest[18:]
+		if len(rest) < credIDLen {
+			return nil, errBadCredential.Hintf("credential id too short")
+		}
+		ad.CredID = rest[:credIDLen]
+		rest = rest[credIDLen:]
+
+		_, after, err := decodeCBOR(rest)
+		if err != nil {
+			return nil, errBadCredential.CausedBy(err)
+		}
+		ad.PublicKey = rest[:len(rest)-len(after)]
+	}
+
+	return ad, nil
+}
+
+// parseCOSEKey parses a COSE_Key encoded public key and returns it along
+// with the COSE algorithm identifier.
+// Refer https://www.rfc-editor.org/rfc/rfc9053
+func parseCOSEKey(raw []byte) (crypto.PublicKey, int64, error) {
+	var errKey = errBadCredential.Coded("invalid_public_key")
+
+	v, _, err := decodeCBOR(raw)
+	if err != nil {
+		return nil, 0, errKey.CausedBy(err)
+	}
+
+	m, ok := v.(map[any]any)
+	if !ok {
+		return nil, 0, errKey.Hintf("not a map")
+	}
+
+	kty, _ := m[int64(1)].(int64)
+	alg, _ := m[int64(3)].(int64)
+
+	switch {
+	case kty == 2 && alg == coseAlgES256:
+		crv, _ := m[int64(-1)].(int64)
+		x, _ := m[int64(-2)].([]byte)
+		y, _ := m[int64(-3)].([]byte)
+		if crv != 1 || len(x) != 32 || len(y) != 32 {
+			return nil, 0, errKey.Hintf("invalid P-256 key")
+		}
+
+		pub := &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}
+		if !pub.Curve.IsOnCurve(pub.X, pub.Y) {
+			return nil, 0, errKey.Hintf("point not on curve")
+		}
+		return pub, alg, nil
+
+	case kty == 1 && alg == coseAlgEdDSA:
+		crv, _ := m[int64(-1)].(int64)
+		x, _ := m[int64(-2)].([]byte)
+		if crv != 6 || len(x) != ed25519.PublicKeySize {
+			return nil, 0, errKey.Hintf("invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(x), alg, nil
+
+	case kty == 3 && alg == coseAlgRS256:
+		n, _ := m[int64(-1)].([]byte)
+		e, _ := m[int64(-2)].([]byte)
+		if len(n) == 0 || len(e) == 0 || len(e) > 4 {
+			return nil, 0, errKey.Hintf("invalid RSA key")
+		}
+
+		var exp int
+		for _, b := range e {
+			exp = exp<<8 | int(b)
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: exp}, alg, nil
+
+	default:
+		return nil, 0, errKey.Hintf("unsupported key type=%d alg=%d", kty, alg)
+	}
+}
+
+func verifyCOSESignature(pub crypto.PublicKey, alg int64, data, sig []byte) bool {
+	switch alg {
+	case coseAlgES256:
+		digest := sha256.Sum256(data)
+		return ecdsa.VerifyASN1(pub.(*ecdsa.PublicKey), digest[:], sig)
+
+	case coseAlgRS256:
+		digest := sha256.Sum256(data)
+		return rsa.VerifyPKCS1v15(pub.(*rsa.PublicKey), crypto.SHA256, digest[:], sig) == nil
+
+	case coseAlgEdDSA:
+		return ed25519.Verify(pub.(ed25519.PublicKey), data, sig)
+	}
+	return false
+}
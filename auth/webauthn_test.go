@@ -0,0 +1,277 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testRPID   = "example.com"
+	testOrigin = "https://example.com"
+)
+
+var testWebAuthnConf = WebAuthnConf{
+	RPID:    testRPID,
+	RPName:  "Example",
+	Origins: []string{testOrigin},
+}
+
+func TestWebAuthn_Registration(t *testing.T) {
+	t.Parallel()
+
+	sa := newSoftAuthenticator(t, false)
+
+	t.Run("Valid", func(t *testing.T) {
+		cred := sa.create(testRPID, testOrigin, "challenge1")
+		cd, ad, err := testWebAuthnConf.verifyRegistration(cred)
+		require.NoError(t, err)
+		assert.Equal(t, "challenge1", cd.Challenge)
+		assert.Equal(t, sa.credID, ad.CredID)
+
+		_, alg, err := parseCOSEKey(ad.PublicKey)
+		require.NoError(t, err)
+		assert.Equal(t, int64(coseAlgES256), alg)
+	})
+
+	t.Run("WrongOrigin", func(t *testing.T) {
+		cred := sa.create(testRPID, "https://evil.com", "challenge1")
+		_, _, err := testWebAuthnConf.verifyRegistration(cred)
+		assert.Error(t, err)
+	})
+
+	t.Run("WrongRPID", func(t *testing.T) {
+		cred := sa.create("evil.com", testOrigin, "challenge1")
+		_, _, err := testWebAuthnConf.verifyRegistration(cred)
+		assert.Error(t, err)
+	})
+
+	t.Run("CredentialIDMismatch", func(t *testing.T) {
+		cred := sa.create(testRPID, testOrigin, "challenge1")
+		cred.RawID = []byte("something-else")
+		_, _, err := testWebAuthnConf.verifyRegistration(cred)
+		assert.Error(t, err)
+	})
+}
+
+func TestWebAuthn_Assertion(t *testing.T) {
+	t.Parallel()
+
+	for _, useEd25519 := range []bool{false, true} {
+		sa := newSoftAuthenticator(t, useEd25519)
+
+		_, ad, err := testWebAuthnConf.verifyRegistration(sa.create(testRPID, testOrigin, "reg"))
+		require.NoError(t, err)
+
+		stored := passkeyKey{PublicKey: ad.PublicKey, SignCount: ad.SignCount}
+
+		cred := sa.get(testRPID, testOrigin, "login1")
+		cd, ad, err := testWebAuthnConf.verifyAssertion(cred, stored)
+		require.NoError(t, err)
+		assert.Equal(t, "login1", cd.Challenge)
+		assert.Equal(t, sa.signCount, ad.SignCount)
+		stored.SignCount = ad.SignCount
+
+		// replayed assertion must fail due to sign count.
+		_, _, err = testWebAuthnConf.verifyAssertion(cred, stored)
+		assert.Error(t, err)
+
+		// tampered signature must fail.
+		cred = sa.get(testRPID, testOrigin, "login2")
+		cred.Response.Signature[len(cred.Response.Signature)-1] ^= 0xff
+		_, _, err = testWebAuthnConf.verifyAssertion(cred, stored)
+		assert.Error(t, err)
+
+		// registration response must not be accepted as assertion.
+		cred = sa.get(testRPID, testOrigin, "login3")
+		cred.Response.ClientDataJSON = sa.clientData("webauthn.create", testOrigin, "login3")
+		_, _, err = testWebAuthnConf.verifyAssertion(cred, stored)
+		assert.Error(t, err)
+	}
+}
+
+func TestDecodeCBOR(t *testing.T) {
+	t.Parallel()
+
+	v, rest, err := decodeCBOR(encodeCBOR(map[any]any{
+		"fmt":    "none",
+		int64(1): int64(-7),
+		"data":   []byte{1, 2, 3},
+		"list":   []any{int64(1), int64(300), int64(70000)},
+	}))
+	require.NoError(t, err)
+	assert.Empty(t, rest)
+	assert.Equal(t, map[any]any{
+		"fmt":    "none",
+		int64(1): int64(-7),
+		"data":   []byte{1, 2, 3},
+		"list":   []any{int64(1), int64(300), int64(70000)},
+	}, v)
+
+	_, _, err = decodeCBOR([]byte{0x5f}) // indefinite length byte string
+	assert.Error(t, err)
+
+	_, _, err = decodeCBOR([]byte{0x44, 0x01}) // truncated byte string
+	assert.Error(t, err)
+}
+
+// softAuthenticator is a software implementation of a WebAuthn
+// authenticator with attestation 'none'.
+type softAuthenticator struct {
+	t         *testing.T
+	ecKey     *ecdsa.PrivateKey
+	edKey     ed25519.PrivateKey
+	credID    []byte
+	signCount uint32
+}
+
+func newSoftAuthenticator(t *testing.T, useEd25519 bool) *softAuthenticator {
+	sa := &softAuthenticator{t: t, credID: make([]byte, 16)}
+	_, _ = rand.Read(sa.credID)
+
+	var err error
+	if useEd25519 {
+		_, sa.edKey, err = ed25519.GenerateKey(rand.Reader)
+	} else {
+		sa.ecKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	}
+	require.NoError(t, err)
+	return sa
+}
+
+func (sa *softAuthenticator) create(rpID, origin, challenge string) PasskeyCredential {
+	coseKey := map[any]any{}
+	if sa.edKey != nil {
+		coseKey[int64(1)] = int64(1)
+		coseKey[int64(3)] = int64(coseAlgEdDSA)
+		coseKey[int64(-1)] = int64(6)
+		coseKey[int64(-2)] = []byte(sa.edKey.Public().(ed25519.PublicKey))
+	} else {
+		coseKey[int64(1)] = int64(2)
+		coseKey[int64(3)] = int64(coseAlgES256)
+		coseKey[int64(-1)] = int64(1)
+		coseKey[int64(-2)] = sa.ecKey.X.FillBytes(make([]byte, 32))
+		coseKey[int64(-3)] = sa.ecKey.Y.FillBytes(make([]byte, 32))
+	}
+
+	attested := make([]byte, 16) // zero AAGUID
+	attested = binary.BigEndian.AppendUint16(attested, uint16(len(sa.credID)))
+	attested = append(attested, sa.credID...)
+	attested = append(attested, encodeCBOR(coseKey)...)
+
+	authData := sa.authData(rpID, authDataFlagUP|authDataFlagUV|authDataFlagAT, attested)
+
+	var cred PasskeyCredential
+	cred.ID = string(sa.credID)
+	cred.RawID = sa.credID
+	cred.Type = "public-key"
+	cred.Response.ClientDataJSON = sa.clientData("webauthn.create", origin, challenge)
+	cred.Response.AttestationObject = encodeCBOR(map[any]any{
+		"fmt":      "none",
+		"attStmt":  map[any]any{},
+		"authData": authData,
+	})
+	return cred
+}
+
+func (sa *softAuthenticator) get(rpID, origin, challenge string) PasskeyCredential {
+	sa.signCount++
+	authData := sa.authData(rpID, authDataFlagUP|authDataFlagUV, nil)
+	clientDataJSON := sa.clientData("webauthn.get", origin, challenge)
+
+	cdHash := sha256.Sum256(clientDataJSON)
+	signed := append(append([]byte(nil), authData...), cdHash[:]...)
+
+	var sig []byte
+	if sa.edKey != nil {
+		sig = ed25519.Sign(sa.edKey, signed)
+	} else {
+		digest := sha256.Sum256(signed)
+		var err error
+		sig, err = ecdsa.SignASN1(rand.Reader, sa.ecKey, digest[:])
+		require.NoError(sa.t, err)
+	}
+
+	var cred PasskeyCredential
+	cred.ID = string(sa.credID)
+	cred.RawID = sa.credID
+	cred.Type = "public-key"
+	cred.Response.ClientDataJSON = clientDataJSON
+	cred.Response.AuthenticatorData = authData
+	cred.Response.Signature = sig
+	return cred
+}
+
+func (sa *softAuthenticator) authData(rpID string, flags byte, attested []byte) []byte {
+	rpIDHash := sha256.Sum256([]byte(rpID))
+	data := append([]byte(nil), rpIDHash[:]...)
+	data = append(data, flags)
+	data = binary.BigEndian.AppendUint32(data, sa.signCount)
+	return append(data, attested...)
+}
+
+func (sa *softAuthenticator) clientData(typ, origin, challenge string) []byte {
+	data, err := json.Marshal(map[string]any{
+		"type":      typ,
+		"origin":    origin,
+		"challenge": challenge,
+	})
+	require.NoError(sa.t, err)
+	return data
+}
+
+// encodeCBOR encodes the subset of types supported by decodeCBOR.
+func encodeCBOR(v any) []byte {
+	head := func(major byte, n uint64) []byte {
+		switch {
+		case n < 24:
+			return []byte{major<<5 | byte(n)}
+		case n <= 0xff:
+			return []byte{major<<5 | 24, byte(n)}
+		case n <= 0xffff:
+			return binary.BigEndian.AppendUint16([]byte{major<<5 | 25}, uint16(n))
+		case n <= 0xffffffff:
+			return binary.BigEndian.AppendUint32([]byte{major<<5 | 26}, uint32(n))
+		default:
+			return binary.BigEndian.AppendUint64([]byte{major<<5 | 27}, n)
+		}
+	}
+
+	switch val := v.(type) {
+	case int64:
+		if val < 0 {
+			return head(1, uint64(-1-val))
+		}
+		return head(0, uint64(val))
+
+	case []byte:
+		return append(head(2, uint64(len(val))), val...)
+
+	case string:
+		return append(head(3, uint64(len(val))), val...)
+
+	case []any:
+		out := head(4, uint64(len(val)))
+		for _, item := range val {
+			out = append(out, encodeCBOR(item)...)
+		}
+		return out
+
+	case map[any]any:
+		out := head(5, uint64(len(val)))
+		for k, item := range val {
+			out = append(out, encodeCBOR(k)...)
+			out = append(out, encodeCBOR(item)...)
+		}
+		return out
+	}
+	panic("unsupported type")
+}
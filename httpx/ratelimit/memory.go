@@ -0,0 +1,63 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+var _ Limiter = (*Memory)(nil)
+
+// Memory is a Limiter that keeps the state in memory. Limits are not
+// shared across instances.
+type Memory struct {
+	alg   Algorithm
+	limit Limit
+	now   func() time.Time
+
+	mu        sync.Mutex
+	states    map[string]state
+	lastSweep time.Time
+}
+
+// NewMemory returns a new in-memory limiter.
+func NewMemory(alg Algorithm, limit Limit) (*Memory, error) {
+	if err := limit.Validate(); err != nil {
+		return nil, err
+	}
+
+	return &Memory{
+		alg:    alg,
+		limit:  limit,
+		now:    time.Now,
+		states: map[string]state{},
+	}, nil
+}
+
+// Allow checks and records the request identified by key.
+func (m *Memory) Allow(_ context.Context, key string) (*Result, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.now()
+	m.sweep(now)
+
+	s, res := step(m.alg, m.limit, m.states[key], now)
+	m.states[key] = s
+	return &res, nil
+}
+
+// sweep discards expired states at most once per ttl to bound memory.
+func (m *Memory) sweep(now time.Time) {
+	expiry := ttl(m.limit)
+	if now.Sub(m.lastSweep) < expiry {
+		return
+	}
+
+	for key, s := range m.states {
+		if now.Sub(s.T) >= expiry {
+			delete(m.states, key)
+		}
+	}
+	m.lastSweep = now
+}
@@ -0,0 +1,70 @@
+package ratelimit
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/spy16/pgbase/errors"
+	"github.com/spy16/pgbase/httpx"
+	"github.com/spy16/pgbase/log"
+)
+
+// KeyFunc returns the key that identifies the client of the request for
+// rate-limiting. Requests with empty key are not rate-limited.
+type KeyFunc func(r *http.Request) string
+
+// Middleware returns a chi compatible middleware that rate-limits the
+// requests using the limiter. RateLimit-* headers are set on all the
+// responses and rejected requests get errors.Throttled.
+func Middleware(l Limiter, keyFn KeyFunc) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := keyFn(r)
+			if key == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			res, err := l.Allow(r.Context(), key)
+			if err != nil {
+				// fail open: an unavailable limiter must not take down
+				// the endpoints it protects.
+				log.Warn(r.Context(), "rate-limit check failed", log.Fields{"error": err.Error()})
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			h := w.Header()
+			h.Set("RateLimit-Limit", strconv.Itoa(res.Limit))
+			h.Set("RateLimit-Remaining", strconv.Itoa(res.Remaining))
+			h.Set("RateLimit-Reset", strconv.Itoa(seconds(res.Reset)))
+
+			if !res.Allowed {
+				retryAfter := seconds(res.RetryAfter)
+				h.Set("Retry-After", strconv.Itoa(retryAfter))
+				httpx.WriteErr(w, r, errors.Throttled.Coded("rate_limited", map[string]any{
+					"retry_after": retryAfter,
+				}))
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// ByIP is a KeyFunc that identifies clients by their IP address.
+func ByIP(r *http.Request) string {
+	ip := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+	return "ip:" + ip
+}
+
+func seconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
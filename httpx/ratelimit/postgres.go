@@ -0,0 +1,112 @@
+package ratelimit
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+
+	"github.com/spy16/pgbase/errors"
+)
+
+const schema = `
+CREATE TABLE IF NOT EXISTS rate_limits
+(
+    key        TEXT                     NOT NULL PRIMARY KEY,
+    a          DOUBLE PRECISION         NOT NULL default 0,
+    b          DOUBLE PRECISION         NOT NULL default 0,
+    t          TIMESTAMP WITH TIME ZONE          default null,
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_rate_limits_expires_at ON rate_limits (expires_at);
+`
+
+var _ Limiter = (*Postgres)(nil)
+
+// DB is implemented by pgx.Conn and pgxpool.Pool.
+type DB interface {
+	Begin(ctx context.Context) (pgx.Tx, error)
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+}
+
+// Postgres is a Limiter that keeps the state in Postgres so that limits
+// are shared across all instances using the same database.
+type Postgres struct {
+	db    DB
+	name  string
+	alg   Algorithm
+	limit Limit
+}
+
+// NewPostgres returns a new Postgres backed limiter. The name is used to
+// namespace the keys so that multiple limiters can share the table.
+func NewPostgres(ctx context.Context, db DB, name string, alg Algorithm, limit Limit) (*Postgres, error) {
+	if err := limit.Validate(); err != nil {
+		return nil, err
+	} else if name == "" {
+		return nil, errors.InvalidInput.Hintf("name must not be empty")
+	}
+
+	if _, err := db.Exec(ctx, schema); err != nil {
+		return nil, errors.InternalIssue.CausedBy(err)
+	}
+
+	return &Postgres{
+		db:    db,
+		name:  name,
+		alg:   alg,
+		limit: limit,
+	}, nil
+}
+
+// Allow checks and records the request identified by key. The state row
+// is locked for the duration of the check so that concurrent requests
+// from different instances are serialised.
+func (p *Postgres) Allow(ctx context.Context, key string) (*Result, error) {
+	key = p.name + ":" + key
+	now := time.Now()
+
+	tx, err := p.db.Begin(ctx)
+	if err != nil {
+		return nil, errors.InternalIssue.CausedBy(err)
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	const upsert = `INSERT INTO rate_limits (key, expires_at) VALUES ($1, $2)
+		ON CONFLICT (key) DO UPDATE SET key=excluded.key
+		RETURNING a, b, t, expires_at`
+
+	var s state
+	var t *time.Time
+	var expiresAt time.Time
+	if err := tx.QueryRow(ctx, upsert, key, now).Scan(&s.A, &s.B, &t, &expiresAt); err != nil {
+		return nil, errors.InternalIssue.CausedBy(err)
+	}
+
+	// expired rows are treated as fresh instead of being deleted.
+	if t != nil && now.Before(expiresAt) {
+		s.T = *t
+	}
+
+	next, res := step(p.alg, p.limit, s, now)
+
+	const update = `UPDATE rate_limits SET a=$2, b=$3, t=$4, expires_at=$5 WHERE key=$1`
+	if _, err := tx.Exec(ctx, update, key, next.A, next.B, next.T, now.Add(ttl(p.limit))); err != nil {
+		return nil, errors.InternalIssue.CausedBy(err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, errors.InternalIssue.CausedBy(err)
+	}
+	return &res, nil
+}
+
+// Cleanup deletes expired state rows. It should be invoked periodically.
+func (p *Postgres) Cleanup(ctx context.Context) error {
+	_, err := p.db.Exec(ctx, "DELETE FROM rate_limits WHERE expires_at < $1", time.Now())
+	if err != nil {
+		return errors.InternalIssue.CausedBy(err)
+	}
+	return nil
+}
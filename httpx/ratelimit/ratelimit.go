@@ -0,0 +1,153 @@
+// Package ratelimit provides rate-limiting using token-bucket and
+// sliding-window algorithms with in-memory and Postgres backed storage.
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"time"
+
+	"github.com/spy16/pgbase/errors"
+)
+
+// Supported rate-limiting algorithms.
+const (
+	// TokenBucket allows bursts of up to Limit.Burst requests and refills
+	// at the rate of Limit.Requests per Limit.Period.
+	TokenBucket Algorithm = "token_bucket"
+
+	// SlidingWindow allows Limit.Requests per Limit.Period using a
+	// weighted count of the current and the previous fixed windows.
+	SlidingWindow Algorithm = "sliding_window"
+)
+
+// Limiter checks if a request identified by key is allowed and records
+// it if so.
+type Limiter interface {
+	Allow(ctx context.Context, key string) (*Result, error)
+}
+
+// Algorithm represents a rate-limiting algorithm.
+type Algorithm string
+
+// Limit represents the allowed rate of requests.
+type Limit struct {
+	Requests int           `mapstructure:"requests"`
+	Period   time.Duration `mapstructure:"period"`
+
+	// Burst is the capacity of the bucket when using TokenBucket.
+	// Defaults to Requests.
+	Burst int `mapstructure:"burst"`
+}
+
+// Result is the outcome of a rate-limit check.
+type Result struct {
+	Allowed    bool
+	Limit      int
+	Remaining  int
+	Reset      time.Duration
+	RetryAfter time.Duration
+}
+
+// Validate validates the limit and sets defaults.
+func (l *Limit) Validate() error {
+	if l.Requests <= 0 || l.Period <= 0 {
+		return errors.InvalidInput.Hintf("requests and period must be positive")
+	}
+	if l.Burst <= 0 {
+		l.Burst = l.Requests
+	}
+	return nil
+}
+
+// state is the per-key state tracked by the backends. Meaning of the
+// fields depends on the algorithm:
+//
+//	TokenBucket:   A=available tokens, T=last refill time.
+//	SlidingWindow: A=previous window count, B=current window count,
+//	               T=start of the current window.
+//
+// Zero T denotes a key that has not been seen before.
+type state struct {
+	A, B float64
+	T    time.Time
+}
+
+// step applies a request at time 'now' to the state and returns the new
+// state along with the result.
+func step(alg Algorithm, l Limit, s state, now time.Time) (state, Result) {
+	if alg == SlidingWindow {
+		return stepSlidingWindow(l, s, now)
+	}
+	return stepTokenBucket(l, s, now)
+}
+
+func stepTokenBucket(l Limit, s state, now time.Time) (state, Result) {
+	capacity := float64(l.Burst)
+	rate := float64(l.Requests) / float64(l.Period) // tokens per nanosecond
+
+	tokens := capacity
+	if !s.T.IsZero() {
+		elapsed := now.Sub(s.T)
+		if elapsed < 0 {
+			elapsed = 0
+		}
+		tokens = math.Min(capacity, s.A+float64(elapsed)*rate)
+	}
+
+	res := Result{Limit: l.Burst}
+	if tokens >= 1 {
+		tokens--
+		res.Allowed = true
+	} else {
+		res.RetryAfter = time.Duration(math.Ceil((1 - tokens) / rate))
+	}
+
+	res.Remaining = int(math.Floor(tokens))
+	res.Reset = time.Duration(math.Ceil((capacity - tokens) / rate))
+	return state{A: tokens, T: now}, res
+}
+
+func stepSlidingWindow(l Limit, s state, now time.Time) (state, Result) {
+	windowStart := now.Truncate(l.Period)
+
+	prev, cur := s.A, s.B
+	switch {
+	case s.T.IsZero() || windowStart.Sub(s.T) >= 2*l.Period:
+		prev, cur = 0, 0
+	case windowStart.After(s.T):
+		prev, cur = cur, 0
+	}
+
+	elapsed := now.Sub(windowStart)
+	weight := 1 - float64(elapsed)/float64(l.Period)
+	estimate := prev*weight + cur
+	limit := float64(l.Requests)
+
+	res := Result{
+		Limit: l.Requests,
+		Reset: l.Period - elapsed,
+	}
+	if estimate+1 <= limit {
+		cur++
+		estimate++
+		res.Allowed = true
+	} else if prev > 0 && cur+1 <= limit {
+		// the previous window's weight decays linearly. So find the time
+		// at which the estimate leaves room for one more request.
+		needWeight := (limit - cur - 1) / prev
+		at := time.Duration((1 - needWeight) * float64(l.Period))
+		res.RetryAfter = at - elapsed
+	} else {
+		res.RetryAfter = l.Period - elapsed
+	}
+
+	res.Remaining = int(math.Max(0, math.Floor(limit-estimate)))
+	return state{A: prev, B: cur, T: windowStart}, res
+}
+
+// ttl returns the duration after which an untouched state is equivalent
+// to a fresh one and can be discarded.
+func ttl(l Limit) time.Duration {
+	return 2 * l.Period
+}
@@ -0,0 +1,105 @@
+package ratelimit
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTokenBucket(t *testing.T) {
+	t.Parallel()
+
+	l := Limit{Requests: 2, Period: time.Second, Burst: 3}
+	require.NoError(t, l.Validate())
+
+	now := time.Unix(1000, 0)
+
+	var s state
+	var res Result
+	for i := 0; i < 3; i++ {
+		s, res = step(TokenBucket, l, s, now)
+		assert.True(t, res.Allowed, "request %d", i)
+		assert.Equal(t, 2-i, res.Remaining)
+	}
+
+	s, res = step(TokenBucket, l, s, now)
+	assert.False(t, res.Allowed)
+	assert.Equal(t, 500*time.Millisecond, res.RetryAfter)
+
+	// refills at 2 tokens per second.
+	s, res = step(TokenBucket, l, s, now.Add(500*time.Millisecond))
+	assert.True(t, res.Allowed)
+	assert.Equal(t, 0, res.Remaining)
+
+	_, res = step(TokenBucket, l, s, now.Add(10*time.Second))
+	assert.True(t, res.Allowed)
+	assert.Equal(t, 2, res.Remaining)
+}
+
+func TestSlidingWindow(t *testing.T) {
+	t.Parallel()
+
+	l := Limit{Requests: 4, Period: time.Minute}
+	require.NoError(t, l.Validate())
+
+	start := time.Unix(60*1000, 0)
+
+	var s state
+	var res Result
+	for i := 0; i < 4; i++ {
+		s, res = step(SlidingWindow, l, s, start)
+		assert.True(t, res.Allowed)
+	}
+
+	s, res = step(SlidingWindow, l, s, start.Add(30*time.Second))
+	assert.False(t, res.Allowed)
+	assert.Equal(t, 30*time.Second, res.RetryAfter)
+	assert.Equal(t, 30*time.Second, res.Reset)
+
+	// quarter into next window, previous window weighs 3/4 => 3 used.
+	s, res = step(SlidingWindow, l, s, start.Add(75*time.Second))
+	assert.True(t, res.Allowed)
+	assert.Equal(t, 0, res.Remaining)
+
+	_, res = step(SlidingWindow, l, s, start.Add(80*time.Second))
+	assert.False(t, res.Allowed)
+	assert.Equal(t, 10*time.Second, res.RetryAfter)
+
+	// previous window is forgotten after two periods.
+	_, res = step(SlidingWindow, l, s, start.Add(5*time.Minute))
+	assert.True(t, res.Allowed)
+	assert.Equal(t, 3, res.Remaining)
+}
+
+func TestMiddleware(t *testing.T) {
+	t.Parallel()
+
+	lim, err := NewMemory(TokenBucket, Limit{Requests: 1, Period: time.Minute})
+	require.NoError(t, err)
+
+	h := Middleware(lim, ByIP)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	do := func() *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/", nil).WithContext(context.Background())
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := do()
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "1", rec.Header().Get("RateLimit-Limit"))
+	assert.Equal(t, "0", rec.Header().Get("RateLimit-Remaining"))
+
+	rec = do()
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+	assert.Equal(t, "60", rec.Header().Get("Retry-After"))
+	assert.Contains(t, rec.Body.String(), "rate_limited")
+}
@@ -4,15 +4,22 @@ import (
 	"encoding/json"
 	"net/http"
 	"reflect"
+	"strconv"
 
 	"github.com/spy16/pgbase/errors"
 	"github.com/spy16/pgbase/log"
 )
 
 // WriteErr writes the error value to the ResponseWriter. HTTP status is
-// inferred from the error value.
+// inferred from the error value. For throttled requests, the 'retry_after'
+// attribute (in seconds) of the error is sent as the Retry-After header.
 func WriteErr(w http.ResponseWriter, r *http.Request, err error) {
 	e := errors.E(err)
+	if e.Status == http.StatusTooManyRequests {
+		if secs, ok := e.Attribs["retry_after"].(int); ok {
+			w.Header().Set("Retry-After", strconv.Itoa(secs))
+		}
+	}
 	WriteJSON(w, r, e.Status, e)
 }
 
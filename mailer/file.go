@@ -0,0 +1,80 @@
+package mailer
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/spy16/pgbase/errors"
+	"github.com/spy16/pgbase/log"
+	"github.com/spy16/pgbase/strutils"
+)
+
+const devSender = "pgbase@localhost"
+
+// NewFile returns a Mailer that writes each message as a '.eml' file
+// into the given directory instead of delivering it. Intended for use
+// in development and tests.
+func NewFile(dir string) (*File, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, errors.InternalIssue.CausedBy(err)
+	}
+	return &File{dir: dir}, nil
+}
+
+// File implements Mailer by writing messages to files.
+type File struct {
+	mu  sync.Mutex
+	dir string
+}
+
+// Send writes the message into the mail directory.
+func (f *File) Send(_ context.Context, msg Message) error {
+	if err := msg.Validate(); err != nil {
+		return err
+	}
+
+	data, err := encodeMessage(devSender, msg)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	name := fmt.Sprintf("%d_%s.eml", time.Now().UnixNano(), strutils.RandStr(6))
+	if err := os.WriteFile(filepath.Join(f.dir, name), data, 0o644); err != nil {
+		return errors.InternalIssue.CausedBy(err)
+	}
+	return nil
+}
+
+// Log implements Mailer by writing messages to the log instead of
+// delivering them. Intended for use in development.
+type Log struct {
+	// ShowText adds the plain-text body to the log entry, which makes it
+	// possible to follow verification and reset links locally. Anyone who
+	// can read the logs can follow them too.
+	ShowText bool
+}
+
+// Send logs the recipients and the subject of the message.
+func (l Log) Send(ctx context.Context, msg Message) error {
+	if err := msg.Validate(); err != nil {
+		return err
+	}
+
+	fields := log.Fields{
+		"to":      msg.To,
+		"subject": msg.Subject,
+	}
+	if l.ShowText {
+		fields["text"] = msg.Text
+	}
+
+	log.Info(ctx, "mail message", fields)
+	return nil
+}
@@ -0,0 +1,45 @@
+package mailer
+
+import (
+	"context"
+	"strings"
+
+	"github.com/spy16/pgbase/errors"
+	"github.com/spy16/pgbase/strutils"
+)
+
+// Mailer implementations deliver email messages.
+type Mailer interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// Message represents an email message to be delivered.
+type Message struct {
+	To      []string `json:"to"`
+	Subject string   `json:"subject"`
+	Text    string   `json:"text"`
+	HTML    string   `json:"html,omitempty"`
+}
+
+// Validate validates the message and returns error if invalid.
+func (msg Message) Validate() error {
+	var errInvalid = errors.InvalidInput.Coded("invalid_message")
+
+	if len(msg.To) == 0 {
+		return errInvalid.Hintf("no recipients")
+	}
+
+	for _, to := range msg.To {
+		if !strutils.IsValidEmail(to) {
+			return errInvalid.Hintf("invalid recipient '%s'", to)
+		}
+	}
+
+	if strings.TrimSpace(msg.Subject) == "" {
+		return errInvalid.Hintf("empty subject")
+	} else if msg.Text == "" && msg.HTML == "" {
+		return errInvalid.Hintf("empty body")
+	}
+
+	return nil
+}
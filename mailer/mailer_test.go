@@ -0,0 +1,74 @@
+package mailer_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/spy16/pgbase/mailer"
+)
+
+func TestMessage_Validate(t *testing.T) {
+	t.Parallel()
+
+	table := []struct {
+		Msg     mailer.Message
+		WantErr bool
+	}{
+		{mailer.Message{To: []string{"bob@bobmail.com"}, Subject: "Hi", Text: "Hello"}, false},
+		{mailer.Message{To: []string{"bob@bobmail.com"}, Subject: "Hi", HTML: "<b>Hello</b>"}, false},
+		{mailer.Message{Subject: "Hi", Text: "Hello"}, true},
+		{mailer.Message{To: []string{"bobmail.com"}, Subject: "Hi", Text: "Hello"}, true},
+		{mailer.Message{To: []string{"bob@bobmail.com"}, Text: "Hello"}, true},
+		{mailer.Message{To: []string{"bob@bobmail.com"}, Subject: "Hi"}, true},
+	}
+
+	for i, tt := range table {
+		t.Run(fmt.Sprintf("Case#%d", i), func(t *testing.T) {
+			err := tt.Msg.Validate()
+			assert.Equal(t, tt.WantErr, err != nil)
+		})
+	}
+}
+
+func TestFile_Send(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	m, err := mailer.NewFile(dir)
+	require.NoError(t, err)
+
+	err = m.Send(context.Background(), mailer.Message{
+		To:      []string{"bob@bobmail.com"},
+		Subject: "Hello",
+		Text:    "Hello Bob!",
+		HTML:    "<p>Hello Bob!</p>",
+	})
+	require.NoError(t, err)
+
+	files, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	assert.True(t, strings.HasSuffix(files[0].Name(), ".eml"))
+
+	data, err := os.ReadFile(dir + "/" + files[0].Name())
+	require.NoError(t, err)
+	assert.Contains(t, string(data), "To: bob@bobmail.com")
+	assert.Contains(t, string(data), "Subject: Hello")
+	assert.Contains(t, string(data), "multipart/alternative")
+	assert.Contains(t, string(data), "Hello Bob!")
+}
+
+func TestLog_Send(t *testing.T) {
+	t.Parallel()
+
+	msg := mailer.Message{To: []string{"bob@bobmail.com"}, Subject: "Hi", Text: "Hello"}
+	assert.NoError(t, mailer.Log{}.Send(context.Background(), msg))
+	assert.NoError(t, mailer.Log{ShowText: true}.Send(context.Background(), msg))
+	assert.Error(t, mailer.Log{}.Send(context.Background(), mailer.Message{Subject: "Hi", Text: "Hello"}))
+}
@@ -0,0 +1,122 @@
+package mailer
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spy16/pgbase/errors"
+)
+
+// SMTPConfig holds the configurations for delivering mails via SMTP.
+type SMTPConfig struct {
+	Host     string `mapstructure:"host"`
+	Port     int    `mapstructure:"port"`
+	Username string `mapstructure:"username"`
+	Password string `mapstructure:"password"`
+	From     string `mapstructure:"from"`
+}
+
+// NewSMTP returns a Mailer that delivers messages using the SMTP server
+// in the config.
+func NewSMTP(cfg SMTPConfig) (*SMTP, error) {
+	if cfg.Host == "" {
+		return nil, errors.InvalidInput.Hintf("smtp host is required")
+	} else if cfg.From == "" {
+		return nil, errors.InvalidInput.Hintf("smtp from address is required")
+	}
+
+	if cfg.Port == 0 {
+		cfg.Port = 587
+	}
+
+	return &SMTP{cfg: cfg}, nil
+}
+
+// SMTP implements Mailer using an SMTP server.
+type SMTP struct {
+	cfg SMTPConfig
+}
+
+// Send delivers the message using the SMTP server.
+func (s *SMTP) Send(_ context.Context, msg Message) error {
+	if err := msg.Validate(); err != nil {
+		return err
+	}
+
+	data, err := encodeMessage(s.cfg.From, msg)
+	if err != nil {
+		return err
+	}
+
+	var auth smtp.Auth
+	if s.cfg.Username != "" {
+		auth = smtp.PlainAuth("", s.cfg.Username, s.cfg.Password, s.cfg.Host)
+	}
+
+	addr := net.JoinHostPort(s.cfg.Host, strconv.Itoa(s.cfg.Port))
+	if err := smtp.SendMail(addr, auth, s.cfg.From, msg.To, data); err != nil {
+		return errors.InternalIssue.Coded("smtp_failed").CausedBy(err)
+	}
+	return nil
+}
+
+// encodeMessage encodes the message in RFC 5322 format. If both text
+// and HTML bodies are present, a multipart/alternative body is used.
+func encodeMessage(from string, msg Message) ([]byte, error) {
+	var buf bytes.Buffer
+
+	headers := []string{
+		fmt.Sprintf("From: %s", from),
+		fmt.Sprintf("To: %s", strings.Join(msg.To, ", ")),
+		fmt.Sprintf("Subject: %s", mime.QEncoding.Encode("utf-8", msg.Subject)),
+		fmt.Sprintf("Date: %s", time.Now().Format(time.RFC1123Z)),
+		"MIME-Version: 1.0",
+	}
+	for _, h := range headers {
+		buf.WriteString(h + "\r\n")
+	}
+
+	if msg.HTML == "" || msg.Text == "" {
+		contentType, body := "text/plain", msg.Text
+		if msg.HTML != "" {
+			contentType, body = "text/html", msg.HTML
+		}
+		buf.WriteString(fmt.Sprintf("Content-Type: %s; charset=utf-8\r\n\r\n", contentType))
+		buf.WriteString(body)
+		return buf.Bytes(), nil
+	}
+
+	mw := multipart.NewWriter(&buf)
+	buf.WriteString(fmt.Sprintf("Content-Type: multipart/alternative; boundary=%s\r\n\r\n", mw.Boundary()))
+
+	parts := []struct{ contentType, body string }{
+		{"text/plain", msg.Text},
+		{"text/html", msg.HTML},
+	}
+	for _, p := range parts {
+		pw, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type": {p.contentType + "; charset=utf-8"},
+		})
+		if err != nil {
+			return nil, errors.InternalIssue.CausedBy(err)
+		}
+
+		if _, err := pw.Write([]byte(p.body)); err != nil {
+			return nil, errors.InternalIssue.CausedBy(err)
+		}
+	}
+
+	if err := mw.Close(); err != nil {
+		return nil, errors.InternalIssue.CausedBy(err)
+	}
+	return buf.Bytes(), nil
+}
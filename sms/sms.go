@@ -0,0 +1,58 @@
+package sms
+
+import (
+	"context"
+	"strings"
+
+	"github.com/spy16/pgbase/errors"
+	"github.com/spy16/pgbase/log"
+	"github.com/spy16/pgbase/strutils"
+)
+
+// Sender implementations deliver text messages.
+type Sender interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// Message represents a text message to be delivered.
+type Message struct {
+	To   string `json:"to"`
+	Text string `json:"text"`
+}
+
+// Validate validates the message and returns error if invalid. The
+// recipient must be in E.164 format.
+func (msg Message) Validate() error {
+	var errInvalid = errors.InvalidInput.Coded("invalid_message")
+
+	if phone, ok := strutils.NormalizePhone(msg.To); !ok || phone != msg.To {
+		return errInvalid.Hintf("invalid recipient '%s'", msg.To)
+	} else if strings.TrimSpace(msg.Text) == "" {
+		return errInvalid.Hintf("empty text")
+	}
+	return nil
+}
+
+// Log implements Sender by writing messages to the log instead of
+// delivering them. Intended for use in development.
+type Log struct {
+	// ShowText logs the message text along with the recipient. Most texts
+	// are one-time login codes, which stay valid for anyone reading the
+	// log until they expire. Keep it off outside local setups.
+	ShowText bool
+}
+
+// Send logs the recipient of the message.
+func (l Log) Send(ctx context.Context, msg Message) error {
+	if err := msg.Validate(); err != nil {
+		return err
+	}
+
+	fields := log.Fields{"to": msg.To}
+	if l.ShowText {
+		fields["text"] = msg.Text
+	}
+
+	log.Info(ctx, "sms message", fields)
+	return nil
+}
@@ -0,0 +1,40 @@
+package sms_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/spy16/pgbase/sms"
+)
+
+func TestMessage_Validate(t *testing.T) {
+	t.Parallel()
+
+	table := []struct {
+		Msg     sms.Message
+		WantErr bool
+	}{
+		{sms.Message{To: "+14155552671", Text: "Hello"}, false},
+		{sms.Message{To: "+1 415 555 2671", Text: "Hello"}, true},
+		{sms.Message{To: "14155552671", Text: "Hello"}, true},
+		{sms.Message{To: "+14155552671", Text: " "}, true},
+	}
+
+	for i, tt := range table {
+		t.Run(fmt.Sprintf("Case#%d", i), func(t *testing.T) {
+			err := tt.Msg.Validate()
+			assert.Equal(t, tt.WantErr, err != nil)
+		})
+	}
+}
+
+func TestLog_Send(t *testing.T) {
+	t.Parallel()
+
+	assert.NoError(t, sms.Log{}.Send(context.Background(), sms.Message{To: "+14155552671", Text: "Hello"}))
+	assert.Error(t, sms.Log{}.Send(context.Background(), sms.Message{To: "nope", Text: "Hello"}))
+	assert.NoError(t, sms.Log{ShowText: true}.Send(context.Background(), sms.Message{To: "+14155552671", Text: "Hello"}))
+}
@@ -0,0 +1,20 @@
+package strutils
+
+import (
+	"regexp"
+	"strings"
+)
+
+var e164Pattern = regexp.MustCompile(`^\+[1-9][0-9]{7,14}$`)
+
+// NormalizePhone strips the common formatting characters (spaces, dashes,
+// dots and parentheses) from the phone number and returns it in E.164
+// format. Returns false if the result is not a valid E.164 number.
+func NormalizePhone(phone string) (string, bool) {
+	phone = strings.NewReplacer(" ", "", "-", "", ".", "", "(", "", ")", "").
+		Replace(strings.TrimSpace(phone))
+	if !e164Pattern.MatchString(phone) {
+		return "", false
+	}
+	return phone, true
+}
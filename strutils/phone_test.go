@@ -0,0 +1,37 @@
+package strutils_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/spy16/pgbase/strutils"
+)
+
+func TestNormalizePhone(t *testing.T) {
+	t.Parallel()
+
+	table := []struct {
+		Phone  string
+		Want   string
+		WantOK bool
+	}{
+		{"+14155552671", "+14155552671", true},
+		{" +1 (415) 555-2671 ", "+14155552671", true},
+		{"+91.98450.12345", "+919845012345", true},
+		{"14155552671", "", false},
+		{"+04155552671", "", false},
+		{"+1415", "", false},
+		{"+1415555abcd", "", false},
+		{"", "", false},
+	}
+
+	for i, tt := range table {
+		t.Run(fmt.Sprintf("Case#%d", i), func(t *testing.T) {
+			got, ok := strutils.NormalizePhone(tt.Phone)
+			assert.Equal(t, tt.WantOK, ok)
+			assert.Equal(t, tt.Want, got)
+		})
+	}
+}